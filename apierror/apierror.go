@@ -0,0 +1,58 @@
+// Package apierror defines the failure kinds of an upstream API call, so
+// callers can branch on them with errors.Is and errors.As.
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	// ErrUpstreamUnreachable wraps transport failures where no response was
+	// received.
+	ErrUpstreamUnreachable = errors.New("upstream unreachable")
+
+	// ErrUpstreamDecode wraps failures reading or parsing an upstream body.
+	ErrUpstreamDecode = errors.New("failed to decode upstream response")
+
+	// ErrUpstreamTruncated marks bodies cut short by the upstream connection
+	// dropping. It also matches ErrUpstreamDecode.
+	ErrUpstreamTruncated = errors.New("truncated upstream response")
+
+	// ErrUpstreamAuth marks failures to apply credentials and upstream 401
+	// responses, which mean the token is invalid or expired. 403 is left out
+	// as GitHub also uses it for exhausted rate limits.
+	ErrUpstreamAuth = errors.New("upstream authentication failed")
+)
+
+// UpstreamStatusError reports a non-2xx upstream response.
+type UpstreamStatusError struct {
+	Code int
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.Code)
+}
+
+// Is makes 401 responses match ErrUpstreamAuth.
+func (e *UpstreamStatusError) Is(target error) bool {
+	return target == ErrUpstreamAuth && e.Code == http.StatusUnauthorized
+}
+
+// Unreachable wraps err as an ErrUpstreamUnreachable, keeping err in the
+// chain so timeouts remain detectable.
+func Unreachable(err error) error {
+	return fmt.Errorf("%w: %w", ErrUpstreamUnreachable, err)
+}
+
+// Decode wraps err as an ErrUpstreamDecode, additionally marking it as
+// ErrUpstreamTruncated when the body ended early.
+func Decode(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w: %w", ErrUpstreamDecode, ErrUpstreamTruncated, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrUpstreamDecode, err)
+}
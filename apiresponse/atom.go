@@ -0,0 +1,87 @@
+package apiresponse
+
+import (
+	"cmp"
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Link    *atomLink `xml:"link,omitempty"`
+	Updated string    `xml:"updated"`
+	Summary string    `xml:"summary,omitempty"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+// WriteAtom renders the repos as an Atom feed identified by id and written by
+// author, one entry per repo. Entries are dated by their last update, or last push. Undated entries
+// take the feed's date, the latest of those, so the output stays stable for
+// the same repos; only a feed with no dates at all uses the current time.
+func (r Repos) WriteAtom(w io.Writer, id, title, author string) error {
+	var latest time.Time
+	for _, repo := range r {
+		if t := repo.updated(); t != nil && t.After(latest) {
+			latest = *t
+		}
+	}
+	if latest.IsZero() {
+		latest = time.Now()
+	}
+
+	// Entries have no author of their own, so Atom requires the feed's.
+	feed := atomFeed{ID: id, Title: title, Updated: atomTime(latest), Author: atomAuthor{Name: author}}
+	for _, repo := range r {
+		updated := latest
+		if t := repo.updated(); t != nil {
+			updated = *t
+		}
+
+		entry := atomEntry{
+			ID:      cmp.Or(repo.HTMLURL, repo.Url),
+			Title:   cmp.Or(repo.Name, repo.Url),
+			Updated: atomTime(updated),
+			Summary: repo.Description,
+		}
+		if repo.HTMLURL != "" {
+			entry.Link = &atomLink{Href: repo.HTMLURL}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	return xml.NewEncoder(w).Encode(feed)
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (repo Repo) updated() *time.Time {
+	if repo.UpdatedAt != nil {
+		return repo.UpdatedAt
+	}
+
+	return repo.PushedAt
+}
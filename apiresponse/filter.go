@@ -0,0 +1,48 @@
+package apiresponse
+
+// Predicate reports whether a repo should be kept by Filter.
+type Predicate func(Repo) bool
+
+// Filter returns the repos satisfying every predicate, preserving order. The
+// result never aliases r.
+func (r Repos) Filter(keep ...Predicate) Repos {
+	filtered := make(Repos, 0, len(r))
+
+next:
+	for _, repo := range r {
+		for _, p := range keep {
+			if !p(repo) {
+				continue next
+			}
+		}
+		filtered = append(filtered, repo)
+	}
+
+	return filtered
+}
+
+// NotFork keeps repos that aren't forks.
+func NotFork(repo Repo) bool {
+	return !repo.Fork
+}
+
+// NotArchived keeps repos that aren't archived.
+func NotArchived(repo Repo) bool {
+	return !repo.Archived
+}
+
+// HasVisibility keeps repos with the given visibility ("public", "private" or
+// "internal"). Repos predating the upstream visibility field fall back to
+// their private flag.
+func HasVisibility(visibility string) Predicate {
+	return func(repo Repo) bool {
+		v := repo.Visibility
+		if v == "" {
+			v = "public"
+			if repo.Private {
+				v = "private"
+			}
+		}
+		return v == visibility
+	}
+}
@@ -0,0 +1,70 @@
+package apiresponse
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// KeyCase selects how JSON object keys are spelled on output.
+type KeyCase int
+
+const (
+	// UpstreamCase keeps GitHub's snake_case keys.
+	UpstreamCase KeyCase = iota
+	// CamelCase converts keys to camelCase, e.g. html_url to htmlUrl.
+	CamelCase
+)
+
+// Recase returns v ready to be encoded with its JSON object keys spelled in c.
+// Keys are converted at every depth, so v must not contain maps whose keys are
+// data rather than field names.
+func Recase(v any, c KeyCase) (any, error) {
+	if c == UpstreamCase {
+		return v, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return camelKeys(generic), nil
+}
+
+func camelKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, elem := range v {
+			out[camel(k)] = camelKeys(elem)
+		}
+		return out
+	case []any:
+		for i, elem := range v {
+			v[i] = camelKeys(elem)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func camel(key string) string {
+	words := strings.Split(key, "_")
+	for i := 1; i < len(words); i++ {
+		if w := words[i]; w != "" {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+
+	return strings.Join(words, "")
+}
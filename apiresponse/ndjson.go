@@ -0,0 +1,28 @@
+package apiresponse
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// WriteNDJSON writes each repo as a JSON object on its own line, with keys
+// spelled in c, flushing w after every line when it supports flushing.
+func (r Repos) WriteNDJSON(w io.Writer, c KeyCase) error {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(interface{ Flush() })
+
+	for _, repo := range r {
+		v, err := Recase(repo, c)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	return nil
+}
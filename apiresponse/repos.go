@@ -1,7 +1,62 @@
 package apiresponse
 
+import "time"
+
 type Repos []Repo
 
 type Repo struct {
-    Url string `json:"url"`
+	Url      string  `json:"url"`
+	Language *string `json:"language"`
+
+	Name        string `json:"name,omitempty"`
+	HTMLURL     string `json:"html_url,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Fork       bool   `json:"fork"`
+	Archived   bool   `json:"archived"`
+	Private    bool   `json:"private"`
+	Visibility string `json:"visibility,omitempty"`
+
+	Stars     int        `json:"stargazers_count"`
+	Forks     int        `json:"forks_count"`
+	PushedAt  *time.Time `json:"pushed_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// UnknownLanguage groups repos that have no detected language.
+const UnknownLanguage = "unknown"
+
+// Offset returns the repos remaining after skipping the first n, which is
+// empty if n is beyond the end of the list.
+func (r Repos) Offset(n int) Repos {
+	if n <= 0 {
+		return r
+	}
+
+	return r[min(n, len(r)):]
+}
+
+// Limit returns at most the first n repos.
+func (r Repos) Limit(n int) Repos {
+	if n < 0 || n >= len(r) {
+		return r
+	}
+
+	return r[:n]
+}
+
+// GroupByLanguage buckets the repos by their primary language, preserving
+// order within each bucket.
+func (r Repos) GroupByLanguage() map[string]Repos {
+	groups := make(map[string]Repos)
+
+	for _, repo := range r {
+		lang := UnknownLanguage
+		if repo.Language != nil && *repo.Language != "" {
+			lang = *repo.Language
+		}
+		groups[lang] = append(groups[lang], repo)
+	}
+
+	return groups
 }
@@ -0,0 +1,32 @@
+package apiresponse
+
+import "time"
+
+// Summary aggregates a list of repos.
+type Summary struct {
+	Repos        int            `json:"repos"`
+	Stars        int            `json:"stars"`
+	Forks        int            `json:"forks"`
+	Languages    map[string]int `json:"languages"`
+	LastPushedAt *time.Time     `json:"last_pushed_at"`
+}
+
+// Summarize totals the stars and forks of the repos, counts them per language
+// (repos without one count as UnknownLanguage) and finds the most recent push.
+func (r Repos) Summarize() Summary {
+	s := Summary{Repos: len(r), Languages: make(map[string]int)}
+
+	for lang, repos := range r.GroupByLanguage() {
+		s.Languages[lang] = len(repos)
+	}
+
+	for _, repo := range r {
+		s.Stars += repo.Stars
+		s.Forks += repo.Forks
+		if repo.PushedAt != nil && (s.LastPushedAt == nil || repo.PushedAt.After(*s.LastPushedAt)) {
+			s.LastPushedAt = repo.PushedAt
+		}
+	}
+
+	return s
+}
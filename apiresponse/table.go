@@ -0,0 +1,24 @@
+package apiresponse
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// WriteTable renders the repos as an aligned plain text table of name, stars
+// and language, for reading in a terminal. Repos without a language show "-".
+func (r Repos) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTARS\tLANGUAGE")
+
+	for _, repo := range r {
+		lang := "-"
+		if repo.Language != nil && *repo.Language != "" {
+			lang = *repo.Language
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", repo.Name, repo.Stars, lang)
+	}
+
+	return tw.Flush()
+}
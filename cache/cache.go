@@ -0,0 +1,126 @@
+// Package cache provides an in-memory, TTL-bounded store for upstream
+// responses.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// Entry is a cached value along with the time it was fetched.
+type Entry[V any] struct {
+	Value     V
+	FetchedAt time.Time
+	ExpiresAt time.Time
+}
+
+type item[V any] struct {
+	key   string
+	entry Entry[V]
+}
+
+// Cache is a concurrency-safe map of entries that expire after a fixed TTL.
+// When maxEntries is non-zero the least recently used entry is evicted to
+// make room for new ones.
+type Cache[V any] struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	ttl        time.Duration
+	grace      time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // front is most recently used
+}
+
+func New[V any](ttl time.Duration, maxEntries int, clk clock.Clock) *Cache[V] {
+	return &Cache[V]{
+		clock:      clk,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// KeepStale retains entries for grace past their expiry, for GetStale.
+func (c *Cache[V]) KeepStale(grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.grace = grace
+}
+
+// Get returns the entry stored under key, provided it hasn't expired.
+func (c *Cache[V]) Get(key string) (Entry[V], bool) {
+	e, fresh, ok := c.GetStale(key)
+	if !fresh {
+		return Entry[V]{}, false
+	}
+
+	return e, ok
+}
+
+// GetStale is like Get, but also returns an entry that has expired within
+// the KeepStale grace period, reporting whether it is still fresh.
+func (c *Cache[V]) GetStale(key string) (e Entry[V], fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return Entry[V]{}, false, false
+	}
+
+	e = elem.Value.(*item[V]).entry
+	now := c.clock.Now()
+	if !now.Before(e.ExpiresAt.Add(c.grace)) {
+		c.remove(elem)
+		return Entry[V]{}, false, false
+	}
+	c.lru.MoveToFront(elem)
+
+	return e, now.Before(e.ExpiresAt), true
+}
+
+// Set stores value under key, replacing any existing entry.
+func (c *Cache[V]) Set(key string, value V) {
+	c.SetTTL(key, value, c.ttl)
+}
+
+// SetTTL is like Set, but the entry expires after ttl instead of the cache's
+// TTL.
+func (c *Cache[V]) SetTTL(key string, value V, ttl time.Duration) {
+	now := c.clock.Now()
+	e := Entry[V]{Value: value, FetchedAt: now, ExpiresAt: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*item[V]).entry = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&item[V]{key: key, entry: e})
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Flush removes every entry.
+func (c *Cache[V]) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+	c.lru.Init()
+}
+
+func (c *Cache[V]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*item[V]).key)
+}
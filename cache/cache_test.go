@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+func TestTTL(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := New[string](time.Minute, 0, clk)
+	c.Set("k", "v")
+
+	clk.Advance(time.Minute - time.Second)
+	e, ok := c.Get("k")
+	if !ok || e.Value != "v" {
+		t.Fatalf("Get before expiry = %v, %t, want v", e.Value, ok)
+	}
+	if want := time.Unix(0, 0).Add(time.Minute); !e.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %s, want %s", e.ExpiresAt, want)
+	}
+
+	clk.Advance(time.Second)
+	if _, ok := c.Get("k"); ok {
+		t.Error("Get at expiry found the entry, want it expired")
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := New[string](time.Minute, 2, clk)
+
+	c.Set("a", "1")
+	clk.Advance(time.Second)
+	c.Set("b", "2")
+	clk.Advance(time.Second)
+
+	// Using a makes b the least recently used, despite a being older.
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing before the cache was full")
+	}
+	c.Set("c", "3")
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b kept, want it evicted as the least recently used")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s evicted, want it kept", key)
+		}
+	}
+
+	// Replacing an entry doesn't make room for anything.
+	c.Set("c", "4")
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s evicted by replacing c, want it kept", key)
+		}
+	}
+	if e, _ := c.Get("c"); e.Value != "4" {
+		t.Errorf("c = %q, want the replacement 4", e.Value)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := New[string](time.Minute, 2, clock.NewFake(time.Unix(0, 0)))
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Flush()
+
+	for _, key := range []string{"a", "b"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s kept across a flush", key)
+		}
+	}
+
+	// The emptied cache still bounds its entries.
+	c.Set("c", "3")
+	c.Set("d", "4")
+	c.Set("e", "5")
+	if _, ok := c.Get("c"); ok {
+		t.Error("c kept, want it evicted as the least recently used")
+	}
+}
+
+func TestKeepStale(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := New[string](time.Minute, 0, clk)
+	c.KeepStale(30 * time.Second)
+	c.Set("k", "v")
+
+	if _, fresh, ok := c.GetStale("k"); !ok || !fresh {
+		t.Fatalf("GetStale within the TTL = fresh %t, ok %t, want a fresh entry", fresh, ok)
+	}
+
+	clk.Advance(time.Minute)
+	if _, ok := c.Get("k"); ok {
+		t.Error("Get returned a stale entry")
+	}
+	if e, fresh, ok := c.GetStale("k"); !ok || fresh || e.Value != "v" {
+		t.Errorf("GetStale within the grace period = %q, fresh %t, ok %t, want the stale entry", e.Value, fresh, ok)
+	}
+
+	clk.Advance(30 * time.Second)
+	if _, _, ok := c.GetStale("k"); ok {
+		t.Error("GetStale returned an entry past the grace period")
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := New[string](time.Minute, 0, clk)
+	c.SetTTL("short", "v", 10*time.Second)
+	c.Set("default", "v")
+
+	clk.Advance(10 * time.Second)
+	if _, ok := c.Get("short"); ok {
+		t.Error("entry kept past its own TTL")
+	}
+	if _, ok := c.Get("default"); !ok {
+		t.Error("entry set with the cache's TTL expired early")
+	}
+
+	// Replacing an entry gives it the new lifetime.
+	c.SetTTL("default", "v", time.Hour)
+	clk.Advance(time.Minute)
+	if _, ok := c.Get("default"); !ok {
+		t.Error("replaced entry expired with its old TTL")
+	}
+}
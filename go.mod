@@ -1,3 +1,8 @@
 module github.com/tcuthbert/apiserver
 
 go 1.23.1
+
+require (
+	github.com/jmespath/go-jmespath v0.4.0
+	golang.org/x/sys v0.30.0
+)
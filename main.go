@@ -1,26 +1,228 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strings"
+	"time"
 
 	srv "github.com/tcuthbert/apiserver/webserver"
 )
 
+// exitUsage is the exit status for invalid command line arguments.
+const exitUsage = 2
+
 var (
 	apiBaseURL = "https://api.github.com/"
 	listenAddr = ":5000"
 )
 
+// errPrintConfig is returned by parseFlags when -print-config asks for the
+// configuration to be printed instead of served.
+var errPrintConfig = errors.New("print config requested")
+
 func main() {
-	flag.StringVar(&listenAddr, "listen-addr", listenAddr, "server listen address")
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
 
-	if err := srv.Start(&listenAddr, apiBaseURL + `users/tcuthbert/repos`); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start server: %s\n", err)
-		os.Exit(1)
+// run serves the configuration given by args, looking up environment
+// variables with getenv, and returns the process exit status.
+func run(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	cfg, err := parseFlags(args, getenv)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		printUsage(stderr)
+		return 0
+	case errors.Is(err, errPrintConfig):
+		if err := cfg.Print(stdout); err != nil {
+			fmt.Fprintf(stderr, "Failed to print config: %s\n", err)
+			return 1
+		}
+		return 0
+	case err != nil:
+		log.New(stderr, "apiserver: ", log.LstdFlags).Printf("ERROR: invalid arguments: %v", err)
+		printUsage(stderr)
+		return exitUsage
 	}
 
-	os.Exit(0)
+	if err := srv.Start(cfg); err != nil {
+		fmt.Fprintf(stderr, "Failed to start server: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// parseFlags resolves the configuration given by args, looking up
+// environment variables with getenv. It returns flag.ErrHelp if help was
+// requested and errPrintConfig if -print-config was given.
+func parseFlags(args []string, getenv func(string) string) (srv.Config, error) {
+	cfg := defaultConfig()
+	var printConfig bool
+	fs := newFlagSet(&cfg, &printConfig)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	// Secrets fall back to the environment only after parsing, so that -h
+	// and usage errors never print them as flag defaults.
+	if cfg.GitHubToken == "" {
+		cfg.GitHubToken = getenv("GITHUB_TOKEN")
+	}
+	if cfg.UpstreamHMACSecret == "" {
+		cfg.UpstreamHMACSecret = getenv("UPSTREAM_HMAC_SECRET")
+	}
+
+	if printConfig {
+		return cfg, errPrintConfig
+	}
+
+	return cfg, nil
+}
+
+// defaultConfig is the configuration before any flags are applied.
+func defaultConfig() srv.Config {
+	cfg := srv.DefaultConfig()
+	cfg.ListenAddr = listenAddr
+	cfg.APIURL = apiBaseURL + `users/tcuthbert/repos`
+
+	return cfg
+}
+
+// newFlagSet defines every flag, each setting its field of cfg and defaulting
+// to its current value, and -print-config setting printConfig.
+func newFlagSet(cfg *srv.Config, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&cfg.ListenAddr, "listen-addr", cfg.ListenAddr, "server listen address")
+	fs.IntVar(&cfg.ListenBacklog, "listen-backlog", cfg.ListenBacklog, "maximum queued connections awaiting accept, 0 keeps the kernel default")
+	fs.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "maximum open connections from one remote IP, 0 is unlimited; behind a proxy every client shares its IP")
+	fs.BoolVar(&cfg.ReusePort, "reuse-port", cfg.ReusePort, "set SO_REUSEPORT so several processes can share -listen-addr")
+	fs.Func("features", "comma-separated `features` to enable (cache, retry, metrics or none; default all)", func(v string) (err error) {
+		cfg.Features, err = srv.ParseFeatures(v)
+		return err
+	})
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "append logs to this file instead of stdout")
+	fs.StringVar(&cfg.AuditLogFile, "audit-log-file", cfg.AuditLogFile, "append the JSON audit log of admin actions to this file instead of the main log")
+	fs.BoolVar(&cfg.DebugLogBodies, "debug-log-bodies", cfg.DebugLogBodies, "log upstream and downstream bodies with credentials redacted")
+	fs.IntVar(&cfg.DebugLogMaxBytes, "debug-log-max-bytes", cfg.DebugLogMaxBytes, "truncate bodies logged by -debug-log-bodies to this many bytes")
+	fs.DurationVar(&cfg.StatsInterval, "stats-interval", cfg.StatsInterval, "interval at which per-route response time percentiles are logged, 0 disables")
+	fs.StringVar(&cfg.GitHubToken, "github-token", cfg.GitHubToken, "GitHub API token, defaults to $GITHUB_TOKEN")
+	fs.StringVar(&cfg.GitHubTokenFile, "github-token-file", cfg.GitHubTokenFile, "file holding the GitHub API token, reloaded when it changes; overrides -github-token")
+	fs.StringVar(&cfg.UpstreamHMACSecret, "upstream-hmac-secret", cfg.UpstreamHMACSecret, "secret signing upstream requests with HMAC-SHA256, defaults to $UPSTREAM_HMAC_SECRET")
+	fs.Func("admin-api-keys", "comma-separated API `keys` authorising the /admin and /whoami endpoints", func(v string) error {
+		cfg.AdminAPIKeys = strings.Split(v, ",")
+		return nil
+	})
+	fs.IntVar(&cfg.MaxActiveAPIRequests, "max-active-requests", cfg.MaxActiveAPIRequests, "maximum concurrent upstream API requests")
+	fs.StringVar(&cfg.MaxActiveAPIRequestsFile, "max-active-requests-file", cfg.MaxActiveAPIRequestsFile, "file holding the maximum concurrent upstream API requests, re-read on SIGHUP")
+	fs.IntVar(&cfg.MaxBackgroundRequests, "max-background-requests", cfg.MaxBackgroundRequests, "maximum concurrent upstream calls by background tasks, which always yield to client requests")
+	fs.BoolVar(&cfg.RateLimitCountQueued, "rate-limit-count-queued", cfg.RateLimitCountQueued, "count queued requests against -max-active-requests, answering 503 instead of queueing")
+	fs.DurationVar(&cfg.SlowStartDuration, "slow-start-duration", cfg.SlowStartDuration, "ramp concurrent upstream API requests up from 1 over this long after startup, 0 disables slow start")
+	fs.IntVar(&cfg.MaxInFlight, "max-inflight", cfg.MaxInFlight, "maximum in-flight API requests before answering 503, 0 is unlimited")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "total time allowed to serve an API request")
+	fs.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", cfg.UpstreamTimeout, "time allowed for the upstream call, must not exceed -request-timeout")
+	fs.Float64Var(&cfg.AdaptiveTimeoutFactor, "adaptive-timeout-factor", cfg.AdaptiveTimeoutFactor, "derive the upstream timeout as this multiple of the recent p95 upstream latency, 0 disables")
+	fs.DurationVar(&cfg.AdaptiveTimeoutMin, "adaptive-timeout-min", cfg.AdaptiveTimeoutMin, "lower bound of the adaptive upstream timeout")
+	fs.DurationVar(&cfg.AdaptiveTimeoutMax, "adaptive-timeout-max", cfg.AdaptiveTimeoutMax, "upper bound of the adaptive upstream timeout (default -upstream-timeout)")
+	fs.Func("route-upstream-timeout", "comma-separated path=duration `timeouts` overriding -upstream-timeout per route, e.g. /summary=30s", func(v string) (err error) {
+		cfg.RouteUpstreamTimeouts, err = srv.ParseRouteTimeouts(v)
+		return err
+	})
+	fs.DurationVar(&cfg.MaxConnLifetime, "max-conn-lifetime", cfg.MaxConnLifetime, "maximum lifetime of a client connection, 0 is unlimited")
+	fs.BoolVar(&cfg.Maintenance, "maintenance", cfg.Maintenance, "start in maintenance mode, answering 503 on API routes (toggle with SIGUSR1)")
+	fs.DurationVar(&cfg.DrainDelay, "drain-delay", cfg.DrainDelay, "time to refuse new requests with 503 before shutting down")
+	fs.StringVar(&cfg.ShutdownWebhookURL, "shutdown-webhook-url", cfg.ShutdownWebhookURL, "URL to POST to when graceful shutdown begins")
+	fs.Func("shutdown-signals", "comma-separated `signals` that trigger a graceful shutdown (default SIGINT,SIGTERM)", func(v string) (err error) {
+		cfg.ShutdownSignals, err = srv.ParseShutdownSignals(v)
+		return err
+	})
+	fs.IntVar(&cfg.MaxPages, "max-pages", cfg.MaxPages, "maximum number of upstream pages to follow")
+	fs.BoolVar(&cfg.PartialOK, "partial-ok", cfg.PartialOK, "serve already-fetched pages with a Warning header when a later page fails")
+	fs.IntVar(&cfg.MaxRetries, "max-retries", cfg.MaxRetries, "maximum retries of a failed upstream attempt")
+	fs.BoolVar(&cfg.RetryTimeouts, "retry-timeouts", cfg.RetryTimeouts, "retry upstream attempts that time out")
+	fs.BoolVar(&cfg.Retry5xx, "retry-5xx", cfg.Retry5xx, "retry upstream attempts answered with a 5xx status")
+	fs.Float64Var(&cfg.RetryBudgetRatio, "retry-budget-ratio", cfg.RetryBudgetRatio, "cap retries across all requests at this fraction of requests, 0 is uncapped")
+	fs.DurationVar(&cfg.RetryBackoff, "retry-backoff", cfg.RetryBackoff, "delay before the first retry, which must be positive if -max-retries is; later ones are drawn at random from it up to three times the previous delay")
+	fs.DurationVar(&cfg.RetryBackoffCap, "retry-backoff-cap", cfg.RetryBackoffCap, "maximum delay before a retry")
+	fs.IntVar(&cfg.DNSRetries, "dns-retries", cfg.DNSRetries, "retries of an upstream dial failing on a temporary DNS error, independent of -max-retries")
+	fs.DurationVar(&cfg.DNSRetryBackoff, "dns-retry-backoff", cfg.DNSRetryBackoff, "delay before the first DNS retry, doubled for each subsequent one")
+	fs.DurationVar(&cfg.HedgeDelay, "hedge-delay", cfg.HedgeDelay, "send a second upstream request if the first is unanswered after this long, 0 disables hedging")
+	fs.DurationVar(&cfg.UpstreamAttemptTimeout, "upstream-attempt-timeout", cfg.UpstreamAttemptTimeout, "time allowed for a single upstream attempt, 0 leaves only -upstream-timeout")
+	fs.IntVar(&cfg.MaxLimit, "max-limit", cfg.MaxLimit, "maximum value accepted for the limit query parameter")
+	fs.BoolVar(&cfg.StrictQuery, "strict-query", cfg.StrictQuery, "reject requests with unrecognised query parameters")
+	fs.BoolVar(&cfg.ExposeUpstreamAPIVersion, "expose-upstream-api-version", cfg.ExposeUpstreamAPIVersion, "send the GitHub API version last reported by the upstream as X-Upstream-Api-Version")
+	fs.BoolVar(&cfg.StrictUpstreamDecode, "strict-upstream-decode", cfg.StrictUpstreamDecode, "fail upstream pages with fields the server doesn't know, instead of ignoring them")
+	fs.BoolVar(&cfg.EmptyAs204, "empty-as-204", cfg.EmptyAs204, "answer 204 No Content when no repos are left to return")
+	fs.BoolVar(&cfg.DeprecateLegacyShape, "deprecate-legacy-shape", cfg.DeprecateLegacyShape, "mark JSON responses not using ?envelope with a Deprecation header")
+	fs.Func("legacy-sunset", "`date` (YYYY-MM-DD or RFC 3339) sent as the Sunset header of deprecated legacy responses", func(v string) (err error) {
+		cfg.LegacySunset, err = time.Parse(time.DateOnly, v)
+		if err != nil {
+			cfg.LegacySunset, err = time.Parse(time.RFC3339, v)
+		}
+		return err
+	})
+	fs.BoolVar(&cfg.CLIMode, "cli-mode", cfg.CLIMode, "answer command line tools accepting any type, or clients passing ?cli=1, with a plain text table; ?cli=0 opts out")
+	fs.IntVar(&cfg.MaxResponseBytes, "max-response-bytes", cfg.MaxResponseBytes, "largest response body buffered before sending, answering 500 beyond it; streamed responses are unbounded")
+	fs.DurationVar(&cfg.MaxEncodeTime, "max-encode-time", cfg.MaxEncodeTime, "answer 503 if transforming and encoding a response takes longer, 0 is unbounded")
+	fs.BoolVar(&cfg.UpstreamPassthrough, "upstream-passthrough", cfg.UpstreamPassthrough, "forward the type, sort, direction and per_page query parameters to GitHub")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", cfg.CacheTTL, "upstream response cache TTL, 0 disables caching")
+	fs.DurationVar(&cfg.CacheWarmInterval, "cache-warm-interval", cfg.CacheWarmInterval, "background cache refresh interval, 0 disables warming")
+	fs.BoolVar(&cfg.CacheHonorUpstream, "cache-honor-upstream", cfg.CacheHonorUpstream, "cache responses for as long as the upstream's Cache-Control or Expires header allows, falling back to -cache-ttl")
+	fs.DurationVar(&cfg.CacheStaleWhileRevalidate, "cache-stale-while-revalidate", cfg.CacheStaleWhileRevalidate, "serve expired cache entries for this long while refreshing them in the background")
+	fs.IntVar(&cfg.CacheMaxEntries, "cache-max-entries", cfg.CacheMaxEntries, "maximum cached responses before least-recently-used eviction, 0 is unbounded")
+	fs.StringVar(&cfg.CacheControl, "cache-control", cfg.CacheControl, "Cache-Control header for successful responses, defaults to max-age of -cache-ttl")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long responses are replayed to requests repeating an Idempotency-Key, 0 disables replays")
+	fs.IntVar(&cfg.IdempotencyMaxKeys, "idempotency-max-keys", cfg.IdempotencyMaxKeys, "maximum idempotency keys remembered, 0 is unbounded")
+	fs.BoolVar(&cfg.WarmupGate, "warmup-gate", cfg.WarmupGate, "return 503 until the cache has been warmed")
+	fs.DurationVar(&cfg.UpstreamKeepaliveInterval, "upstream-keepalive-interval", cfg.UpstreamKeepaliveInterval, "interval at which the upstream host is pinged to keep a warm connection, 0 disables pinging")
+	fs.DurationVar(&cfg.UpstreamIdleReapInterval, "upstream-idle-reap-interval", cfg.UpstreamIdleReapInterval, "interval at which idle upstream connections are closed, 0 disables reaping")
+	fs.StringVar(&cfg.UpstreamProxy, "upstream-proxy", cfg.UpstreamProxy, "proxy URL for upstream requests, overrides $HTTPS_PROXY")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", cfg.TLSCertFile, "PEM certificate to serve HTTPS with, requires -tls-key-file")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", cfg.TLSKeyFile, "PEM private key for -tls-cert-file")
+	fs.Func("tls-min-version", "minimum TLS `version` served, 1.2 or 1.3 (default 1.2)", func(v string) (err error) {
+		cfg.TLSMinVersion, err = srv.ParseTLSVersion(v)
+		return err
+	})
+	fs.Func("tls-cipher-suites", "comma-separated TLS 1.2 cipher `suites` to offer (default ECDHE with AES-GCM or ChaCha20-Poly1305)", func(v string) (err error) {
+		cfg.TLSCipherSuites, err = srv.ParseTLSCipherSuites(v)
+		return err
+	})
+	fs.StringVar(&cfg.UpstreamCAFile, "upstream-ca-file", cfg.UpstreamCAFile, "PEM CA bundle used to verify the upstream TLS certificate")
+	fs.BoolVar(&cfg.UpstreamInsecureSkipVerify, "upstream-insecure-skip-verify", cfg.UpstreamInsecureSkipVerify, "disable upstream TLS certificate verification (development only)")
+	fs.BoolVar(&cfg.AllowUpstreamOverride, "allow-upstream-override", cfg.AllowUpstreamOverride, "honour the X-Upstream-Override header from -trusted-proxies")
+	fs.Func("forward-upstream-headers", "comma-separated upstream response `headers` /raw forwards besides Content-Type, * for all", func(v string) error {
+		cfg.ForwardUpstreamHeaders = strings.Split(v, ",")
+		return nil
+	})
+	fs.Func("strip-upstream-headers", "comma-separated upstream response `headers` never forwarded (default Set-Cookie,X-GitHub-Request-Id)", func(v string) error {
+		cfg.StripUpstreamHeaders = strings.Split(v, ",")
+		return nil
+	})
+	fs.Func("trusted-proxies", "comma-separated proxy `addresses` or CIDRs allowed to override the upstream host", func(v string) error {
+		cfg.TrustedProxies = strings.Split(v, ",")
+		return nil
+	})
+	fs.Func("upstream-override-hosts", "comma-separated `hosts` X-Upstream-Override may select", func(v string) error {
+		cfg.UpstreamOverrideHosts = strings.Split(v, ",")
+		return nil
+	})
+	fs.BoolVar(&cfg.RequireUpstreamOnStart, "require-upstream-on-start", cfg.RequireUpstreamOnStart, "fail startup if the upstream can't be reached")
+	fs.BoolVar(&cfg.PropagateTrace, "propagate-trace", cfg.PropagateTrace, "forward the incoming traceparent and tracestate headers upstream")
+	fs.StringVar(&cfg.CorrelationHeader, "correlation-header", cfg.CorrelationHeader, "incoming request header to forward upstream, e.g. X-Request-ID")
+	fs.StringVar(&cfg.RobotsTxtFile, "robots-txt-file", cfg.RobotsTxtFile, "file served as /robots.txt, by default disallowing all crawling")
+	fs.StringVar(&cfg.FallbackFile, "fallback-file", cfg.FallbackFile, "JSON file served when the upstream is unavailable")
+	fs.BoolVar(printConfig, "print-config", *printConfig, "print the resolved configuration and exit")
+	// The flag package's own error message and usage are replaced by the
+	// logged error in run, followed by the grouped usage.
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	return fs
 }
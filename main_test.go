@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	srv "github.com/tcuthbert/apiserver/webserver"
+)
+
+// noEnv is a getenv with no variables set.
+func noEnv(string) string { return "" }
+
+func TestParseFlags(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		args  []string
+		check func(t *testing.T, cfg srv.Config)
+	}{
+		{"defaults", nil, func(t *testing.T, cfg srv.Config) {
+			if cfg.ListenAddr != listenAddr {
+				t.Errorf("ListenAddr = %q, want %q", cfg.ListenAddr, listenAddr)
+			}
+		}},
+		{"duration", []string{"-request-timeout=45s"}, func(t *testing.T, cfg srv.Config) {
+			if cfg.RequestTimeout != 45*time.Second {
+				t.Errorf("RequestTimeout = %s, want 45s", cfg.RequestTimeout)
+			}
+		}},
+		{"list", []string{"-trusted-proxies", "10.0.0.0/8,192.168.1.10"}, func(t *testing.T, cfg srv.Config) {
+			if want := []string{"10.0.0.0/8", "192.168.1.10"}; !slices.Equal(cfg.TrustedProxies, want) {
+				t.Errorf("TrustedProxies = %q, want %q", cfg.TrustedProxies, want)
+			}
+		}},
+		{"legacy sunset date", []string{"-legacy-sunset=2027-01-01"}, func(t *testing.T, cfg srv.Config) {
+			if want := time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC); !cfg.LegacySunset.Equal(want) {
+				t.Errorf("LegacySunset = %s, want %s", cfg.LegacySunset, want)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseFlags(tt.args, noEnv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"-h"}, flag.ErrHelp},
+		{[]string{"-print-config"}, errPrintConfig},
+		{[]string{"-no-such-flag"}, nil},
+		{[]string{"-max-pages=many"}, nil},
+		{[]string{"-tls-min-version=1.1"}, nil},
+		{[]string{"-features=cache,teleport"}, nil},
+	} {
+		_, err := parseFlags(tt.args, noEnv)
+		if err == nil {
+			t.Errorf("parseFlags(%q) succeeded, want an error", tt.args)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("parseFlags(%q) = %v, want %v", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestRunExitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		args       []string
+		want       int
+		wantStderr string
+	}{
+		{[]string{"-h"}, 0, "Usage of"},
+		{[]string{"-no-such-flag"}, exitUsage, "invalid arguments"},
+		{[]string{"-max-pages=many"}, exitUsage, "invalid arguments"},
+		{[]string{"-print-config"}, 0, ""},
+		// Flag parsing stops at the first argument, which would hide the rest.
+		{[]string{"stray", "-print-config"}, exitUsage, "unexpected argument"},
+	} {
+		var stdout, stderr strings.Builder
+		if got := run(tt.args, noEnv, &stdout, &stderr); got != tt.want {
+			t.Errorf("run(%q) = %d, want %d\n%s", tt.args, got, tt.want, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), tt.wantStderr) {
+			t.Errorf("run(%q) stderr = %q, want it to contain %q", tt.args, stderr.String(), tt.wantStderr)
+		}
+	}
+}
+
+// secretEnv is a getenv with both secrets set.
+func secretEnv(key string) string {
+	switch key {
+	case "GITHUB_TOKEN":
+		return "ghp-secret-token"
+	case "UPSTREAM_HMAC_SECRET":
+		return "s3cr3t-hmac-key"
+	}
+	return ""
+}
+
+func TestSecretsFromEnv(t *testing.T) {
+	cfg, err := parseFlags(nil, secretEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GitHubToken != "ghp-secret-token" || cfg.UpstreamHMACSecret != "s3cr3t-hmac-key" {
+		t.Errorf("secrets = %q, %q, want them from the environment", cfg.GitHubToken, cfg.UpstreamHMACSecret)
+	}
+
+	cfg, err = parseFlags([]string{"-github-token=flag-token"}, secretEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GitHubToken != "flag-token" {
+		t.Errorf("GitHubToken = %q, want the flag to override the environment", cfg.GitHubToken)
+	}
+}
+
+func TestUsageRedactsSecrets(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "ghp-secret-token")
+	t.Setenv("UPSTREAM_HMAC_SECRET", "s3cr3t-hmac-key")
+
+	var b strings.Builder
+	printUsage(&b)
+	for _, args := range [][]string{{"-h"}, {"-no-such-flag"}} {
+		run(args, secretEnv, io.Discard, &b)
+	}
+	for _, secret := range []string{"ghp-secret-token", "s3cr3t-hmac-key"} {
+		if strings.Contains(b.String(), secret) {
+			t.Errorf("usage prints the secret %q", secret)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var stdout, stderr strings.Builder
+	if got := run([]string{"-print-config", "-max-pages=7"}, noEnv, &stdout, &stderr); got != 0 {
+		t.Fatalf("run = %d, want 0\n%s", got, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "MaxPages=7\n") {
+		t.Errorf("printed configuration lacks MaxPages=7:\n%s", stdout.String())
+	}
+}
+
+func TestPrintUsageGroups(t *testing.T) {
+	var b strings.Builder
+	printUsage(&b)
+	usage := b.String()
+
+	// Every flag belongs to a group, so nothing falls through to "Other".
+	if strings.Contains(usage, "\nOther:\n") {
+		t.Errorf("usage has ungrouped flags:\n%s", usage)
+	}
+
+	// Groups appear in order, each with its flags.
+	last := -1
+	for _, group := range flagGroups {
+		i := strings.Index(usage, "\n"+group.name+":\n")
+		if i < 0 {
+			t.Errorf("usage has no %s group", group.name)
+			continue
+		}
+		if i < last {
+			t.Errorf("group %s is out of order", group.name)
+		}
+		last = i
+
+		next := len(usage)
+		if j := strings.Index(usage[i+1:], "\n\n"); j >= 0 {
+			next = i + 1 + j
+		}
+		for _, name := range group.flags {
+			if !strings.Contains(usage[i:next], "\n  -"+name+" ") && !strings.Contains(usage[i:next], "\n  -"+name+"\n") {
+				t.Errorf("flag -%s missing from group %s", name, group.name)
+			}
+		}
+	}
+
+	// Every flag is defined, and only listed once.
+	cfg := defaultConfig()
+	fs := newFlagSet(&cfg, new(bool))
+	fs.VisitAll(func(f *flag.Flag) {
+		if n := strings.Count(usage, "\n  -"+f.Name+" ") + strings.Count(usage, "\n  -"+f.Name+"\n"); n != 1 {
+			t.Errorf("flag -%s listed %d times, want once", f.Name, n)
+		}
+	})
+	for _, group := range flagGroups {
+		for _, name := range group.flags {
+			if fs.Lookup(name) == nil {
+				t.Errorf("group %s lists undefined flag -%s", group.name, name)
+			}
+		}
+	}
+}
+
+func TestPrintUsageExamples(t *testing.T) {
+	var b strings.Builder
+	printUsage(&b)
+
+	for name, example := range flagExamples {
+		if want := "(e.g. -" + name + "=" + example + ")"; !strings.Contains(b.String(), want) {
+			t.Errorf("usage lacks the example %s", want)
+		}
+	}
+}
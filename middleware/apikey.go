@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequireAPIKey rejects requests that don't present one of keys, either as a
+// bearer token or in the X-API-Key header.
+func RequireAPIKey(keys []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if _, ok := MatchAPIKey(r, keys); !ok {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// MatchAPIKey returns the index of the key presented by r, comparing in
+// constant time.
+func MatchAPIKey(r *http.Request, keys []string) (int, bool) {
+	presented := r.Header.Get("X-API-Key")
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		presented = token
+	}
+	if presented == "" {
+		return -1, false
+	}
+
+	for i, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
@@ -0,0 +1,21 @@
+// Package middleware provides composable http.Handler decorators.
+package middleware
+
+import "net/http"
+
+// Middleware decorates an http.Handler with additional behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middleware. The first entry is the outermost
+// decorator and therefore sees the request first and the response last.
+type Chain []Middleware
+
+// Then wraps handler with every middleware in the chain and returns the
+// resulting handler.
+func (c Chain) Then(handler http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		handler = c[i](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var events []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				events = append(events, name+" in")
+				next.ServeHTTP(rw, r)
+				events = append(events, name+" out")
+			})
+		}
+	}
+
+	h := Chain{record("first"), record("second"), record("third")}.Then(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			events = append(events, "handler")
+		}),
+	)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := []string{
+		"first in", "second in", "third in",
+		"handler",
+		"third out", "second out", "first out",
+	}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestEmptyChain(t *testing.T) {
+	called := false
+	h := Chain(nil).Then(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !called {
+		t.Error("empty chain didn't call the handler")
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// MaxInFlight answers 503 Service Unavailable straight away, without queuing,
+// while limit requests are already being served.
+func MaxInFlight(limit int) Middleware {
+	var inFlight atomic.Int64
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			defer inFlight.Add(-1)
+			if inFlight.Add(1) > int64(limit) {
+				http.Error(
+					rw,
+					http.StatusText(http.StatusServiceUnavailable),
+					http.StatusServiceUnavailable,
+				)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
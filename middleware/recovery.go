@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recovery converts a panic in the wrapped handler into a 500 response so one
+// faulty request cannot take down the process. It should be the outermost
+// middleware in a Chain.
+func Recovery(logger *log.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+					panic(err)
+				}
+
+				logger.Printf("ERROR: panic serving %s: %v\n%s", r.URL, err, debug.Stack())
+				http.Error(
+					rw,
+					http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError,
+				)
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Unavailable answers 503 Service Unavailable for as long as unavailable
+// reports true, advertising retryAfter to the client when it is non-zero.
+func Unavailable(unavailable func() bool, retryAfter time.Duration) Middleware {
+	retryAfterSecs := strconv.Itoa(int(retryAfter.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !unavailable() {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if retryAfter > 0 {
+				rw.Header().Set("Retry-After", retryAfterSecs)
+			}
+			http.Error(
+				rw,
+				http.StatusText(http.StatusServiceUnavailable),
+				http.StatusServiceUnavailable,
+			)
+		})
+	}
+}
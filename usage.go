@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// flagGroups orders the -h output by category. Flags missing from every group
+// are listed under "Other" so that a new flag is never hidden.
+var flagGroups = []struct {
+	name  string
+	flags []string
+}{
+	{"Server", []string{
+		"listen-addr",
+		"listen-backlog",
+		"max-conns-per-ip",
+		"reuse-port",
+		"features",
+		"request-timeout",
+		"max-conn-lifetime",
+		"maintenance",
+		"drain-delay",
+		"shutdown-signals",
+		"shutdown-webhook-url",
+		"admin-api-keys",
+		"print-config",
+	}},
+	{"Upstream", []string{
+		"github-token",
+		"github-token-file",
+		"upstream-hmac-secret",
+		"upstream-timeout",
+		"route-upstream-timeout",
+		"adaptive-timeout-factor",
+		"adaptive-timeout-min",
+		"adaptive-timeout-max",
+		"max-pages",
+		"partial-ok",
+		"upstream-proxy",
+		"upstream-idle-reap-interval",
+		"upstream-keepalive-interval",
+		"propagate-trace",
+		"correlation-header",
+		"allow-upstream-override",
+		"trusted-proxies",
+		"upstream-override-hosts",
+		"require-upstream-on-start",
+		"fallback-file",
+	}},
+	{"Retries", []string{
+		"max-retries",
+		"retry-timeouts",
+		"retry-5xx",
+		"retry-budget-ratio",
+		"retry-backoff",
+		"retry-backoff-cap",
+		"dns-retries",
+		"dns-retry-backoff",
+		"upstream-attempt-timeout",
+		"hedge-delay",
+	}},
+	{"Rate limiting", []string{
+		"max-active-requests",
+		"max-active-requests-file",
+		"rate-limit-count-queued",
+		"max-background-requests",
+		"slow-start-duration",
+		"max-inflight",
+	}},
+	{"Caching", []string{
+		"cache-ttl",
+		"cache-stale-while-revalidate",
+		"cache-honor-upstream",
+		"cache-max-entries",
+		"cache-control",
+		"cache-warm-interval",
+		"warmup-gate",
+		"idempotency-ttl",
+		"idempotency-max-keys",
+	}},
+	{"Responses", []string{
+		"max-limit",
+		"strict-query",
+		"upstream-passthrough",
+		"strict-upstream-decode",
+		"expose-upstream-api-version",
+		"forward-upstream-headers",
+		"strip-upstream-headers",
+		"empty-as-204",
+		"cli-mode",
+		"deprecate-legacy-shape",
+		"legacy-sunset",
+		"max-encode-time",
+		"max-response-bytes",
+		"robots-txt-file",
+	}},
+	{"TLS", []string{
+		"tls-cert-file",
+		"tls-key-file",
+		"tls-min-version",
+		"tls-cipher-suites",
+		"upstream-ca-file",
+		"upstream-insecure-skip-verify",
+	}},
+	{"Logging", []string{
+		"log-file",
+		"audit-log-file",
+		"debug-log-bodies",
+		"debug-log-max-bytes",
+		"stats-interval",
+	}},
+}
+
+// flagExamples are shown alongside flags whose format isn't self-evident.
+var flagExamples = map[string]string{
+	"listen-addr":              "127.0.0.1:8080",
+	"request-timeout":          "45s",
+	"drain-delay":              "10s",
+	"features":                 "cache,metrics",
+	"shutdown-signals":         "SIGINT,SIGTERM,SIGQUIT",
+	"max-conn-lifetime":        "10m",
+	"upstream-timeout":         "30s",
+	"upstream-proxy":           "http://proxy.internal:3128",
+	"trusted-proxies":          "10.0.0.0/8,192.168.1.10",
+	"upstream-override-hosts":  "ghe-staging.internal",
+	"retry-budget-ratio":       "0.1",
+	"retry-backoff":            "250ms",
+	"upstream-attempt-timeout": "10s",
+	"fallback-file":            "/etc/apiserver/repos.json",
+	"max-active-requests-file": "/etc/apiserver/max-active-requests",
+	"cache-ttl":                "5m",
+	"legacy-sunset":            "2027-01-01",
+	"cache-control":            "public, max-age=60",
+	"cache-warm-interval":      "1m",
+	"upstream-ca-file":         "/etc/ssl/certs/ghe-ca.pem",
+	"log-file":                 "/var/log/apiserver.log",
+}
+
+// printUsage writes every flag to w, grouped by category.
+func printUsage(w io.Writer) {
+	cfg := defaultConfig()
+	fs := newFlagSet(&cfg, new(bool))
+	fmt.Fprintf(w, "Usage of %s:\n", fs.Name())
+
+	seen := make(map[string]bool)
+	for _, group := range flagGroups {
+		var flags []*flag.Flag
+		for _, name := range group.flags {
+			if f := fs.Lookup(name); f != nil {
+				flags = append(flags, f)
+				seen[name] = true
+			}
+		}
+		printFlagGroup(w, group.name, flags)
+	}
+
+	var other []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		if !seen[f.Name] {
+			other = append(other, f)
+		}
+	})
+	printFlagGroup(w, "Other", other)
+}
+
+func printFlagGroup(w io.Writer, name string, flags []*flag.Flag) {
+	if len(flags) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%s:\n", name)
+	for _, f := range flags {
+		typeName, help := flag.UnquoteUsage(f)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "  -%s", f.Name)
+		if typeName != "" {
+			fmt.Fprintf(&b, " %s", typeName)
+		}
+		fmt.Fprintf(&b, "\n    \t%s", help)
+
+		switch f.DefValue {
+		case "", "0", "0s", "false":
+		default:
+			fmt.Fprintf(&b, " (default %s)", f.DefValue)
+		}
+		if example, ok := flagExamples[f.Name]; ok {
+			fmt.Fprintf(&b, " (e.g. -%s=%s)", f.Name, example)
+		}
+
+		fmt.Fprintln(w, b.String())
+	}
+}
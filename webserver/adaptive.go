@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveWindow is the number of recent upstream fetches the adaptive
+	// timeout is derived from.
+	adaptiveWindow = 256
+
+	// adaptiveMinSamples is how many fetches must be seen before the timeout
+	// adapts. Until then the upper bound applies.
+	adaptiveMinSamples = 20
+)
+
+// adaptiveTimeout derives the upstream timeout from recently observed fetch
+// latencies, as factor times their p95 clamped to [min, max], so that it
+// tightens while the upstream is fast and loosens as load slows it down.
+type adaptiveTimeout struct {
+	factor   float64
+	min, max time.Duration
+
+	mu      sync.Mutex
+	samples [adaptiveWindow]time.Duration
+	n       int // samples recorded, up to adaptiveWindow
+	next    int // index the next sample is written to
+}
+
+// observe records the latency of a fetch. A fetch that timed out should be
+// recorded at the timeout it was given, so that a slowing upstream loosens
+// the timeout rather than being cut off by it indefinitely.
+func (a *adaptiveTimeout) observe(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.samples[a.next] = d
+	a.next = (a.next + 1) % adaptiveWindow
+	a.n = min(a.n+1, adaptiveWindow)
+}
+
+func (a *adaptiveTimeout) timeout() time.Duration {
+	a.mu.Lock()
+	if a.n < adaptiveMinSamples {
+		a.mu.Unlock()
+		return a.max
+	}
+	samples := slices.Clone(a.samples[:a.n])
+	a.mu.Unlock()
+
+	slices.Sort(samples)
+	p95 := samples[(len(samples)*95+99)/100-1]
+
+	return min(max(time.Duration(float64(p95)*a.factor), a.min), a.max)
+}
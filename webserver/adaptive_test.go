@@ -0,0 +1,51 @@
+package webserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"too few samples", repeat(100*time.Millisecond, adaptiveMinSamples-1), 10 * time.Second},
+		{"fast upstream", repeat(100*time.Millisecond, adaptiveMinSamples), 300 * time.Millisecond},
+		{"tightens to min", repeat(time.Millisecond, 100), 50 * time.Millisecond},
+		{"loosens to max", repeat(5*time.Second, 100), 10 * time.Second},
+		{
+			"p95 of a mix",
+			append(repeat(100*time.Millisecond, 95), repeat(time.Second, 5)...),
+			300 * time.Millisecond,
+		},
+		{
+			"p95 of a slower mix",
+			append(repeat(100*time.Millisecond, 94), repeat(time.Second, 6)...),
+			3 * time.Second,
+		},
+		{
+			"old samples age out of the window",
+			append(repeat(5*time.Second, 100), repeat(200*time.Millisecond, adaptiveWindow)...),
+			600 * time.Millisecond,
+		},
+	} {
+		a := &adaptiveTimeout{factor: 3, min: 50 * time.Millisecond, max: 10 * time.Second}
+		for _, d := range tt.samples {
+			a.observe(d)
+		}
+		if got := a.timeout(); got != tt.want {
+			t.Errorf("%s: timeout = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// repeat returns n copies of d.
+func repeat(d time.Duration, n int) []time.Duration {
+	ds := make([]time.Duration, n)
+	for i := range ds {
+		ds[i] = d
+	}
+	return ds
+}
@@ -0,0 +1,17 @@
+package webserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+	"github.com/tcuthbert/apiserver/cache"
+)
+
+func flushCacheHandler(logger *log.Logger, c *cache.Cache[apiresponse.Repos]) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		c.Flush()
+		logger.Println("INFO: response cache flushed")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
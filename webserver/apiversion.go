@@ -0,0 +1,63 @@
+package webserver
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// UpstreamAPIVersionHeader exposes the GitHub API version the upstream last
+// answered with, when enabled.
+const UpstreamAPIVersionHeader = "X-Upstream-Api-Version"
+
+// upstreamVersion tracks the API version reported by upstream responses, so
+// that a change on GitHub's side is logged when it happens rather than
+// noticed later through its effects.
+type upstreamVersion struct {
+	logger *log.Logger
+
+	mu      sync.Mutex
+	version string
+}
+
+// observe records the version reported by an upstream response's headers,
+// logging it when it differs from the last one seen. GitHub reports the
+// dated API version it selected, or else just its media type.
+func (v *upstreamVersion) observe(h http.Header) {
+	version := cmp.Or(h.Get("X-Github-Api-Version-Selected"), h.Get("X-Github-Media-Type"))
+	if version == "" {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if version == v.version {
+		return
+	}
+	if v.version == "" {
+		v.logger.Printf("INFO: upstream API version: version=%q", version)
+	} else {
+		v.logger.Printf("WARNING: upstream API version changed: old=%q new=%q", v.version, version)
+	}
+	v.version = version
+}
+
+func (v *upstreamVersion) get() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.version
+}
+
+// exposeAPIVersion sets UpstreamAPIVersionHeader if enabled and a version has
+// been seen.
+func (ah *ApiRequestHandler) exposeAPIVersion(h http.Header) {
+	if !ah.exposeUpstreamVersion {
+		return
+	}
+	if version := ah.upstreamVersion.get(); version != "" {
+		h.Set(UpstreamAPIVersionHeader, version)
+	}
+}
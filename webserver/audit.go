@@ -0,0 +1,116 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tcuthbert/apiserver/middleware"
+)
+
+// auditRecord is one audited admin action, written as a line of JSON.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Actor identifies who acted: the presented admin key as "key:" and a
+	// hash prefix, or how the action was triggered, such as "signal:SIGUSR1".
+	Actor    string `json:"actor"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+	Status   int    `json:"status,omitempty"`
+}
+
+// auditLog records admin actions, apart from the operational log when given
+// a file of its own. Admin keys are never recorded, only a hash identifying
+// which key was used.
+type auditLog struct {
+	out    *log.Logger
+	prefix string
+	keys   []string
+	file   *os.File // the audit log's own file, if it has one
+}
+
+// newAuditLog returns an audit log appending to path, or writing to logger
+// with an AUDIT: prefix when path is empty.
+func newAuditLog(path string, logger *log.Logger, keys []string) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{out: logger, prefix: "AUDIT: ", keys: keys}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log file: %w", err)
+	}
+
+	return &auditLog{out: log.New(f, "", 0), keys: keys, file: f}, nil
+}
+
+func (a *auditLog) close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+func (a *auditLog) record(rec auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.out.Printf("%s%s", a.prefix, b)
+}
+
+// middleware audits every request to an admin endpoint as action, including
+// those rejected for a missing or wrong key, so it must wrap the key check.
+func (a *auditLog) middleware(action string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			actor := "anonymous"
+			if i, ok := middleware.MatchAPIKey(r, a.keys); ok {
+				actor = "key:" + keyID(a.keys[i])
+			}
+			remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				remoteIP = r.RemoteAddr
+			}
+
+			a.record(auditRecord{
+				Time:     time.Now().UTC(),
+				Action:   action,
+				Actor:    actor,
+				RemoteIP: remoteIP,
+				Status:   sw.status,
+			})
+		})
+	}
+}
+
+// keyID identifies an admin key without revealing it.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// statusWriter records the status code of the response passing through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// TokenFileCheckInterval is how long a FileToken goes between checks of its
+// file for a rotated token.
+const TokenFileCheckInterval = 5 * time.Second
+
+// Authenticator attaches upstream credentials to an outgoing request. It is
+// applied to every upstream request, so implementations may refresh
+// short-lived credentials such as GitHub App installation tokens.
+type Authenticator interface {
+	Apply(ctx context.Context, req *http.Request) error
+}
+
+// StaticToken authenticates with a fixed GitHub token. The empty token leaves
+// requests unauthenticated.
+type StaticToken string
+
+func (t StaticToken) Apply(_ context.Context, req *http.Request) error {
+	if t != "" {
+		req.Header.Set("Authorization", "Bearer "+string(t))
+	}
+
+	return nil
+}
+
+// FileToken authenticates with a GitHub token read from a file, such as a
+// mounted secret, picking up a rotated token without a restart. The file is
+// stat'd at most once per TokenFileCheckInterval and re-read whenever it has
+// changed.
+type FileToken struct {
+	path  string
+	clock clock.Clock
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewFileToken returns a FileToken for path, failing if it can't be read.
+func NewFileToken(path string) (*FileToken, error) {
+	return newFileToken(path, clock.Real{})
+}
+
+func newFileToken(path string, clk clock.Clock) (*FileToken, error) {
+	t := &FileToken{path: path, clock: clk}
+	if _, err := t.current(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *FileToken) Apply(_ context.Context, req *http.Request) error {
+	token, err := t.current()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
+
+// current returns the token, re-reading the file if it has changed since the
+// last check. Once a token has been read, a failed reload keeps it, since
+// secret mounts are briefly missing while being swapped.
+func (t *FileToken) current() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	if !t.modTime.IsZero() && now.Sub(t.checked) < TokenFileCheckInterval {
+		return t.token, nil
+	}
+	t.checked = now
+
+	fi, err := os.Stat(t.path)
+	if err == nil && fi.ModTime().Equal(t.modTime) && fi.Size() == t.size {
+		return t.token, nil
+	}
+
+	var b []byte
+	if err == nil {
+		b, err = os.ReadFile(t.path)
+	}
+	if err != nil {
+		if t.modTime.IsZero() {
+			return "", fmt.Errorf("failed to read GitHub token file: %w", err)
+		}
+		return t.token, nil
+	}
+
+	t.token = strings.TrimSpace(string(b))
+	t.modTime, t.size = fi.ModTime(), fi.Size()
+
+	return t.token, nil
+}
+
+// Token returns the most recently read token, without checking the file.
+func (t *FileToken) Token() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.token
+}
@@ -0,0 +1,70 @@
+package webserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// backgroundYieldInterval is how often a background upstream call waiting on
+// the foreground checks whether it may go ahead.
+const backgroundYieldInterval = 50 * time.Millisecond
+
+// backgroundLimiter bounds the upstream calls made by background tasks, such
+// as cache warming, revalidation and keep-alive pings, separately from the
+// rate limiter fronting client requests. Background calls also yield to
+// client requests: they wait while the rate limiter is full or has requests
+// queued, so they never take upstream capacity a client is waiting for.
+type backgroundLimiter struct {
+	slots      chan struct{}
+	foreground *RateLimiter
+	clock      clock.Clock
+}
+
+func newBackgroundLimiter(size int, foreground *RateLimiter, clk clock.Clock) *backgroundLimiter {
+	return &backgroundLimiter{
+		slots:      make(chan struct{}, size),
+		foreground: foreground,
+		clock:      clk,
+	}
+}
+
+// acquire takes a background slot once one is free and the foreground is not
+// busy, returning the function releasing it. It gives up with ctx's error if
+// ctx is done first.
+func (bl *backgroundLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case bl.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for bl.foreground.busy() {
+		select {
+		case <-ctx.Done():
+			<-bl.slots
+			return nil, ctx.Err()
+		case <-bl.clock.After(backgroundYieldInterval):
+		}
+	}
+
+	return func() { <-bl.slots }, nil
+}
+
+// tryAcquire is acquire without waiting, reporting false if a slot isn't
+// available straight away.
+func (bl *backgroundLimiter) tryAcquire() (func(), bool) {
+	select {
+	case bl.slots <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	if bl.foreground.busy() {
+		<-bl.slots
+		return nil, false
+	}
+
+	return func() { <-bl.slots }, true
+}
@@ -0,0 +1,506 @@
+package webserver
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Config is the resolved server configuration. Fields tagged `redact:"true"`
+// hold secrets and are masked whenever the configuration is printed.
+type Config struct {
+	ListenAddr string
+	LogFile    string
+
+	// AuditLogFile, if set, receives the audit log of admin actions as JSON
+	// lines, which otherwise go to the main log.
+	AuditLogFile string
+
+	// Features switches optional subsystems on and off wholesale, overriding
+	// their individual settings.
+	Features Features
+
+	// DebugLogBodies logs upstream and downstream bodies, truncated to
+	// DebugLogMaxBytes and with credentials redacted.
+	DebugLogBodies   bool
+	DebugLogMaxBytes int
+
+	// StatsInterval is how often per-route response time percentiles are
+	// logged, 0 disables latency tracking.
+	StatsInterval time.Duration
+
+	APIURL      string
+	GitHubToken string `redact:"true"`
+
+	// GitHubTokenFile, if set, holds the GitHub token in place of GitHubToken.
+	// It is reloaded whenever it changes, so the token can be rotated.
+	GitHubTokenFile string
+
+	// AdminAPIKeys authorise access to the /admin and /whoami endpoints,
+	// which are disabled when none are configured.
+	AdminAPIKeys []string `redact:"true"`
+
+	// UpstreamHMACSecret, if set, signs every upstream request with
+	// HMAC-SHA256 for authenticating proxies in front of GitHub Enterprise.
+	UpstreamHMACSecret string `redact:"true"`
+
+	// MaxActiveAPIRequestsFile, if set, holds a rate limiter size that is
+	// re-read on SIGHUP.
+	MaxActiveAPIRequests     int
+	MaxActiveAPIRequestsFile string
+
+	// RateLimitCountQueued makes MaxActiveAPIRequests bound queued requests
+	// as well as running ones, turning requests away with 503 rather than
+	// queueing them once it is reached.
+	RateLimitCountQueued bool
+
+	// MaxBackgroundRequests bounds the concurrent upstream calls made by
+	// background tasks, which also wait for the rate limiter to have room
+	// to spare, so that client requests always come first.
+	MaxBackgroundRequests int
+
+	// SlowStartDuration ramps the rate limiter up from a single request to
+	// MaxActiveAPIRequests over this long after startup.
+	SlowStartDuration time.Duration
+
+	// MaxInFlight sheds API requests with an immediate 503 once this many are
+	// being served, rather than queuing them behind the rate limiter.
+	MaxInFlight int
+
+	// MaxPages bounds how many upstream pages are followed via the Link
+	// header. PartialOK serves the pages fetched so far if a later one fails.
+	MaxPages  int
+	PartialOK bool
+
+	// MaxRetries bounds retries of a failed upstream attempt. Timeouts and 5xx
+	// responses are retried independently, as retrying timeouts can pile more
+	// load onto an upstream that is already struggling. Retry delays follow
+	// decorrelated jitter between RetryBackoff and RetryBackoffCap.
+	MaxRetries             int
+	RetryTimeouts          bool
+	Retry5xx               bool
+	RetryBackoff           time.Duration
+	RetryBackoffCap        time.Duration
+	UpstreamAttemptTimeout time.Duration
+
+	// DNSRetries retries upstream dials failing on a temporary DNS error,
+	// independently of MaxRetries, starting after DNSRetryBackoff.
+	DNSRetries      int
+	DNSRetryBackoff time.Duration
+
+	// RetryBudgetRatio caps retries across all requests at this fraction of
+	// the request rate, 0 leaves them uncapped.
+	RetryBudgetRatio float64
+
+	// HedgeDelay, if set, sends a second copy of an upstream request that
+	// hasn't been answered within it, using whichever response comes first.
+	HedgeDelay time.Duration
+
+	// MaxLimit caps the ?limit query parameter. StrictQuery rejects query
+	// parameters the server doesn't recognise.
+	MaxLimit    int
+	StrictQuery bool
+
+	// ExposeUpstreamAPIVersion sets the X-Upstream-Api-Version header on
+	// responses to the GitHub API version the upstream last reported.
+	ExposeUpstreamAPIVersion bool
+
+	// StrictUpstreamDecode fails upstream pages carrying fields that Repo
+	// doesn't declare, instead of ignoring them. GitHub itself sends many
+	// more fields than Repo has, so this suits upstreams serving exactly the
+	// Repo shape, such as a mirror or a fixture.
+	StrictUpstreamDecode bool
+
+	// EmptyAs204 answers 204 No Content instead of an empty list.
+	EmptyAs204 bool
+
+	// CLIMode answers command line tools such as curl that accept any type,
+	// and clients passing ?cli=1, with a plain text table of repos instead.
+	// ?cli=0 asks for JSON whatever the client.
+	CLIMode bool
+
+	// DeprecateLegacyShape marks JSON responses not wrapped in the ?envelope
+	// with a Deprecation header, and LegacySunset, if set, with a Sunset
+	// header (RFC 8594) announcing when the bare shape goes away.
+	DeprecateLegacyShape bool
+	LegacySunset         time.Time
+
+	// MaxEncodeTime, if set, bounds filtering, transforming and encoding a
+	// response, answering 503 once it is exceeded.
+	MaxEncodeTime time.Duration
+
+	// MaxResponseBytes bounds the size of a response, which is buffered in
+	// full before being sent unless it is streamed, 0 leaving it unbounded.
+	MaxResponseBytes int
+
+	// UpstreamPassthrough forwards GitHub's own type, sort, direction and
+	// per_page parameters to the upstream, validated against an allowlist.
+	UpstreamPassthrough bool
+
+	// ForwardUpstreamHeaders lists the upstream response headers /raw passes
+	// on besides Content-Type, or "*" for all of them. StripUpstreamHeaders
+	// are never passed on, whatever ForwardUpstreamHeaders says.
+	ForwardUpstreamHeaders []string
+	StripUpstreamHeaders   []string
+
+	// RequestTimeout bounds the whole API handler, UpstreamTimeout just the
+	// upstream fetch, leaving the difference as headroom for transformation,
+	// encoding and serving a fallback or partial response.
+	RequestTimeout  time.Duration
+	UpstreamTimeout time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+
+	// RouteUpstreamTimeouts overrides UpstreamTimeout for the routes at
+	// these paths, for endpoints with their own latency profile.
+	RouteUpstreamTimeouts map[string]time.Duration
+
+	// AdaptiveTimeoutFactor, if set, replaces UpstreamTimeout with this
+	// multiple of the recent p95 upstream latency, clamped between
+	// AdaptiveTimeoutMin and AdaptiveTimeoutMax, which defaults to
+	// UpstreamTimeout.
+	AdaptiveTimeoutFactor float64
+	AdaptiveTimeoutMin    time.Duration
+	AdaptiveTimeoutMax    time.Duration
+
+	// ListenBacklog, if set, replaces the kernel default queue length for
+	// pending connections. ReusePort sets SO_REUSEPORT so several processes
+	// can share the listen address, e.g. for zero-downtime deploys.
+	ListenBacklog int
+	ReusePort     bool
+
+	// MaxConnLifetime bounds how long any client connection may stay open,
+	// so long-lived keep-alive connections can't pin server resources.
+	MaxConnLifetime time.Duration
+
+	// MaxConnsPerIP, if set, bounds the connections open at once from a
+	// single remote IP, closing any beyond it as soon as they are accepted.
+	MaxConnsPerIP int
+
+	// Maintenance starts the server with API routes answering 503, while
+	// /healthz keeps passing. SIGUSR1 toggles it at runtime.
+	Maintenance bool
+
+	// DrainDelay keeps the listener open after a shutdown signal while new
+	// requests are refused, so load balancers can deregister the server.
+	DrainDelay      time.Duration
+	ShutdownSignals []os.Signal
+
+	// ShutdownWebhookURL, if set, is POSTed to when shutdown begins, so that
+	// dashboards can show the drain. It may embed a secret, as many do.
+	ShutdownWebhookURL string `redact:"true"`
+
+	CacheTTL          time.Duration
+	CacheMaxEntries   int
+	CacheWarmInterval time.Duration
+	WarmupGate        bool
+
+	// CacheStaleWhileRevalidate serves cache entries for this long past
+	// CacheTTL, refreshing them in the background when they are.
+	CacheStaleWhileRevalidate time.Duration
+
+	// CacheHonorUpstream caches each response for the lifetime its upstream
+	// Cache-Control or Expires header gives it, falling back to CacheTTL.
+	CacheHonorUpstream bool
+
+	// IdempotencyTTL is how long the response to a request carrying an
+	// Idempotency-Key header is replayed to repeats of that key, 0 disables
+	// replays. At most IdempotencyMaxKeys responses are kept.
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+
+	// CacheControl is sent on successful responses. It defaults to a max-age
+	// matching CacheTTL so CDNs can cache as long as the server does.
+	CacheControl string
+
+	// PropagateTrace forwards the incoming W3C traceparent and tracestate
+	// headers upstream, and CorrelationHeader names one more header to
+	// forward, such as X-Request-ID.
+	PropagateTrace    bool
+	CorrelationHeader string
+
+	UpstreamIdleReapInterval time.Duration
+
+	// UpstreamProxy may carry proxy credentials in its userinfo.
+	UpstreamProxy string `redact:"true"`
+
+	// UpstreamKeepaliveInterval, if set, pings the upstream host this often
+	// to keep a warm connection pooled while the server is idle.
+	UpstreamKeepaliveInterval time.Duration
+
+	// TLSCertFile and TLSKeyFile, if set, serve HTTPS, with at least
+	// TLSMinVersion and, below TLS 1.3, only TLSCipherSuites.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// UpstreamCAFile is a PEM bundle trusted for upstream TLS, replacing the
+	// system roots.
+	UpstreamCAFile             string
+	UpstreamInsecureSkipVerify bool
+
+	// AllowUpstreamOverride honours the X-Upstream-Override header from peers
+	// in TrustedProxies, replacing the upstream host with one listed in
+	// UpstreamOverrideHosts. The GitHub token is sent to those hosts too.
+	AllowUpstreamOverride bool
+	TrustedProxies        []string
+	UpstreamOverrideHosts []string
+
+	// RequireUpstreamOnStart makes Start fail, before listening, if the
+	// upstream can't be fetched.
+	RequireUpstreamOnStart bool
+
+	// RobotsTxtFile replaces DefaultRobotsTxt as the /robots.txt body.
+	RobotsTxtFile string
+
+	// FallbackFile is a JSON repos list served when the upstream is down and
+	// nothing is cached.
+	FallbackFile string
+}
+
+// DefaultConfig returns a Config populated from the package defaults.
+func DefaultConfig() Config {
+	return Config{
+		Features:              AllFeatures(),
+		MaxActiveAPIRequests:  MaxActiveAPIRequests,
+		ShutdownSignals:       DefaultShutdownSignals,
+		DebugLogMaxBytes:      4096,
+		MaxResponseBytes:      32 << 20,
+		StripUpstreamHeaders:  DefaultStrippedUpstreamHeaders,
+		MaxBackgroundRequests: 1,
+		CacheMaxEntries:       1000,
+		IdempotencyMaxKeys:    1000,
+		MaxPages:              1,
+		RetryBackoff:          100 * time.Millisecond,
+		RetryBackoffCap:       5 * time.Second,
+		DNSRetries:            2,
+		DNSRetryBackoff:       100 * time.Millisecond,
+		MaxLimit:              100,
+		RequestTimeout:        MaxRequestTimeout,
+		UpstreamTimeout:       MaxAPIResponseTimeout,
+		ReadTimeout:           MaxReadTimeout,
+		WriteTimeout:          MaxWriteTimeout,
+		IdleTimeout:           MaxIdleTimeout,
+		TLSMinVersion:         tls.VersionTLS12,
+		TLSCipherSuites:       DefaultTLSCipherSuites,
+	}
+}
+
+// Validate reports every configuration value that is malformed or can't work
+// together with the others, joined into a single error.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	// An empty port would silently listen on a random one.
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen address is required"))
+	} else if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid listen address %q: %w", c.ListenAddr, err))
+	} else if port == "" {
+		errs = append(errs, fmt.Errorf("invalid listen address %q: missing port", c.ListenAddr))
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		errs = append(errs, fmt.Errorf("invalid listen address %q: %w", c.ListenAddr, err))
+	}
+
+	if u, err := url.Parse(c.APIURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid API URL: %w", err))
+	} else {
+		check(u.Scheme == "http" || u.Scheme == "https", "API URL %q must be http or https", c.APIURL)
+		check(u.Host != "", "API URL %q has no host", c.APIURL)
+	}
+
+	if c.UpstreamProxy != "" {
+		if _, err := url.Parse(c.UpstreamProxy); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream proxy: %w", err))
+		}
+	}
+
+	if c.ShutdownWebhookURL != "" {
+		if u, err := url.Parse(c.ShutdownWebhookURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid shutdown webhook URL: %w", err))
+		} else {
+			check(u.Scheme == "http" || u.Scheme == "https", "shutdown webhook URL must be http or https")
+		}
+	}
+
+	check(c.MaxActiveAPIRequests > 0, "max active requests %d must be positive", c.MaxActiveAPIRequests)
+	check(c.MaxBackgroundRequests > 0, "max background requests %d must be positive", c.MaxBackgroundRequests)
+	check(c.ListenBacklog >= 0, "listen backlog %d must not be negative", c.ListenBacklog)
+	check(c.MaxConnsPerIP >= 0, "max connections per IP %d must not be negative", c.MaxConnsPerIP)
+	check(c.MaxInFlight >= 0, "max in-flight requests %d must not be negative", c.MaxInFlight)
+	check(c.MaxPages > 0, "max pages %d must be positive", c.MaxPages)
+	check(c.MaxLimit > 0, "max limit %d must be positive", c.MaxLimit)
+	check(c.MaxRetries >= 0, "max retries %d must not be negative", c.MaxRetries)
+	check(c.DNSRetries >= 0, "DNS retries %d must not be negative", c.DNSRetries)
+	check(c.RetryBudgetRatio >= 0, "retry budget ratio %g must not be negative", c.RetryBudgetRatio)
+	check(c.CacheMaxEntries >= 0, "cache max entries %d must not be negative", c.CacheMaxEntries)
+	check(c.IdempotencyMaxKeys >= 0, "idempotency max keys %d must not be negative", c.IdempotencyMaxKeys)
+	check(c.MaxResponseBytes >= 0, "max response bytes %d must not be negative", c.MaxResponseBytes)
+	check(c.DebugLogMaxBytes >= 0, "debug log max bytes %d must not be negative", c.DebugLogMaxBytes)
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request timeout", c.RequestTimeout},
+		{"upstream timeout", c.UpstreamTimeout},
+		{"upstream attempt timeout", c.UpstreamAttemptTimeout},
+		{"retry backoff", c.RetryBackoff},
+		{"retry backoff cap", c.RetryBackoffCap},
+		{"DNS retry backoff", c.DNSRetryBackoff},
+		{"hedge delay", c.HedgeDelay},
+		{"max encode time", c.MaxEncodeTime},
+		{"adaptive timeout min", c.AdaptiveTimeoutMin},
+		{"adaptive timeout max", c.AdaptiveTimeoutMax},
+		{"read timeout", c.ReadTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"idle timeout", c.IdleTimeout},
+		{"max connection lifetime", c.MaxConnLifetime},
+		{"drain delay", c.DrainDelay},
+		{"slow start duration", c.SlowStartDuration},
+		{"cache TTL", c.CacheTTL},
+		{"cache warm interval", c.CacheWarmInterval},
+		{"cache stale-while-revalidate", c.CacheStaleWhileRevalidate},
+		{"idempotency TTL", c.IdempotencyTTL},
+		{"stats interval", c.StatsInterval},
+		{"upstream keep-alive interval", c.UpstreamKeepaliveInterval},
+	} {
+		check(d.value >= 0, "%s %s must not be negative", d.name, d.value)
+	}
+	// Without a base, decorrelated jitter never grows past zero, so every
+	// retry would follow immediately.
+	check(
+		c.MaxRetries == 0 || c.RetryBackoff > 0,
+		"retry backoff %s must be positive when retries are enabled",
+		c.RetryBackoff,
+	)
+	check(
+		c.RetryBackoff <= c.RetryBackoffCap,
+		"retry backoff %s exceeds retry backoff cap %s",
+		c.RetryBackoff,
+		c.RetryBackoffCap,
+	)
+	check(
+		c.UpstreamTimeout <= c.RequestTimeout,
+		"upstream timeout %s exceeds request timeout %s",
+		c.UpstreamTimeout,
+		c.RequestTimeout,
+	)
+
+	if c.AdaptiveTimeoutFactor != 0 {
+		maxTimeout := cmp.Or(c.AdaptiveTimeoutMax, c.UpstreamTimeout)
+		check(c.AdaptiveTimeoutFactor >= 1, "adaptive timeout factor %g must be at least 1", c.AdaptiveTimeoutFactor)
+		check(
+			c.AdaptiveTimeoutMin <= maxTimeout,
+			"adaptive timeout min %s exceeds max %s",
+			c.AdaptiveTimeoutMin,
+			maxTimeout,
+		)
+		check(
+			maxTimeout <= c.RequestTimeout,
+			"adaptive timeout max %s exceeds request timeout %s",
+			maxTimeout,
+			c.RequestTimeout,
+		)
+	}
+
+	for path, d := range c.RouteUpstreamTimeouts {
+		check(d > 0, "upstream timeout %s for route %s must be positive", d, path)
+		check(
+			d <= c.RequestTimeout,
+			"upstream timeout %s for route %s exceeds request timeout %s",
+			d,
+			path,
+			c.RequestTimeout,
+		)
+	}
+
+	check(
+		c.LegacySunset.IsZero() || c.DeprecateLegacyShape,
+		"a legacy sunset requires deprecating the legacy response shape",
+	)
+
+	check(len(c.ShutdownSignals) > 0, "at least one shutdown signal is required")
+
+	if c.AllowUpstreamOverride {
+		check(len(c.TrustedProxies) > 0, "upstream override requires trusted proxies")
+		check(len(c.UpstreamOverrideHosts) > 0, "upstream override requires allowed hosts")
+		for _, p := range c.TrustedProxies {
+			if _, err := parsePrefix(strings.TrimSpace(p)); err != nil {
+				errs = append(errs, fmt.Errorf("invalid trusted proxy %q: %w", p, err))
+			}
+		}
+	}
+
+	if c.GitHubTokenFile != "" {
+		if _, err := os.Stat(c.GitHubTokenFile); err != nil {
+			errs = append(errs, fmt.Errorf("GitHub token file: %w", err))
+		}
+	}
+
+	if c.RobotsTxtFile != "" {
+		if _, err := os.Stat(c.RobotsTxtFile); err != nil {
+			errs = append(errs, fmt.Errorf("robots.txt file: %w", err))
+		}
+	}
+
+	check(
+		(c.TLSCertFile == "") == (c.TLSKeyFile == ""),
+		"TLS serving requires both a certificate and a key file",
+	)
+	for _, f := range []struct{ name, path string }{
+		{"TLS certificate file", c.TLSCertFile},
+		{"TLS key file", c.TLSKeyFile},
+	} {
+		if f.path != "" {
+			if _, err := os.Stat(f.path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+			}
+		}
+	}
+
+	if c.UpstreamCAFile != "" {
+		if _, err := os.Stat(c.UpstreamCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("upstream CA file: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration to w as key=value lines, one per field, with
+// secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	v := reflect.ValueOf(c)
+	t := v.Type()
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i).Interface()
+
+		if field.Tag.Get("redact") == "true" && !v.Field(i).IsZero() {
+			value = "REDACTED"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s=%v\n", field.Name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
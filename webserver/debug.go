@@ -0,0 +1,54 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// redactedHeaders are masked whenever headers are written to the debug log.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Cookie"}
+
+// bodyLogger dumps truncated request/response bodies for debugging payload
+// issues, scrubbing credentials first.
+type bodyLogger struct {
+	maxBytes int
+	secrets  []string
+
+	// liveSecret, if set, returns a secret that can change at runtime, such
+	// as a token reloaded from disk.
+	liveSecret func() string
+}
+
+func (ah *ApiRequestHandler) debugLogBody(direction string, h http.Header, body []byte) {
+	if ah.bodyLog == nil {
+		return
+	}
+
+	headers := h.Clone()
+	for _, name := range redactedHeaders {
+		if headers.Get(name) != "" {
+			headers.Set(name, "REDACTED")
+		}
+	}
+
+	// Redact before truncating so a secret can't leak across the cut.
+	logged, truncated := ah.bodyLog.redact(string(body)), ""
+	if len(logged) > ah.bodyLog.maxBytes {
+		logged, truncated = logged[:ah.bodyLog.maxBytes], " (truncated)"
+	}
+
+	ah.logger.Printf("DEBUG: %s headers=%v body%s=%q", direction, headers, truncated, logged)
+}
+
+func (bl *bodyLogger) redact(s string) string {
+	for _, secret := range bl.secrets {
+		s = strings.ReplaceAll(s, secret, "REDACTED")
+	}
+	if bl.liveSecret != nil {
+		if secret := bl.liveSecret(); secret != "" {
+			s = strings.ReplaceAll(s, secret, "REDACTED")
+		}
+	}
+
+	return s
+}
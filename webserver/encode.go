@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// errResponseTooLarge rejects writes beyond a bufferedResponse's limit.
+var errResponseTooLarge = errors.New("response too large to buffer")
+
+// bufferedResponse is a ResponseWriter holding a response in memory, so that
+// a response being built in the background can be discarded untouched.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	limit  int // bytes of body, 0 is unlimited
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if b.limit > 0 && b.body.Len()+len(p) > b.limit {
+		return 0, errResponseTooLarge
+	}
+	return b.body.Write(p)
+}
+
+// copyTo sends the buffered response to rw.
+func (b *bufferedResponse) copyTo(rw http.ResponseWriter) error {
+	for name, values := range b.header {
+		rw.Header()[name] = values
+	}
+	if b.status != 0 {
+		rw.WriteHeader(b.status)
+	}
+
+	_, err := rw.Write(b.body.Bytes())
+	return err
+}
+
+// serveReposBounded transforms and encodes repos in the background, giving up
+// with a 503 if that takes longer than the maximum encode time. As with ?jq,
+// the work can't be interrupted, so it is abandoned rather than stopped, and
+// the response is buffered in full, even when streaming was requested, so
+// that nothing abandoned can reach rw.
+func (ah *ApiRequestHandler) serveReposBounded(
+	rw http.ResponseWriter,
+	repos apiresponse.Repos,
+	opts queryOptions,
+	meta responseMeta,
+) error {
+	// Past the max encode time this goroutine outlives the request, running
+	// the encode to completion. It only touches buf and the buffered done
+	// channel, so it then exits without blocking on anything.
+	buf := &bufferedResponse{header: rw.Header().Clone()}
+	done := make(chan error, 1)
+	go func() {
+		repos, status := opts.apply(buf.Header(), repos)
+		if status == http.StatusRequestedRangeNotSatisfiable {
+			http.Error(buf, http.StatusText(status), status)
+			done <- nil
+			return
+		}
+		done <- ah.writeRepos(buf, repos, status, opts, meta)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-ah.clock.After(ah.maxEncodeTime):
+		ah.logger.Printf("WARNING: response abandoned after exceeding max encode time %s", ah.maxEncodeTime)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	cw := &countingWriter{ResponseWriter: rw}
+	if err := buf.copyTo(cw); err != nil {
+		return &downstreamWriteError{written: cw.written, err: err}
+	}
+
+	return nil
+}
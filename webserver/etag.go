@@ -0,0 +1,78 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// contentETag derives a weak ETag from the SHA-256 of the encoded body, so
+// downstream caches can revalidate even when the upstream sends no ETag.
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. As RFC
+// 7232 section 3.2 requires, the weak comparison is used: W/"x" and "x" match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	for {
+		var candidate string
+		candidate, ifNoneMatch = scanETag(ifNoneMatch)
+		if candidate == "" {
+			return false
+		}
+		if weakETagMatch(candidate, etag) {
+			return true
+		}
+	}
+}
+
+// weakETagMatch compares two entity tags ignoring their weakness indicators.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// scanETag returns the first entity tag in a comma-separated list along with
+// the remainder, or "" once no well-formed tag is left. Tags are scanned
+// rather than split on commas, since a quoted tag may itself contain one.
+func scanETag(s string) (etag, rest string) {
+	s = strings.TrimLeft(s, " \t,")
+
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", ""
+	}
+
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", ""
+	}
+	end += start + 2
+
+	return s[:end], s[end:]
+}
+
+// writeWithETag writes body with status, tagged with its content ETag, or just
+// a 304 if the client already holds a matching representation.
+func writeWithETag(rw http.ResponseWriter, status int, body []byte, ifNoneMatch string) error {
+	etag := contentETag(body)
+	rw.Header().Set("ETag", etag)
+
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	rw.WriteHeader(status)
+	_, err := rw.Write(body)
+	return err
+}
@@ -0,0 +1,80 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIfNoneMatch(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), nil)
+
+	resp, body := get(t, url+"/")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q, want a tagged 200: %s", resp.StatusCode, etag, body)
+	}
+
+	resp, body = get(t, url+"/", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status = %d, want %d for the current ETag", resp.StatusCode, http.StatusNotModified)
+	}
+	if body != "" {
+		t.Errorf("304 has body %q", body)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %q, want %q", got, etag)
+	}
+
+	resp, _ = get(t, url+"/", "If-None-Match", `W/"stale"`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d for a different ETag", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	a, b := contentETag([]byte("a")), contentETag([]byte("b"))
+	if a == b {
+		t.Errorf("different bodies share ETag %s", a)
+	}
+	if a != contentETag([]byte("a")) {
+		t.Error("ETag of the same body changed")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `W/"abc"`
+	for _, tt := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true}, // weak comparison ignores the W/ prefix
+		{`"xyz", W/"abc"`, true},
+		{`"xyz",W/"abc"`, true},
+		{`  *  `, true},
+		{`"a,b", "abc"`, true}, // a quoted comma doesn't split a tag
+		{`"a,b"`, false},
+		{`"xyz"`, false},
+		{`"ab"`, false},
+		{`abc`, false},  // unquoted
+		{`"abc`, false}, // unterminated
+		{``, false},
+		{`w/"abc"`, false}, // the weakness indicator is case-sensitive
+	} {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %t, want %t", tt.ifNoneMatch, etag, got, tt.want)
+		}
+	}
+}
+
+func TestIfNoneMatchWeakComparison(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), nil)
+
+	resp, _ := get(t, url+"/")
+	strong := strings.TrimPrefix(resp.Header.Get("ETag"), "W/")
+
+	if resp, _ := get(t, url+"/", "If-None-Match", `"other", `+strong); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status = %d, want %d for the strong form of the weak ETag", resp.StatusCode, http.StatusNotModified)
+	}
+}
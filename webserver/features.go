@@ -0,0 +1,71 @@
+package webserver
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Features switches optional subsystems on and off as a group, so deployments
+// can trim the server down without tuning each subsystem's own flags.
+type Features struct {
+	Cache   bool // response cache and cache warming
+	Retry   bool // upstream retries
+	Metrics bool // /stats and latency percentiles
+}
+
+// AllFeatures enables every feature, the default.
+func AllFeatures() Features {
+	return Features{Cache: true, Retry: true, Metrics: true}
+}
+
+func (f *Features) byName() map[string]*bool {
+	return map[string]*bool{
+		"cache":   &f.Cache,
+		"retry":   &f.Retry,
+		"metrics": &f.Metrics,
+	}
+}
+
+// ParseFeatures parses a comma-separated list of the features to enable, such
+// as "cache,metrics". Features not listed are disabled; "none" disables all.
+func ParseFeatures(names string) (Features, error) {
+	var f Features
+	if strings.TrimSpace(names) == "none" {
+		return f, nil
+	}
+
+	toggles := f.byName()
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		enabled, ok := toggles[name]
+		if !ok {
+			return Features{}, fmt.Errorf(
+				"unknown feature %q, must be one of %s",
+				name,
+				strings.Join(slices.Sorted(maps.Keys(toggles)), ", "),
+			)
+		}
+		*enabled = true
+	}
+
+	return f, nil
+}
+
+// String lists the enabled features in the form ParseFeatures accepts.
+func (f Features) String() string {
+	var enabled []string
+	for name, on := range f.byName() {
+		if *on {
+			enabled = append(enabled, name)
+		}
+	}
+	if len(enabled) == 0 {
+		return "none"
+	}
+	slices.Sort(enabled)
+
+	return strings.Join(enabled, ",")
+}
@@ -0,0 +1,135 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type responseFormat int
+
+const (
+	formatJSON responseFormat = iota
+	formatNDJSON
+	formatAtom
+	formatText // a plain text table, see Config.CLIMode
+)
+
+var mediaTypeFormats = map[string]responseFormat{
+	"application/x-ndjson": formatNDJSON,
+	"application/atom+xml": formatAtom,
+}
+
+// negotiateFormat picks the first format in the Accept header the server can
+// produce, defaulting to a JSON array.
+func negotiateFormat(accept string) responseFormat {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		if format, ok := mediaTypeFormats[mediaType]; ok {
+			return format
+		}
+	}
+
+	return formatJSON
+}
+
+// cliUserAgents are the User-Agent prefixes of the command line tools that
+// get a text table by default.
+var cliUserAgents = []string{"curl/", "Wget/", "HTTPie/", "xh/"}
+
+// wantsText reports whether r should be answered with a text table in CLI
+// mode: as ?cli says if given, and otherwise only for a known command line
+// tool accepting any type, since other clients without JSON in their Accept
+// header may still expect it.
+func wantsText(r *http.Request, cli *bool) bool {
+	if cli != nil {
+		return *cli
+	}
+	if accept := strings.TrimSpace(r.Header.Get("Accept")); accept != "" && accept != "*/*" {
+		return false
+	}
+
+	ua := r.Header.Get("User-Agent")
+	for _, prefix := range cliUserAgents {
+		if strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamingRequested reports whether r will be answered with a streamed body:
+// always for /raw, and otherwise for NDJSON unless the repos are reshaped.
+// Invalid parameters are answered with an error, so they needn't be checked.
+func streamingRequested(r *http.Request) bool {
+	if r.URL.Path == "/raw" {
+		return true
+	}
+	if negotiateFormat(r.Header.Get("Accept")) != formatNDJSON {
+		return false
+	}
+
+	q := r.URL.Query()
+	opts := queryOptions{groupBy: q.Get("group_by")}
+	opts.envelope, _ = strconv.ParseBool(q.Get("envelope"))
+	if q.Has("jq") {
+		opts.jq = &jqQuery{src: q.Get("jq")}
+	}
+
+	return !opts.reshaped()
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) error {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+
+	return json.NewEncoder(rw).Encode(v)
+}
+
+// downstreamWriteError reports that writing the response to the client failed
+// part way, typically because the server's WriteTimeout fired or the client
+// went away. The status line has already been sent, so the client just sees
+// a truncated body and nothing more can be written.
+type downstreamWriteError struct {
+	written int64
+	err     error
+}
+
+func (e *downstreamWriteError) Error() string {
+	return fmt.Sprintf("response write failed after %d bytes: %v", e.written, e.err)
+}
+
+func (e *downstreamWriteError) Unwrap() error {
+	return e.err
+}
+
+// countingWriter records how much of a response was written and the first
+// write error, which encoders would otherwise report as their own failure.
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+	err     error
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+// Flush keeps streamed responses flushing through the wrapper.
+func (w *countingWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
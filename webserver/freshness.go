@@ -0,0 +1,128 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// FetchedAtHeader carries the RFC 3339 time the repos in a response were
+// fetched from the upstream, which for a cached response is when the cache
+// entry was stored rather than the current time.
+const FetchedAtHeader = "X-Data-Fetched-At"
+
+func setFetchedAt(h http.Header, t time.Time) {
+	h.Set(FetchedAtHeader, t.UTC().Format(time.RFC3339))
+}
+
+// freshness collects the freshness lifetime the upstream gave the pages of a
+// fetch, the shortest of them being how long the whole result stays fresh.
+type freshness struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	set bool
+}
+
+type freshnessKey struct{}
+
+func withFreshness(ctx context.Context) (context.Context, *freshness) {
+	f := new(freshness)
+	return context.WithValue(ctx, freshnessKey{}, f), f
+}
+
+// recordFreshness notes the lifetime given by an upstream response's headers
+// with the freshness collected by ctx, if any.
+func recordFreshness(ctx context.Context, h http.Header, now time.Time) {
+	f, _ := ctx.Value(freshnessKey{}).(*freshness)
+	if f == nil {
+		return
+	}
+
+	ttl, ok := upstreamFreshness(h, now)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.set || ttl < f.ttl {
+		f.ttl, f.set = ttl, true
+	}
+}
+
+// upstreamFreshness returns the freshness lifetime set by a response's
+// Cache-Control or, failing that, Expires header. As a shared cache, s-maxage
+// takes precedence over max-age. "private" is disregarded, since GitHub marks
+// every authenticated response with it, but no-store and no-cache give a
+// lifetime of 0.
+func upstreamFreshness(h http.Header, now time.Time) (time.Duration, bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			maxAge = parseDeltaSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseDeltaSeconds(value)
+		}
+	}
+	if sMaxAge >= 0 {
+		return time.Duration(sMaxAge) * time.Second, true
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid date means already expired.
+			return 0, true
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		return max(expires.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+// parseDeltaSeconds parses a Cache-Control delta-seconds value, returning -1
+// if it is invalid.
+func parseDeltaSeconds(v string) int {
+	n, err := strconv.Atoi(strings.Trim(v, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// cacheRepos caches repos under url for the lifetime the upstream gave them,
+// when fresh recorded one, or else the cache's own TTL. A lifetime of 0 isn't
+// cached at all.
+func (ah *ApiRequestHandler) cacheRepos(url string, repos apiresponse.Repos, fresh *freshness) {
+	if fresh == nil {
+		ah.cache.Set(url, repos)
+		return
+	}
+
+	fresh.mu.Lock()
+	ttl, set := fresh.ttl, fresh.set
+	fresh.mu.Unlock()
+
+	switch {
+	case !set:
+		ah.cache.Set(url, repos)
+	case ttl > 0:
+		ah.cache.SetTTL(url, repos, ttl)
+	}
+}
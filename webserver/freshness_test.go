@@ -0,0 +1,108 @@
+package webserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+func TestUpstreamFreshness(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Minute).Format(http.TimeFormat)
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		wantOK bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"max-age", http.Header{"Cache-Control": {"private, max-age=60"}}, time.Minute, true},
+		{"quoted max-age", http.Header{"Cache-Control": {`max-age="60"`}}, time.Minute, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=30"}}, 30 * time.Second, true},
+		{"split headers", http.Header{"Cache-Control": {"public", "MAX-AGE=90"}}, 90 * time.Second, true},
+		{"no-cache", http.Header{"Cache-Control": {"max-age=60, no-cache"}}, 0, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, true},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0, false},
+		{"negative max-age", http.Header{"Cache-Control": {"max-age=-1"}}, 0, false},
+		{
+			"max-age over Expires",
+			http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}},
+			time.Minute,
+			true,
+		},
+		{"Expires", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{
+			"Expires against Date",
+			http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}, "Date": {date}},
+			time.Hour + time.Minute,
+			true,
+		},
+		{"Expires passed", http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0, true},
+		{"Expires invalid", http.Header{"Expires": {"0"}}, 0, true},
+	} {
+		got, ok := upstreamFreshness(tt.header, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: upstreamFreshness = %s, %t, want %s, %t", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRecordFreshnessKeepsShortest(t *testing.T) {
+	now := time.Now()
+	ctx, fresh := withFreshness(context.Background())
+
+	recordFreshness(ctx, http.Header{"Cache-Control": {"max-age=60"}}, now)
+	recordFreshness(ctx, http.Header{}, now)
+	recordFreshness(ctx, http.Header{"Cache-Control": {"max-age=30"}}, now)
+	recordFreshness(ctx, http.Header{"Cache-Control": {"max-age=90"}}, now)
+
+	if !fresh.set || fresh.ttl != 30*time.Second {
+		t.Errorf("freshness = %s, set %t, want the shortest page lifetime 30s", fresh.ttl, fresh.set)
+	}
+
+	// Without a collector in the context, recording is a no-op.
+	recordFreshness(context.Background(), http.Header{"Cache-Control": {"max-age=1"}}, now)
+}
+
+func TestCacheHonorsUpstreamLifetime(t *testing.T) {
+	for _, tt := range []struct {
+		cacheControl string
+		advance      time.Duration
+		wantCalls    int32
+	}{
+		{"max-age=10", 5 * time.Second, 1},
+		{"max-age=10", 10 * time.Second, 2},
+		{"no-store", 0, 2},
+		// Without a lifetime from the upstream, the cache's own TTL applies.
+		{"", 30 * time.Second, 1},
+	} {
+		var calls atomic.Int32
+		upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if tt.cacheControl != "" {
+				rw.Header().Set("Cache-Control", tt.cacheControl)
+			}
+			io.WriteString(rw, `[{"name":"a"}]`)
+		})
+		clk := clock.NewFake(time.Now())
+		_, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+			cfg.CacheTTL = time.Minute
+			cfg.CacheHonorUpstream = true
+		}, log.New(io.Discard, "", 0), clk)
+
+		get(t, url+"/")
+		clk.Advance(tt.advance)
+		get(t, url+"/")
+
+		if n := calls.Load(); n != tt.wantCalls {
+			t.Errorf("Cache-Control %q, %s apart: upstream called %d times, want %d", tt.cacheControl, tt.advance, n, tt.wantCalls)
+		}
+	}
+}
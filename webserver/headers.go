@@ -0,0 +1,57 @@
+package webserver
+
+import "net/http"
+
+// DefaultStrippedUpstreamHeaders are never forwarded from the upstream unless
+// configured otherwise, as they identify the server's session or requests to
+// GitHub.
+var DefaultStrippedUpstreamHeaders = []string{"Set-Cookie", "X-Github-Request-Id"}
+
+// hopByHopHeaders describe a single connection, so they are never forwarded.
+// Content-Length is included since the body is re-framed when copied.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// headerFilter selects the upstream response headers forwarded downstream by
+// the passthrough endpoint. Only allowed headers are forwarded, all of them
+// if "*" is allowed, and stripped headers never are.
+type headerFilter struct {
+	allowAll bool
+	allow    map[string]bool
+	strip    map[string]bool
+}
+
+func newHeaderFilter(allow, strip []string) *headerFilter {
+	f := &headerFilter{allow: make(map[string]bool), strip: make(map[string]bool)}
+	for _, name := range allow {
+		if name == "*" {
+			f.allowAll = true
+			continue
+		}
+		f.allow[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range append(strip, hopByHopHeaders...) {
+		f.strip[http.CanonicalHeaderKey(name)] = true
+	}
+
+	return f
+}
+
+// copy adds the headers of src the filter forwards to dst.
+func (f *headerFilter) copy(dst, src http.Header) {
+	for name, values := range src {
+		if f.strip[name] || !f.allowAll && !f.allow[name] {
+			continue
+		}
+		dst[name] = values
+	}
+}
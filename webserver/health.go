@@ -0,0 +1,149 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// HealthChecker reports whether a dependency of the server is usable.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// HealthCheckFunc adapts a function to a HealthChecker.
+type HealthCheckFunc func(ctx context.Context) error
+
+func (f HealthCheckFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+type healthCheck struct {
+	name     string
+	critical bool
+	checker  HealthChecker
+}
+
+// readiness is the set of checks behind /readyz. A failing critical check
+// makes the server unready; other failures are reported but tolerated.
+type readiness struct {
+	timeout time.Duration
+	checks  []healthCheck
+}
+
+func (rd *readiness) register(name string, critical bool, checker HealthChecker) {
+	rd.checks = append(rd.checks, healthCheck{name: name, critical: critical, checker: checker})
+}
+
+type checkStatus struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handler runs every check concurrently, each bounded by the check timeout,
+// and answers with each check's status by name, with 503 if any critical
+// check failed.
+func (rd *readiness) handler(logger *log.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		statuses := make(map[string]checkStatus, len(rd.checks))
+		code := http.StatusOK
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, check := range rd.checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ctx, cancel := context.WithTimeout(r.Context(), rd.timeout)
+				defer cancel()
+
+				status := checkStatus{Status: "ok", Critical: check.critical}
+				if err := check.checker.CheckHealth(ctx); err != nil {
+					status.Status = "failing"
+					status.Error = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				statuses[check.name] = status
+				if status.Error != "" && check.critical {
+					code = http.StatusServiceUnavailable
+				}
+			}()
+		}
+		wg.Wait()
+
+		for name, status := range statuses {
+			if status.Error != "" {
+				logger.Printf("WARNING: readiness check failed: check=%s critical=%t: %s", name, status.Critical, status.Error)
+			}
+		}
+
+		if err := writeJSON(rw, code, statuses); err != nil {
+			logger.Printf("io error writing response: %v", err)
+		}
+	}
+}
+
+// upstreamReady checks the upstream, taking a fresh cache entry as proof that
+// it works, so that frequent readiness probes don't spend the rate limit.
+// Otherwise the upstream is only called once per UpstreamCheckInterval.
+func (ah *ApiRequestHandler) upstreamReady(ctx context.Context) error {
+	if ah.cache != nil {
+		if _, ok := ah.cache.Get(ah.apiURL); ok {
+			return nil
+		}
+	}
+
+	return ah.upstreamCheck.CheckHealth(ctx)
+}
+
+// cachedCheck runs check at most once per interval, answering with its last
+// result in between. Concurrent callers share a single run.
+type cachedCheck struct {
+	check    HealthCheckFunc
+	interval time.Duration
+	clock    clock.Clock
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newCachedCheck(check HealthCheckFunc, interval time.Duration, clk clock.Clock) *cachedCheck {
+	return &cachedCheck{check: check, interval: interval, clock: clk}
+}
+
+func (c *cachedCheck) CheckHealth(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && c.clock.Now().Sub(c.checkedAt) < c.interval {
+		return c.err
+	}
+
+	err := c.check(ctx)
+	// A run cut short by its caller says nothing about the dependency.
+	if ctx.Err() == nil {
+		c.checkedAt, c.err = c.clock.Now(), err
+	}
+
+	return err
+}
+
+// failWhen is a check failing with msg whenever cond holds.
+func failWhen(cond func() bool, msg string) HealthCheckFunc {
+	return func(context.Context) error {
+		if cond() {
+			return errors.New(msg)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+func TestCachedCheck(t *testing.T) {
+	errDown := errors.New("upstream down")
+	for _, tt := range []struct {
+		name    string
+		wantErr error
+	}{
+		{"passing", nil},
+		{"failing", errDown},
+	} {
+		clk := clock.NewFake(time.Unix(0, 0))
+		calls := 0
+		check := newCachedCheck(func(context.Context) error {
+			calls++
+			return tt.wantErr
+		}, 10*time.Second, clk)
+
+		for range 3 {
+			if err := check.CheckHealth(context.Background()); err != tt.wantErr {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("%s: checked %d times within the interval, want 1", tt.name, calls)
+		}
+
+		clk.Advance(10 * time.Second)
+		if err := check.CheckHealth(context.Background()); err != tt.wantErr {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if calls != 2 {
+			t.Errorf("%s: checked %d times after the interval, want 2", tt.name, calls)
+		}
+	}
+}
+
+func TestCachedCheckIgnoresCancelledRuns(t *testing.T) {
+	calls := 0
+	check := newCachedCheck(func(ctx context.Context) error {
+		calls++
+		return ctx.Err()
+	}, 10*time.Second, clock.NewFake(time.Unix(0, 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := check.CheckHealth(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	if err := check.CheckHealth(context.Background()); err != nil {
+		t.Errorf("err = %v, want the cancelled run not to be reused", err)
+	}
+	if calls != 2 {
+		t.Errorf("checked %d times, want 2", calls)
+	}
+}
+
+func TestReadyzUpstreamCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		upstream int
+		want     int
+	}{
+		{"passing", http.StatusOK, http.StatusOK},
+		{"failing", http.StatusInternalServerError, http.StatusServiceUnavailable},
+	} {
+		var calls atomic.Int32
+		upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			rw.WriteHeader(tt.upstream)
+			rw.Write([]byte(`[]`))
+		})
+		_, url := newTestServer(t, upstream, nil)
+
+		for range 3 {
+			if resp, body := get(t, url+"/readyz"); resp.StatusCode != tt.want {
+				t.Errorf("%s: status = %d, want %d: %s", tt.name, resp.StatusCode, tt.want, body)
+			}
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("%s: upstream called %d times by repeated probes, want 1", tt.name, n)
+		}
+	}
+}
+
+func TestDrainingFailsOnlyReadiness(t *testing.T) {
+	srv, url := newTestServer(t, reposUpstream(`[]`), nil)
+	srv.draining.Store(true)
+
+	if resp, body := get(t, url+"/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d while draining: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	resp, body := get(t, url+"/readyz")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status = %d, want %d while draining: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+	if !strings.Contains(body, `"draining"`) {
+		t.Errorf("/readyz body = %s, want the draining check reported", body)
+	}
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/ status = %d, want new requests refused while draining: %s", resp.StatusCode, body)
+	}
+}
+
+func TestMaintenanceReportedNotFailingReadiness(t *testing.T) {
+	srv, url := newTestServer(t, reposUpstream(`[]`), nil)
+	srv.maintenance.Store(true)
+
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/ status = %d, want %d in maintenance: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+	if resp, body := get(t, url+"/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d in maintenance: %s", resp.StatusCode, http.StatusOK, body)
+	}
+
+	resp, body := get(t, url+"/readyz")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/readyz status = %d, want %d in maintenance: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	var checks map[string]checkStatus
+	if err := json.Unmarshal([]byte(body), &checks); err != nil {
+		t.Fatalf("/readyz body %s: %v", body, err)
+	}
+	if got := checks["maintenance"]; got.Status != "failing" || got.Critical {
+		t.Errorf("maintenance check = %+v, want a failing non-critical check", got)
+	}
+}
@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// hedger fires a second, identical upstream request when the first is slow,
+// to cut tail latency. Each attempt is hedged at most once, and the hedges in
+// flight are capped at the rate limiter's current size, so hedging never more
+// than doubles the load the rate limiter lets through to the upstream.
+type hedger struct {
+	delay time.Duration
+	limit func() int // the rate limiter's size, read at each hedge
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+// newHedger returns nil, disabling hedging, unless delay is positive.
+func newHedger(delay time.Duration, limit func() int) *hedger {
+	if delay <= 0 {
+		return nil
+	}
+
+	return &hedger{delay: delay, limit: limit}
+}
+
+// acquire takes a hedge slot if one is free, returning its release func.
+func (h *hedger) acquire() (func(), bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.inFlight >= max(h.limit(), 1) {
+		return nil, false
+	}
+	h.inFlight++
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.inFlight--
+	}, true
+}
+
+type pageResult struct {
+	repos apiresponse.Repos
+	next  string
+	err   error
+}
+
+// fetchHedged calls fetchPage, racing a hedged copy of r against it once the
+// hedge delay passes. The first success wins and the other is cancelled.
+func (ah *ApiRequestHandler) fetchHedged(r *http.Request) (apiresponse.Repos, string, error) {
+	if ah.hedge == nil {
+		return ah.fetchPage(r)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	results := make(chan pageResult, 2)
+	launch := func(release func()) {
+		go func() {
+			repos, next, err := ah.fetchPage(r.Clone(ctx))
+			release()
+			results <- pageResult{repos, next, err}
+		}()
+	}
+
+	launch(func() {})
+	pending := 1
+	hedgeAt := ah.clock.After(ah.hedge.delay)
+
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil || pending == 0 {
+				return res.repos, res.next, res.err
+			}
+		case <-hedgeAt:
+			hedgeAt = nil
+			// Without a free slot too many hedges are in flight already, so
+			// keep waiting.
+			if release, ok := ah.hedge.acquire(); ok {
+				launch(release)
+				pending++
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package webserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHedgesFollowLimiterResize(t *testing.T) {
+	srv, _ := newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 1
+		cfg.HedgeDelay = time.Millisecond
+	})
+
+	// hedges takes as many hedge slots as are free, returning how many.
+	var releases []func()
+	hedges := func() int {
+		n := 0
+		for {
+			release, ok := srv.api.hedge.acquire()
+			if !ok {
+				return n
+			}
+			releases = append(releases, release)
+			n++
+		}
+	}
+
+	if n := hedges(); n != 1 {
+		t.Fatalf("hedge slots = %d, want 1 at the initial limiter size", n)
+	}
+
+	srv.limiter.Resize(3)
+	if n := hedges(); n != 2 {
+		t.Errorf("hedge slots = %d, want 2 more once the limiter grows to 3", n)
+	}
+
+	srv.limiter.Resize(2)
+	for _, release := range releases {
+		release()
+	}
+	if n := hedges(); n != 2 {
+		t.Errorf("hedge slots = %d, want 2 once the limiter shrinks to 2", n)
+	}
+}
@@ -0,0 +1,143 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/tcuthbert/apiserver/cache"
+	"github.com/tcuthbert/apiserver/middleware"
+)
+
+// IdempotencyKeyHeader lets a retrying client have a repeated request answered
+// with the response to its first attempt.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotentBodyBytes bounds the responses kept for replay. Larger ones,
+// typically long streams, are served but not remembered.
+const maxIdempotentBodyBytes = 1 << 20
+
+// storedResponse is a response recorded for replay to the same idempotency key.
+type storedResponse struct {
+	request requestIdentity
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// requestIdentity is what a request repeating an idempotency key must match:
+// its URI, and the headers that select the response's format and range.
+type requestIdentity struct {
+	uri         string
+	accept      string
+	rangeHeader string
+}
+
+func identifyRequest(r *http.Request) requestIdentity {
+	return requestIdentity{
+		uri:         r.URL.RequestURI(),
+		accept:      r.Header.Get("Accept"),
+		rangeHeader: r.Header.Get("Range"),
+	}
+}
+
+// idempotency replays the stored response to requests repeating an earlier
+// request's Idempotency-Key. Unlike the upstream cache, entries are keyed by
+// the client's choice rather than the URL, scoped to the request method and
+// the caller, and reusing a key for a different request is rejected with
+// 422. Only successful responses are stored: errors get a fresh attempt when
+// retried, and a 304 depends on the If-None-Match of the request it answered.
+func idempotency(logger *log.Logger, store *cache.Cache[storedResponse]) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			key = r.Method + " " + idempotencyScope(r) + " " + key
+
+			if entry, ok := store.Get(key); ok {
+				stored := entry.Value
+				if stored.request != identifyRequest(r) {
+					http.Error(rw, "idempotency key reused for a different request", http.StatusUnprocessableEntity)
+					return
+				}
+
+				for name, values := range stored.header {
+					rw.Header()[name] = values
+				}
+				rw.Header().Set("Idempotent-Replayed", "true")
+				rw.WriteHeader(stored.status)
+				if _, err := rw.Write(stored.body); err != nil {
+					logger.Printf("io error writing response: %v", err)
+				}
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= 200 && rec.status < 300 && !rec.overflow {
+				store.Set(key, storedResponse{
+					request: identifyRequest(r),
+					status:  rec.status,
+					header:  rec.Header().Clone(),
+					body:    rec.body.Bytes(),
+				})
+			}
+		})
+	}
+}
+
+// idempotencyScope identifies the caller an idempotency key belongs to: the
+// credentials it presents, or failing those its address, so that one caller
+// can't be replayed another's response by reusing its key.
+func idempotencyScope(r *http.Request) string {
+	if auth, apiKey := r.Header.Get("Authorization"), r.Header.Get("X-API-Key"); auth != "" || apiKey != "" {
+		sum := sha256.Sum256([]byte(auth + "\x00" + apiKey))
+		return "credential:" + hex.EncodeToString(sum[:])
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return "address:" + ip
+}
+
+// responseRecorder passes a response through while keeping a copy of it, up
+// to maxIdempotentBodyBytes.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > maxIdempotentBodyBytes {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
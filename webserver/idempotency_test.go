@@ -0,0 +1,155 @@
+package webserver
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/cache"
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+func TestIdempotencyKeyHitsUpstreamOnce(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.WriteString(rw, `[{"name":"a"}]`)
+	})
+	_, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.IdempotencyTTL = time.Minute
+	})
+
+	first, firstBody := get(t, url+"/", IdempotencyKeyHeader, "k1")
+	second, secondBody := get(t, url+"/", IdempotencyKeyHeader, "k1")
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+	if first.StatusCode != http.StatusOK || second.StatusCode != http.StatusOK {
+		t.Fatalf("statuses = %d, %d, want both %d", first.StatusCode, second.StatusCode, http.StatusOK)
+	}
+	if secondBody != firstBody {
+		t.Errorf("replayed body = %s, want %s", secondBody, firstBody)
+	}
+	if second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("replay not marked with Idempotent-Replayed")
+	}
+}
+
+// newIdempotencyHandler wraps next in the idempotency middleware, counting
+// the requests that reach next.
+func newIdempotencyHandler(next http.HandlerFunc) (http.Handler, *atomic.Int32) {
+	calls := new(atomic.Int32)
+	store := cache.New[storedResponse](time.Minute, 0, clock.Real{})
+	h := idempotency(log.New(io.Discard, "", 0), store)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		next(rw, r)
+	}))
+
+	return h, calls
+}
+
+func serveIdempotent(h http.Handler, method, key string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestIdempotencyDoesNotStoreNonSuccess(t *testing.T) {
+	for _, status := range []int{
+		http.StatusNotModified,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusUnprocessableEntity,
+		http.StatusBadGateway,
+	} {
+		h, calls := newIdempotencyHandler(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(status)
+		})
+
+		serveIdempotent(h, http.MethodGet, "k1")
+		serveIdempotent(h, http.MethodGet, "k1")
+
+		if n := calls.Load(); n != 2 {
+			t.Errorf("status %d: handler called %d times, want 2", status, n)
+		}
+	}
+}
+
+func TestIdempotencyScopesKeys(t *testing.T) {
+	h, calls := newIdempotencyHandler(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+
+	serveIdempotent(h, http.MethodGet, "k1", "Authorization", "Bearer alice")
+	serveIdempotent(h, http.MethodGet, "k1", "Authorization", "Bearer alice")
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("same caller: handler called %d times, want 1", n)
+	}
+
+	serveIdempotent(h, http.MethodGet, "k1", "Authorization", "Bearer bob")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("another credential: handler called %d times, want 2", n)
+	}
+
+	serveIdempotent(h, http.MethodGet, "k1")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("no credential: handler called %d times, want 3", n)
+	}
+
+	serveIdempotent(h, http.MethodHead, "k1", "Authorization", "Bearer alice")
+	if n := calls.Load(); n != 4 {
+		t.Errorf("another method: handler called %d times, want 4", n)
+	}
+}
+
+func TestIdempotencyRejectsReuseForDifferentRequest(t *testing.T) {
+	h, _ := newIdempotencyHandler(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+
+	serveIdempotent(h, http.MethodGet, "k1")
+
+	req := httptest.NewRequest(http.MethodGet, "/?limit=1", nil)
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotencyRejectsReuseWithDifferentHeaders(t *testing.T) {
+	h, calls := newIdempotencyHandler(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+
+	serveIdempotent(h, http.MethodGet, "k1", "Accept", "application/json", "Range", "items=0-9")
+	if rec := serveIdempotent(h, http.MethodGet, "k1", "Accept", "application/json", "Range", "items=0-9"); rec.Code != http.StatusOK {
+		t.Fatalf("same headers: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	for _, header := range [][]string{
+		{"Accept", "application/x-ndjson", "Range", "items=0-9"},
+		{"Accept", "application/json", "Range", "items=10-19"},
+		{"Accept", "application/json"},
+	} {
+		if rec := serveIdempotent(h, http.MethodGet, "k1", header...); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: status = %d, want %d", header, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
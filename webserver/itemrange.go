@@ -0,0 +1,66 @@
+package webserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// itemRangeUnit is the range unit for slicing the repos list, as in
+// "Range: items=0-49", modelled on RFC 9110 byte ranges.
+const itemRangeUnit = "items"
+
+// itemRange is an inclusive range of repos. last is -1 for an open-ended
+// range such as "items=50-".
+type itemRange struct {
+	first, last int
+}
+
+// parseItemRange parses a Range header in the items unit. Anything else,
+// including malformed or multiple ranges, yields nil: RFC 9110 lets a server
+// ignore a Range header it doesn't support and send the full list.
+func parseItemRange(header string) *itemRange {
+	spec, ok := strings.CutPrefix(header, itemRangeUnit+"=")
+	if !ok {
+		return nil
+	}
+
+	firstStr, lastStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil
+	}
+
+	first, err := strconv.Atoi(firstStr)
+	if err != nil || first < 0 {
+		return nil
+	}
+	if lastStr == "" {
+		return &itemRange{first: first, last: -1}
+	}
+
+	last, err := strconv.Atoi(lastStr)
+	if err != nil || last < first {
+		return nil
+	}
+
+	return &itemRange{first: first, last: last}
+}
+
+// resolve clamps the range to a list of total items, reporting false if none
+// of them fall within it.
+func (ir itemRange) resolve(total int) (first, last int, ok bool) {
+	if ir.first >= total {
+		return 0, 0, false
+	}
+
+	last = total - 1
+	if ir.last >= 0 {
+		last = min(ir.last, last)
+	}
+
+	return ir.first, last, true
+}
+
+func contentRange(first, last, total int) string {
+	return fmt.Sprintf("%s %d-%d/%d", itemRangeUnit, first, last, total)
+}
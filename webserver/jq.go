@@ -0,0 +1,149 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+const (
+	// maxJQLength bounds the ?jq expression, as parsing cost grows with it.
+	maxJQLength = 1024
+
+	// jqTimeout and maxJQResultBytes bound the cost of evaluating an
+	// expression and the size of what it may project, since a few nested
+	// projections over a large list can multiply both.
+	jqTimeout        = 100 * time.Millisecond
+	maxJQResultBytes = 1 << 20
+
+	// maxJQDepth bounds how deeply a result may nest.
+	maxJQDepth = 64
+)
+
+var (
+	errJQTimeout  = errors.New("expression took too long to evaluate")
+	errJQTooLarge = errors.New("expression result is too large")
+	errJQEval     = errors.New("expression failed to evaluate against the repos")
+)
+
+// jqQuery is a compiled ?jq JMESPath expression.
+type jqQuery struct {
+	src  string
+	expr *jmespath.JMESPath
+}
+
+func parseJQ(src string) (*jqQuery, error) {
+	if len(src) > maxJQLength {
+		return nil, fmt.Errorf("must be at most %d bytes", maxJQLength)
+	}
+
+	expr, err := jmespath.Compile(src)
+	if err != nil {
+		return nil, fmt.Errorf("must be a valid JMESPath expression: %v", err)
+	}
+
+	return &jqQuery{src: src, expr: expr}, nil
+}
+
+// evalJQ evaluates q against the JSON form of v, returning the encoded result.
+func (ah *ApiRequestHandler) evalJQ(q *jqQuery, v any) (json.RawMessage, error) {
+	// JMESPath works on JSON values, not Go structs, so field names follow
+	// the JSON tags and any recasing already applied.
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+
+	// The library can't be interrupted, so a slow evaluation is abandoned
+	// rather than stopped. Encoding runs under the same deadline: a result
+	// may share one value many times over, so it is cheap to project but
+	// exponentially large once written out.
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := q.expr.Search(data)
+		if err != nil {
+			// Runtime errors quote the whole input, too much to send back.
+			done <- result{nil, errJQEval}
+			return
+		}
+		var buf bytes.Buffer
+		err = encodeJQResult(&buf, v, 0)
+		done <- result{buf.Bytes(), err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.out, res.err
+	case <-ah.clock.After(jqTimeout):
+		return nil, errJQTimeout
+	}
+}
+
+// encodeJQResult writes v as JSON, as json.Marshal would, giving up with
+// errJQTooLarge as soon as buf passes maxJQResultBytes or v nests deeper
+// than maxJQDepth.
+func encodeJQResult(buf *bytes.Buffer, v any, depth int) error {
+	if buf.Len() > maxJQResultBytes || depth > maxJQDepth {
+		return errJQTooLarge
+	}
+
+	switch v := v.(type) {
+	case []any:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJQResult(buf, elem, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJQResult(buf, k, depth); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeJQResult(buf, v[k], depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+
+	if buf.Len() > maxJQResultBytes {
+		return errJQTooLarge
+	}
+
+	return nil
+}
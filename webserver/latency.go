@@ -0,0 +1,162 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// latencyBounds are the upper bounds of the histogram buckets, doubling from
+// 1ms to about 65s. Anything slower lands in an overflow bucket.
+var latencyBounds = func() (bounds [17]time.Duration) {
+	for i := range bounds {
+		bounds[i] = time.Millisecond << i
+	}
+	return bounds
+}()
+
+// latencyHistogram is a fixed-bucket response time distribution. Percentiles
+// are reported as the upper bound of the bucket they fall in, so they may
+// overstate the true value by up to a factor of two.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts [len(latencyBounds) + 1]uint64
+	total  uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.mu.Unlock()
+}
+
+type latencySnapshot struct {
+	count         uint64
+	p50, p90, p99 time.Duration
+}
+
+// reset returns the percentiles observed since the previous reset and starts
+// a new window.
+func (h *latencyHistogram) reset() latencySnapshot {
+	h.mu.Lock()
+	counts, total := h.counts, h.total
+	h.counts, h.total = [len(h.counts)]uint64{}, 0
+	h.mu.Unlock()
+
+	return latencySnapshot{
+		count: total,
+		p50:   percentile(counts[:], total, 0.50),
+		p90:   percentile(counts[:], total, 0.90),
+		p99:   percentile(counts[:], total, 0.99),
+	}
+}
+
+// percentile returns the upper bound of the bucket holding the p-th fraction
+// of the total observations. The overflow bucket reports as the last bound.
+func percentile(counts []uint64, total uint64, p float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(p*float64(total) + 0.5)
+	rank = max(rank, 1)
+
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			return latencyBounds[min(i, len(latencyBounds)-1)]
+		}
+	}
+
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// routeLatencies keeps a histogram per route. Routes are labelled by their
+// ServeMux pattern, such as "GET /summary", rather than the request path, so
+// the number of histograms is bounded by the registered routes.
+type routeLatencies struct {
+	mu      sync.Mutex
+	byRoute map[string]*latencyHistogram
+}
+
+func (l *routeLatencies) histogram(route string) *latencyHistogram {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.byRoute[route]
+	if !ok {
+		if l.byRoute == nil {
+			l.byRoute = make(map[string]*latencyHistogram)
+		}
+		h = new(latencyHistogram)
+		l.byRoute[route] = h
+	}
+
+	return h
+}
+
+// instrument records the response time of every request h serves under route.
+func (l *routeLatencies) instrument(route string, h http.Handler) http.Handler {
+	hist := l.histogram(route)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() { hist.observe(time.Since(start)) }()
+
+		h.ServeHTTP(rw, r)
+	})
+}
+
+func (l *routeLatencies) routes() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(l.byRoute))
+}
+
+// logLatency logs the response time percentiles of each route every interval
+// until ctx is cancelled. Quiet routes are skipped.
+func logLatency(
+	ctx context.Context,
+	l *routeLatencies,
+	interval time.Duration,
+	logger *log.Logger,
+	clk clock.Clock,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+
+		for _, route := range l.routes() {
+			s := l.histogram(route).reset()
+			if s.count == 0 {
+				continue
+			}
+			logger.Printf(
+				"INFO: latency route=%q window=%s count=%d p50<=%s p90<=%s p99<=%s",
+				route,
+				interval,
+				s.count,
+				s.p50,
+				s.p90,
+				s.p99,
+			)
+		}
+	}
+}
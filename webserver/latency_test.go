@@ -0,0 +1,63 @@
+package webserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	// Buckets 0 to 2 are bounded by 1ms, 2ms and 4ms.
+	for _, tt := range []struct {
+		name   string
+		counts []uint64
+		p      float64
+		want   time.Duration
+	}{
+		{"empty", []uint64{0, 0, 0}, 0.5, 0},
+		{"single bucket", []uint64{0, 4, 0}, 0.99, 2 * time.Millisecond},
+		{"median in first", []uint64{6, 3, 1}, 0.5, time.Millisecond},
+		{"p90 in second", []uint64{6, 3, 1}, 0.9, 2 * time.Millisecond},
+		{"p99 in last", []uint64{6, 3, 1}, 0.99, 4 * time.Millisecond},
+		{"low rank still counts one", []uint64{1, 0, 0}, 0.01, time.Millisecond},
+	} {
+		var total uint64
+		for _, n := range tt.counts {
+			total += n
+		}
+		if got := percentile(tt.counts, total, tt.p); got != tt.want {
+			t.Errorf("%s: percentile(%v, %.2f) = %s, want %s", tt.name, tt.counts, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	// 90 fast requests, 9 slower ones and one slower than every bucket.
+	for range 90 {
+		h.observe(800 * time.Microsecond)
+	}
+	for range 9 {
+		h.observe(30 * time.Millisecond)
+	}
+	h.observe(5 * time.Minute)
+
+	s := h.reset()
+	want := latencySnapshot{
+		count: 100,
+		p50:   time.Millisecond,
+		p90:   time.Millisecond,
+		p99:   32 * time.Millisecond,
+	}
+	if s != want {
+		t.Errorf("snapshot = %+v, want %+v", s, want)
+	}
+
+	if s := h.reset(); s.count != 0 {
+		t.Errorf("count after reset = %d, want 0", s.count)
+	}
+
+	h.observe(5 * time.Minute)
+	if s := h.reset(); s.p50 != latencyBounds[len(latencyBounds)-1] {
+		t.Errorf("overflow p50 = %s, want the last bound %s", s.p50, latencyBounds[len(latencyBounds)-1])
+	}
+}
@@ -0,0 +1,88 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkGoroutines fails t if, once its cleanups have run, more goroutines
+// remain than when it was called. It must be called before anything that
+// registers a cleanup, such as the test servers, so that it checks last.
+// Goroutines abandoned until their work completes get a grace period to
+// finish.
+func checkGoroutines(t *testing.T) {
+	t.Helper()
+
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		http.DefaultClient.CloseIdleConnections()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Errorf("%d goroutines left running, want %d:\n%s", runtime.NumGoroutine(), before, buf)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestNoGoroutineLeakOnUpstreamTimeout(t *testing.T) {
+	checkGoroutines(t)
+	_, url := newTestServer(t, http.HandlerFunc(hangingUpstream), func(cfg *Config) {
+		cfg.UpstreamTimeout = 20 * time.Millisecond
+		cfg.HedgeDelay = 5 * time.Millisecond
+	})
+
+	for range 10 {
+		if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusGatewayTimeout, body)
+		}
+	}
+}
+
+func TestNoGoroutineLeakOnClientCancel(t *testing.T) {
+	checkGoroutines(t)
+	_, url := newTestServer(t, http.HandlerFunc(hangingUpstream), nil)
+
+	for range 10 {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			t.Errorf("status = %d, want the request cancelled", resp.StatusCode)
+		}
+		cancel()
+	}
+}
+
+func TestNoGoroutineLeakPastMaxEncodeTime(t *testing.T) {
+	checkGoroutines(t)
+	body, err := json.Marshal(fixtureRepos(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, url := newTestServer(t, reposUpstream(string(body)), func(cfg *Config) {
+		cfg.MaxEncodeTime = time.Microsecond
+	})
+
+	// The encode goroutine is abandoned, and must exit once it finishes.
+	resp, respBody := get(t, url+"/?case=camel")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(respBody, `"name"`) {
+		t.Errorf("body has part of the abandoned response")
+	}
+}
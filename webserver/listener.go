@@ -0,0 +1,165 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// listen opens the server's TCP listener, applying the socket options and
+// connection limits in cfg.
+func listen(ctx context.Context, cfg Config, logger *log.Logger) (net.Listener, error) {
+	var lc net.ListenConfig
+	if cfg.ReusePort {
+		lc.Control = reusePort
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ListenBacklog > 0 {
+		if err := setBacklog(ln, cfg.ListenBacklog); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("could not set listen backlog: %w", err)
+		}
+	}
+
+	if cfg.MaxConnsPerIP > 0 {
+		ln = &perIPListener{
+			Listener: ln,
+			max:      cfg.MaxConnsPerIP,
+			logger:   logger,
+			conns:    make(map[string]int),
+		}
+	}
+
+	if cfg.MaxConnLifetime > 0 {
+		ln = lifetimeListener{Listener: ln, lifetime: cfg.MaxConnLifetime}
+	}
+
+	return ln, nil
+}
+
+// lifetimeListener wraps accepted connections so that none outlives lifetime,
+// however busy it is kept. http.Server.ConnContext can't do this: cancelling
+// a connection's context doesn't close it, and the server sets the deadlines
+// that do on the net.Conn itself, so only a wrapped conn can bound them.
+type lifetimeListener struct {
+	net.Listener
+	lifetime time.Duration
+}
+
+func (l lifetimeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &lifetimeConn{Conn: c, expires: time.Now().Add(l.lifetime)}
+	if err := lc.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return lc, nil
+}
+
+// lifetimeConn clamps every deadline the server sets to its expiry, so
+// ReadTimeout, WriteTimeout and keep-alive idling can't extend it.
+type lifetimeConn struct {
+	net.Conn
+	expires time.Time
+}
+
+func (c *lifetimeConn) clamp(t time.Time) time.Time {
+	if t.IsZero() || t.After(c.expires) {
+		return c.expires
+	}
+
+	return t
+}
+
+func (c *lifetimeConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.clamp(t))
+}
+
+func (c *lifetimeConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.clamp(t))
+}
+
+func (c *lifetimeConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.clamp(t))
+}
+
+// perIPListener closes accepted connections from a remote IP that already has
+// max connections open, so that no single client can hold all of them.
+type perIPListener struct {
+	net.Listener
+	max    int
+	logger *log.Logger
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := c.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		if !l.acquire(ip) {
+			l.logger.Printf("WARNING: refusing connection, per-IP limit reached: remote-ip=%s max-conns-per-ip=%d", ip, l.max)
+			c.Close()
+			continue
+		}
+
+		return &perIPConn{Conn: c, release: sync.OnceFunc(func() { l.release(ip) })}, nil
+	}
+}
+
+func (l *perIPListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+
+	return true
+}
+
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// perIPConn gives its slot back to the perIPListener once closed, however
+// many times Close is called.
+type perIPConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *perIPConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+
+	return err
+}
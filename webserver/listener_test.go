@@ -0,0 +1,204 @@
+package webserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// serveWithLifetime serves trivial responses on a listener whose connections
+// last at most lifetime, with keep-alive idling allowed far longer, and
+// returns its address.
+func serveWithLifetime(t *testing.T, lifetime time.Duration) string {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.MaxConnLifetime = lifetime
+
+	ln, err := listen(context.Background(), cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, "ok")
+		}),
+		IdleTimeout: time.Minute,
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+// roundTrip sends a request on conn and reads its response.
+func roundTrip(conn net.Conn, br *bufio.Reader) error {
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func TestMaxConnLifetimeBusy(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	addr := serveWithLifetime(t, lifetime)
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Keep the connection busy with requests, each of which would reset an
+	// idle or read timeout, until the server closes it.
+	for roundTrip(conn, br) == nil {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection still open long past its lifetime")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if elapsed := time.Since(start); elapsed < lifetime {
+		t.Errorf("connection closed after %s, before its %s lifetime", elapsed, lifetime)
+	}
+}
+
+func TestMaxConnLifetimeIdle(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	addr := serveWithLifetime(t, lifetime)
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	if err := roundTrip(conn, br); err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle connection is closed at its lifetime, not the idle timeout.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read on the idle connection = %v, want %v", err, io.EOF)
+	}
+	if elapsed := time.Since(start); elapsed < lifetime || elapsed > 2*time.Second {
+		t.Errorf("idle connection closed after %s, want at its %s lifetime", elapsed, lifetime)
+	}
+}
+
+func TestTwoServersShareNoState(t *testing.T) {
+	type instance struct {
+		name string
+		size int
+		srv  *webserver
+		url  string
+	}
+	start := func(name string, size int) instance {
+		up := httptest.NewServer(reposUpstream(`[{"name":"` + name + `"}]`))
+		t.Cleanup(up.Close)
+
+		cfg := DefaultConfig()
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.APIURL = up.URL
+		cfg.CacheTTL = time.Minute
+		cfg.MaxActiveAPIRequests = size
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		srv, err := newWebserver(ctx, &cfg, log.New(io.Discard, "", 0), clock.Real{})
+		if err != nil {
+			t.Error(err)
+			return instance{}
+		}
+		ln, err := listen(ctx, cfg, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Error(err)
+			return instance{}
+		}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+
+		return instance{name, size, srv, "http://" + ln.Addr().String()}
+	}
+
+	// Built concurrently, so the race detector sees any state they share.
+	var a, b instance
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a = start("first", 2) }()
+	go func() { defer wg.Done(); b = start("second", 7) }()
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if a.url == b.url {
+		t.Fatalf("both servers listen on %s", a.url)
+	}
+	for _, in := range []instance{a, b, a, b} {
+		resp, body := get(t, in.url+"/")
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"`+in.name+`"`) {
+			t.Errorf("%s: %d %s, want its own upstream's repos", in.name, resp.StatusCode, body)
+		}
+		if n := in.srv.limiter.size(); n != in.size {
+			t.Errorf("%s: limiter size = %d, want %d", in.name, n, in.size)
+		}
+	}
+
+	a.srv.maintenance.Store(true)
+	if resp, _ := get(t, b.url+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("second server status = %d in the first's maintenance, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT load balancing between listeners is only tested on Linux")
+	}
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.ReusePort = true
+	logger := log.New(io.Discard, "", 0)
+
+	first, err := listen(context.Background(), cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	cfg.ListenAddr = first.Addr().String()
+	second, err := listen(context.Background(), cfg, logger)
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", cfg.ListenAddr, err)
+	}
+	defer second.Close()
+
+	cfg.ReusePort = false
+	if ln, err := listen(context.Background(), cfg, logger); err == nil {
+		ln.Close()
+		t.Errorf("listener without SO_REUSEPORT bound %s as well", cfg.ListenAddr)
+	}
+}
@@ -0,0 +1,72 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tcuthbert/apiserver/middleware"
+)
+
+// errorResponse is the JSON body of errors not tied to a query parameter.
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// maintenanceGate answers API requests with a 503 JSON body while on is set.
+func maintenanceGate(logger *log.Logger, on *atomic.Bool) middleware.Middleware {
+	retryAfter := strconv.Itoa(int(MaintenanceRetryAfter.Seconds()))
+	body := errorResponse{
+		Error:   "maintenance",
+		Message: "The service is undergoing planned maintenance, please try again later.",
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !on.Load() {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			rw.Header().Set("Retry-After", retryAfter)
+			if err := writeJSON(rw, http.StatusServiceUnavailable, body); err != nil {
+				logger.Printf("io error writing response: %v", err)
+			}
+		})
+	}
+}
+
+// toggleMaintenanceOnSignal flips maintenance mode each time sig fires, until
+// ctx is cancelled.
+func toggleMaintenanceOnSignal(
+	ctx context.Context,
+	on *atomic.Bool,
+	logger *log.Logger,
+	audit *auditLog,
+	sig <-chan os.Signal,
+) {
+	for {
+		var s os.Signal
+		select {
+		case <-ctx.Done():
+			return
+		case s = <-sig:
+		}
+
+		// Only this goroutine writes, so a load then store can't race.
+		enabled := !on.Load()
+		on.Store(enabled)
+		logger.Printf("INFO: maintenance mode toggled: enabled=%t", enabled)
+
+		action := "maintenance.disable"
+		if enabled {
+			action = "maintenance.enable"
+		}
+		audit.record(auditRecord{Time: time.Now().UTC(), Action: action, Actor: "signal:" + s.String()})
+	}
+}
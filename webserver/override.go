@@ -0,0 +1,96 @@
+package webserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// UpstreamOverrideHeader names the request header trusted proxies use to
+// route a request to an alternative upstream host.
+const UpstreamOverrideHeader = "X-Upstream-Override"
+
+// upstreamOverride decides whether a request may replace the upstream host.
+type upstreamOverride struct {
+	trusted []netip.Prefix
+	hosts   []string
+}
+
+// newUpstreamOverride returns nil unless cfg.AllowUpstreamOverride is set, so
+// the header is ignored entirely by default.
+func newUpstreamOverride(cfg *Config) (*upstreamOverride, error) {
+	if !cfg.AllowUpstreamOverride {
+		return nil, nil
+	}
+
+	o := &upstreamOverride{}
+	for _, s := range cfg.TrustedProxies {
+		prefix, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		o.trusted = append(o.trusted, prefix)
+	}
+	for _, host := range cfg.UpstreamOverrideHosts {
+		o.hosts = append(o.hosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+
+	return o, nil
+}
+
+// parsePrefix accepts a CIDR or a bare address, the latter matching only
+// itself.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// target returns apiURL with its host replaced by the request's override
+// header, or apiURL unchanged when the override isn't honoured.
+func (o *upstreamOverride) target(r *http.Request, apiURL string) string {
+	if o == nil {
+		return apiURL
+	}
+
+	host := strings.ToLower(strings.TrimSpace(r.Header.Get(UpstreamOverrideHeader)))
+	if host == "" || !o.trustedPeer(r.RemoteAddr) || !slices.Contains(o.hosts, host) {
+		return apiURL
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return apiURL
+	}
+	u.Host = host
+
+	return u.String()
+}
+
+func (o *upstreamOverride) trustedPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	return slices.ContainsFunc(o.trusted, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
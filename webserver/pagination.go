@@ -0,0 +1,96 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// partialResultsError reports that only some upstream pages could be fetched.
+type partialResultsError struct {
+	page int
+	err  error
+}
+
+func (e *partialResultsError) Error() string {
+	return fmt.Sprintf("page %d failed: %v", e.page, e.err)
+}
+
+func (e *partialResultsError) Unwrap() error {
+	return e.err
+}
+
+// warning formats the error as an RFC 7234 Warning header value.
+func (e *partialResultsError) warning() string {
+	return fmt.Sprintf(`199 - "incomplete results: upstream page %d failed"`, e.page)
+}
+
+// fetchRepos fetches up to maxPages pages of repos starting at r, following
+// the upstream's Link header. When partialOK is set and a page after the first
+// fails, the repos fetched so far are returned with a *partialResultsError.
+// When the upstream's caching headers are honoured, the freshness they gave
+// the pages is returned for cacheRepos, and is nil otherwise.
+func (ah *ApiRequestHandler) fetchRepos(r *http.Request) (apiresponse.Repos, *freshness, error) {
+	// Non-nil, so an empty list encodes as [] rather than null.
+	repos := apiresponse.Repos{}
+
+	var fresh *freshness
+	if ah.honorUpstreamCache {
+		var ctx context.Context
+		ctx, fresh = withFreshness(r.Context())
+		r = r.WithContext(ctx)
+	}
+
+	for page := 1; ; page++ {
+		pageRepos, next, err := ah.fetchPageWithRetry(r)
+		if err != nil {
+			if page > 1 && ah.partialOK {
+				return repos, fresh, &partialResultsError{page: page, err: err}
+			}
+			return nil, nil, err
+		}
+		repos = append(repos, pageRepos...)
+
+		if next == "" || page >= ah.maxPages {
+			return repos, fresh, nil
+		}
+
+		if r, err = ah.newUpstreamRequest(r.Context(), next); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// nextPageURL extracts the rel="next" target from a GitHub style Link header
+// on the response to from. The credentials sent upstream would follow the
+// link, so a target on another scheme or host than from is refused; from is
+// on the configured API URL unless a trusted proxy overrode it.
+func nextPageURL(h http.Header, from *url.URL) (string, error) {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			if strings.TrimSpace(param) != `rel="next"` {
+				continue
+			}
+
+			next, err := from.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+			if err != nil {
+				return "", fmt.Errorf("invalid next page link: %w", err)
+			}
+			if next.Scheme != from.Scheme || next.Host != from.Host {
+				return "", fmt.Errorf("next page link %s leaves %s://%s", next.Redacted(), from.Scheme, from.Host)
+			}
+			return next.String(), nil
+		}
+	}
+
+	return "", nil
+}
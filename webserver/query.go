@@ -0,0 +1,254 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// queryOptions are the client-controlled transformations applied to the repos
+// before they are encoded.
+type queryOptions struct {
+	offset   int
+	limit    int
+	groupBy  string
+	envelope bool
+	cli      *bool // nil unless ?cli was given
+	filters  []apiresponse.Predicate
+	keyCase  apiresponse.KeyCase
+	jq       *jqQuery
+
+	// upstream holds the passthrough parameters forwarded to GitHub.
+	upstream url.Values
+
+	format      responseFormat
+	ifNoneMatch string
+	itemRange   *itemRange // from the Range header, replacing offset and limit
+}
+
+// reshaped reports whether the repos are grouped, wrapped in the envelope or
+// projected with ?jq, which only the buffered JSON encoding supports.
+func (opts queryOptions) reshaped() bool {
+	return opts.groupBy != "" || opts.envelope || opts.jq != nil
+}
+
+// paramError describes a single invalid query parameter.
+type paramError struct {
+	Param   string `json:"param"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+type paramErrors []paramError
+
+func (e paramErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = fmt.Sprintf("invalid %s %q: %s", pe.Param, pe.Value, pe.Message)
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// queryParser validates every recognised query parameter up front, so that
+// all problems can be reported to the client in a single response.
+type queryParser struct {
+	maxLimit    int
+	strict      bool // reject unrecognised parameters
+	passthrough bool // forward upstreamParams to GitHub
+}
+
+type paramParser func(p queryParser, opts *queryOptions, v string) error
+
+var queryParams = map[string]paramParser{
+	"limit": func(p queryParser, opts *queryOptions, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return errors.New("must be a positive integer")
+		}
+		opts.limit = min(n, p.maxLimit)
+		return nil
+	},
+	"offset": func(_ queryParser, opts *queryOptions, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative integer")
+		}
+		opts.offset = n
+		return nil
+	},
+	"group_by": func(_ queryParser, opts *queryOptions, v string) error {
+		if v != "language" {
+			return errors.New(`must be "language"`)
+		}
+		opts.groupBy = v
+		return nil
+	},
+	"exclude_forks":    boolFilter(apiresponse.NotFork),
+	"exclude_archived": boolFilter(apiresponse.NotArchived),
+	"visibility": func(_ queryParser, opts *queryOptions, v string) error {
+		if v != "public" && v != "private" && v != "internal" {
+			return errors.New(`must be one of "public", "private" or "internal"`)
+		}
+		opts.filters = append(opts.filters, apiresponse.HasVisibility(v))
+		return nil
+	},
+	"case": func(_ queryParser, opts *queryOptions, v string) error {
+		switch v {
+		case "snake":
+			opts.keyCase = apiresponse.UpstreamCase
+		case "camel":
+			opts.keyCase = apiresponse.CamelCase
+		default:
+			return errors.New(`must be "snake" or "camel"`)
+		}
+		return nil
+	},
+	"jq": func(_ queryParser, opts *queryOptions, v string) error {
+		q, err := parseJQ(v)
+		if err != nil {
+			return err
+		}
+		opts.jq = q
+		return nil
+	},
+	"cli": func(_ queryParser, opts *queryOptions, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		opts.cli = &b
+		return nil
+	},
+	"envelope": func(_ queryParser, opts *queryOptions, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		opts.envelope = b
+		return nil
+	},
+}
+
+// upstreamParams are the GitHub repos listing parameters that may be passed
+// through, each with the values it accepts. Anything else is never forwarded.
+var upstreamParams = map[string]func(v string) error{
+	"type":      oneOf("all", "owner", "member"),
+	"sort":      oneOf("created", "updated", "pushed", "full_name"),
+	"direction": oneOf("asc", "desc"),
+	"per_page": func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return errors.New("must be an integer between 1 and 100")
+		}
+		return nil
+	},
+}
+
+func oneOf(values ...string) func(v string) error {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	msg := "must be one of " + strings.Join(quoted, ", ")
+
+	return func(v string) error {
+		if !slices.Contains(values, v) {
+			return errors.New(msg)
+		}
+		return nil
+	}
+}
+
+// boolFilter parses a boolean parameter that applies pred when true.
+func boolFilter(pred apiresponse.Predicate) paramParser {
+	return func(_ queryParser, opts *queryOptions, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		if b {
+			opts.filters = append(opts.filters, pred)
+		}
+		return nil
+	}
+}
+
+func (p queryParser) parse(query url.Values) (queryOptions, paramErrors) {
+	opts := queryOptions{limit: -1}
+	var errs paramErrors
+
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		v := query.Get(name)
+
+		if validate, ok := upstreamParams[name]; ok && p.passthrough {
+			if v == "" {
+				continue
+			}
+			if err := validate(v); err != nil {
+				errs = append(errs, paramError{Param: name, Value: v, Message: err.Error()})
+				continue
+			}
+			if opts.upstream == nil {
+				opts.upstream = url.Values{}
+			}
+			opts.upstream.Set(name, v)
+			continue
+		}
+
+		parse, ok := queryParams[name]
+		if !ok {
+			if p.strict {
+				errs = append(errs, paramError{Param: name, Value: v, Message: "unknown parameter"})
+			}
+			continue
+		}
+
+		if v == "" {
+			continue
+		}
+		if err := parse(p, &opts, v); err != nil {
+			errs = append(errs, paramError{Param: name, Value: v, Message: err.Error()})
+		}
+	}
+
+	return opts, errs
+}
+
+// apply filters and pages through repos, reporting the total count and the
+// offset of the next page (if any) in the response headers. It returns the
+// status to respond with: 206 or 416 for an item range, otherwise 200.
+func (o queryOptions) apply(h http.Header, repos apiresponse.Repos) (apiresponse.Repos, int) {
+	if len(o.filters) > 0 {
+		repos = repos.Filter(o.filters...)
+	}
+
+	total := len(repos)
+	h.Set("Accept-Ranges", itemRangeUnit)
+	h.Set("X-Total-Count", strconv.Itoa(total))
+
+	if o.itemRange != nil {
+		first, last, ok := o.itemRange.resolve(total)
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("%s */%d", itemRangeUnit, total))
+			return nil, http.StatusRequestedRangeNotSatisfiable
+		}
+
+		h.Set("Content-Range", contentRange(first, last, total))
+		return repos[first : last+1], http.StatusPartialContent
+	}
+
+	repos = repos.Offset(o.offset).Limit(o.limit)
+	if next := o.offset + len(repos); len(repos) > 0 && next < total {
+		h.Set("X-Next-Offset", strconv.Itoa(next))
+	}
+
+	return repos, http.StatusOK
+}
@@ -0,0 +1,374 @@
+package webserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+	"github.com/tcuthbert/apiserver/middleware"
+)
+
+// RateLimiter bounds the number of concurrent requests reaching its handler,
+// admitting waiting requests in arrival order. Its capacity can be changed at
+// runtime with Resize.
+type RateLimiter struct {
+	handler  http.Handler
+	logger   *log.Logger
+	clock    clock.Clock
+	shutdown <-chan struct{} // closed when the server begins shutting down
+
+	// countQueued makes the capacity bound queued requests as well as those
+	// holding a slot, so requests beyond it are rejected instead of queued.
+	countQueued bool
+
+	mu        sync.Mutex
+	active    int // holding a slot, whether executing or backing off
+	executing int // holding a slot and inside the handler
+	delayed   int // holding a slot during a back-off delay
+	limit     int
+	waiters   list.List // of chan struct{}, closed once a slot is granted
+
+	lastBackoff   time.Duration
+	lastBackoffAt time.Time
+
+	// Capacity ramps up from 1 to limit over rampWindow from rampStart,
+	// see SlowStart.
+	rampStart  time.Time
+	rampWindow time.Duration
+}
+
+// NewRateLimitHandler returns a RateLimiter admitting size concurrent
+// requests. Back-off delays are cut short once shutdown is closed.
+func NewRateLimitHandler(
+	handler http.Handler,
+	logger *log.Logger,
+	size int,
+	clk clock.Clock,
+	shutdown <-chan struct{},
+) *RateLimiter {
+	return &RateLimiter{
+		logger:   logger,
+		handler:  handler,
+		clock:    clk,
+		shutdown: shutdown,
+		limit:    size,
+	}
+}
+
+// rateLimit adapts rl to a Middleware wrapping the next handler in the chain.
+// rl must only be used in a single chain.
+func rateLimit(rl *RateLimiter) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		rl.handler = next
+		return rl
+	}
+}
+
+// BackoffHeader advertises the back-off the rate limiter has recently been
+// applying, so that clients can throttle themselves before they are slowed.
+const BackoffHeader = "X-Server-Backoff"
+
+// backoffAdvertiseWindow is how long a back-off keeps being advertised after
+// it was applied.
+const backoffAdvertiseWindow = 5 * time.Second
+
+// errLimiterFull rejects a request that counting queued requests left no room
+// for.
+var errLimiterFull = errors.New("rate limiter full")
+
+func (rl *RateLimiter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	ok, err := rl.acquire(r.Context())
+	if errors.Is(err, errLimiterFull) {
+		rl.logger.Printf("WARNING: rejecting request, rate limiter full: max-request=%d", rl.size())
+		http.Error(
+			rw,
+			http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable,
+		)
+		return
+	}
+	if err != nil {
+		rl.logger.Printf("WARNING: request abandoned while queued: %v", err)
+		http.Error(
+			rw,
+			http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable,
+		)
+		return
+	}
+	if !ok { // too many in-flight requests detected.
+		delay := max(1, rand.IntN(5)) // minimum 1s back-off delay.
+		rl.logger.Printf(
+			"WARNING: %ds back-off delay triggered: active-requests=%d max-request=%d",
+			delay,
+			rl.total(),
+			rl.size(),
+		)
+		rl.recordBackoff(time.Duration(delay) * time.Second)
+		rl.track(&rl.delayed, 1)
+		select {
+		case <-rl.clock.After(time.Duration(delay) * time.Second):
+			rl.track(&rl.delayed, -1)
+		case <-r.Context().Done():
+			rl.track(&rl.delayed, -1)
+			rl.release()
+			return
+		case <-rl.shutdown:
+			rl.track(&rl.delayed, -1)
+			rl.release()
+			rl.logger.Println("WARNING: back-off delay aborted by shutdown")
+			http.Error(
+				rw,
+				http.StatusText(http.StatusServiceUnavailable),
+				http.StatusServiceUnavailable,
+			)
+			return
+		}
+	}
+	defer rl.release()
+
+	rl.track(&rl.executing, 1)
+	defer rl.track(&rl.executing, -1)
+
+	if backoff := rl.recentBackoff(); backoff > 0 {
+		rw.Header().Set(BackoffHeader, backoff.String())
+	}
+
+	rl.handler.ServeHTTP(rw, r)
+}
+
+func (rl *RateLimiter) recordBackoff(d time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.lastBackoff = d
+	rl.lastBackoffAt = rl.clock.Now()
+}
+
+// recentBackoff returns the last back-off applied, or 0 if there has been
+// none within backoffAdvertiseWindow.
+func (rl *RateLimiter) recentBackoff() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.lastBackoffAt.IsZero() || rl.clock.Now().Sub(rl.lastBackoffAt) >= backoffAdvertiseWindow {
+		return 0
+	}
+
+	return rl.lastBackoff
+}
+
+// track adds delta to one of rl's counters.
+func (rl *RateLimiter) track(counter *int, delta int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	*counter += delta
+}
+
+// Resize changes the limiter's capacity. Requests already holding a slot are
+// unaffected; waiting requests are admitted as soon as the new capacity allows.
+func (rl *RateLimiter) Resize(size int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limit = size
+	rl.admit()
+}
+
+// acquire takes a slot, queueing behind earlier arrivals while the limiter is
+// full, and reports whether slots remain free afterwards. It gives up with
+// ctx's error if ctx is done before a slot is granted.
+func (rl *RateLimiter) acquire(ctx context.Context) (bool, error) {
+	rl.mu.Lock()
+	if rl.waiters.Len() == 0 && rl.active < rl.capacity() {
+		rl.active++
+		ok := rl.active < rl.capacity()
+		rl.mu.Unlock()
+		return ok, nil
+	}
+	if rl.countQueued && rl.active+rl.waiters.Len() >= rl.capacity() {
+		rl.mu.Unlock()
+		return false, errLimiterFull
+	}
+	ready := make(chan struct{})
+	waiter := rl.waiters.PushBack(ready)
+	rl.mu.Unlock()
+
+	select {
+	case <-ready:
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.active < rl.capacity(), nil
+	case <-ctx.Done():
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+
+		select {
+		case <-ready:
+			// Granted concurrently with the cancellation: pass it on.
+			rl.active--
+			rl.admit()
+		default:
+			rl.waiters.Remove(waiter)
+		}
+		return false, ctx.Err()
+	}
+}
+
+func (rl *RateLimiter) release() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.active--
+	rl.admit()
+}
+
+// admit grants free slots to waiters in arrival order. rl.mu must be held.
+func (rl *RateLimiter) admit() {
+	for rl.active < rl.capacity() && rl.waiters.Len() > 0 {
+		ready := rl.waiters.Remove(rl.waiters.Front()).(chan struct{})
+		rl.active++
+		close(ready)
+	}
+}
+
+// capacity is the number of requests admitted at once, which is below limit
+// while slow start is ramping up. rl.mu must be held.
+func (rl *RateLimiter) capacity() int {
+	if rl.rampWindow <= 0 {
+		return rl.limit
+	}
+
+	elapsed := rl.clock.Now().Sub(rl.rampStart)
+	if elapsed >= rl.rampWindow {
+		return rl.limit
+	}
+
+	return 1 + int(int64(rl.limit-1)*int64(elapsed)/int64(rl.rampWindow))
+}
+
+func (rl *RateLimiter) size() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.capacity()
+}
+
+// SlowStart ramps the limiter's capacity linearly from 1 up to its size over
+// window, so that a cold upstream or freshly issued token isn't hit with full
+// concurrency straight after boot. It returns once the ramp is complete or
+// ctx is cancelled.
+func (rl *RateLimiter) SlowStart(ctx context.Context, window time.Duration) {
+	rl.mu.Lock()
+	rl.rampStart = rl.clock.Now()
+	rl.rampWindow = window
+	rl.mu.Unlock()
+
+	for {
+		rl.mu.Lock()
+		// Wake once per slot, the rate at which capacity grows.
+		step := window / time.Duration(max(rl.limit-1, 1))
+		elapsed := rl.clock.Now().Sub(rl.rampStart)
+		rl.admit()
+		rl.mu.Unlock()
+
+		if elapsed >= window {
+			rl.logger.Printf("INFO: rate limiter slow start complete: max-request=%d", rl.size())
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-rl.clock.After(min(step, window-elapsed)):
+		}
+	}
+}
+
+// limiterStats separates requests running an upstream call from those waiting
+// for one, whether queued for a slot or in a back-off delay.
+type limiterStats struct {
+	Executing   int  `json:"executing"`
+	Waiting     int  `json:"waiting"`
+	Capacity    int  `json:"capacity"`
+	CountQueued bool `json:"count_queued"`
+}
+
+func (rl *RateLimiter) stats() limiterStats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return limiterStats{
+		Executing:   rl.executing,
+		Waiting:     rl.waiters.Len() + rl.delayed,
+		Capacity:    rl.capacity(),
+		CountQueued: rl.countQueued,
+	}
+}
+
+// busy reports whether the limiter is full or has requests queued for a slot.
+func (rl *RateLimiter) busy() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.waiters.Len() > 0 || rl.active >= rl.capacity()
+}
+
+func (rl *RateLimiter) total() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.active
+}
+
+// resizeOnSignal re-reads the limiter size from path each time a signal
+// arrives on sig, until ctx is cancelled.
+func resizeOnSignal(
+	ctx context.Context,
+	rl *RateLimiter,
+	path string,
+	logger *log.Logger,
+	sig <-chan os.Signal,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		size, err := readLimiterSize(path)
+		if err != nil {
+			logger.Printf("ERROR: rate limiter reload failed: %v", err)
+			continue
+		}
+
+		rl.Resize(size)
+		logger.Printf("INFO: rate limiter resized: max-request=%d", size)
+	}
+}
+
+func readLimiterSize(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%s: invalid size %q: must be a positive integer", path, b)
+	}
+
+	return size, nil
+}
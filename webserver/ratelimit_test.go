@@ -0,0 +1,443 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// instantClock is the real clock with back-off delays skipped, so benchmarks
+// measure admission rather than the limiter's deliberate slow-down.
+type instantClock struct{}
+
+func (instantClock) Now() time.Time {
+	return time.Now()
+}
+
+func (instantClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+// limiterSizes are the limiter sizes benchmarked: the historical default of
+// 3 and multiples of the available CPUs.
+func limiterSizes() []int {
+	procs := runtime.GOMAXPROCS(0)
+	sizes := []int{1, 3, procs, 2 * procs, 4 * procs}
+	slices.Sort(sizes)
+	return slices.Compact(sizes)
+}
+
+// BenchmarkRateLimiter measures requests through the limiter alone, with
+// clients outnumbering its slots. With no work behind it this is the cost of
+// admission; with work standing in for an upstream round trip, throughput
+// grows with the size until the slots outnumber the clients.
+func BenchmarkRateLimiter(b *testing.B) {
+	clients := 4 * runtime.GOMAXPROCS(0)
+	logger := log.New(io.Discard, "", 0)
+
+	for _, work := range []time.Duration{0, time.Millisecond} {
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if work > 0 {
+				time.Sleep(work)
+			}
+		})
+
+		for _, size := range limiterSizes() {
+			b.Run(fmt.Sprintf("work=%s/size=%d", work, size), func(b *testing.B) {
+				rl := NewRateLimitHandler(handler, logger, size, instantClock{}, nil)
+
+				runConcurrently(b, clients, func() {
+					rl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+				})
+			})
+		}
+	}
+}
+
+func TestRateLimiterBackoff(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	served := make(chan struct{})
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(served)
+	})
+	// Taking the only slot leaves none free, which triggers the back-off.
+	rl := NewRateLimitHandler(handler, log.New(io.Discard, "", 0), 1, clk, nil)
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	clk.BlockUntil(1)
+	select {
+	case <-served:
+		t.Fatal("request served before its back-off delay elapsed")
+	default:
+	}
+
+	// Delays are a whole number of seconds, from 1 to 4.
+	clk.Advance(4 * time.Second)
+	<-done
+
+	d, err := time.ParseDuration(rec.Header().Get(BackoffHeader))
+	if err != nil || d < time.Second || d > 4*time.Second {
+		t.Errorf("%s = %q, want the 1-4s back-off applied", BackoffHeader, rec.Header().Get(BackoffHeader))
+	}
+
+	clk.Advance(backoffAdvertiseWindow)
+	if d := rl.recentBackoff(); d != 0 {
+		t.Errorf("back-off still advertised as %s after the advertise window", d)
+	}
+}
+
+func newTestLimiter(size int, clk clock.Clock) *RateLimiter {
+	return NewRateLimitHandler(http.NotFoundHandler(), log.New(io.Discard, "", 0), size, clk, nil)
+}
+
+// queued returns the number of requests waiting for a slot.
+func (rl *RateLimiter) queued() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.waiters.Len()
+}
+
+// waitFor polls until cond holds, failing t if it doesn't within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// enqueue starts n requests queueing on rl, one at a time so that their
+// arrival order is known, and returns a channel receiving each one's index as
+// it is granted a slot.
+func enqueue(t *testing.T, ctx context.Context, rl *RateLimiter, n int) <-chan int {
+	t.Helper()
+
+	granted := make(chan int, n)
+	for i := range n {
+		want := rl.queued() + 1
+		go func() {
+			if _, err := rl.acquire(ctx); err == nil {
+				granted <- i
+			}
+		}()
+		waitFor(t, fmt.Sprintf("request %d to queue", i), func() bool { return rl.queued() == want })
+	}
+
+	return granted
+}
+
+func TestRateLimiterFIFO(t *testing.T) {
+	rl := newTestLimiter(1, clock.Real{})
+	if _, err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	granted := enqueue(t, context.Background(), rl, 5)
+
+	for want := range 5 {
+		rl.release()
+		if got := <-granted; got != want {
+			t.Fatalf("request %d granted a slot, want %d in arrival order", got, want)
+		}
+	}
+	rl.release()
+
+	if n := rl.total(); n != 0 {
+		t.Errorf("%d slots still held, want 0", n)
+	}
+}
+
+func TestRateLimiterCancelWhileQueued(t *testing.T) {
+	rl := newTestLimiter(1, clock.Real{})
+	if _, err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := rl.acquire(ctx)
+		cancelled <- err
+	}()
+	waitFor(t, "the request to queue", func() bool { return rl.queued() == 1 })
+	next := enqueue(t, context.Background(), rl, 1)
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire = %v, want %v", err, context.Canceled)
+	}
+	if n := rl.queued(); n != 1 {
+		t.Fatalf("%d requests queued, want only the one behind the cancelled request", n)
+	}
+
+	rl.release()
+	<-next
+	rl.release()
+	if n := rl.total(); n != 0 {
+		t.Errorf("%d slots still held, want 0", n)
+	}
+}
+
+func TestRateLimiterCancelRacingGrant(t *testing.T) {
+	// Cancelling a queued request as its slot is granted must pass the slot
+	// on, rather than leak it or grant it twice.
+	for range 20 {
+		rl := newTestLimiter(1, clock.Real{})
+		if _, err := rl.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		first := make(chan error, 1)
+		go func() {
+			_, err := rl.acquire(ctx)
+			first <- err
+		}()
+		waitFor(t, "the request to queue", func() bool { return rl.queued() == 1 })
+		second := enqueue(t, context.Background(), rl, 1)
+
+		// Cancel while holding the lock, so that the request wakes for its
+		// cancellation and then finds the slot granted as well.
+		rl.mu.Lock()
+		cancel()
+		time.Sleep(time.Millisecond)
+		rl.active--
+		rl.admit()
+		rl.mu.Unlock()
+
+		if err := <-first; err == nil {
+			rl.release()
+		}
+		select {
+		case <-second:
+		case <-time.After(time.Second):
+			t.Fatal("slot granted to the cancelled request was never passed on")
+		}
+		rl.release()
+
+		if n := rl.total(); n != 0 {
+			t.Fatalf("%d slots still held, want 0", n)
+		}
+	}
+}
+
+func TestRateLimiterResize(t *testing.T) {
+	rl := newTestLimiter(1, clock.Real{})
+	if _, err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	granted := enqueue(t, context.Background(), rl, 3)
+
+	// Growing admits the earliest waiters at once.
+	rl.Resize(3)
+	if got := []int{<-granted, <-granted}; !slices.Contains(got, 0) || !slices.Contains(got, 1) {
+		t.Fatalf("requests %v granted slots, want 0 and 1", got)
+	}
+	if n := rl.queued(); n != 1 {
+		t.Fatalf("%d requests queued after growing to 3, want 1", n)
+	}
+
+	// Shrinking leaves held slots alone, but admits nobody until the
+	// requests holding them drop below the new size.
+	rl.Resize(1)
+	rl.release()
+	rl.release()
+	select {
+	case got := <-granted:
+		t.Fatalf("request %d granted a slot while 1 of 1 is held", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+	rl.release()
+	if got := <-granted; got != 2 {
+		t.Fatalf("request %d granted a slot, want 2", got)
+	}
+}
+
+func TestRateLimiterSlowStart(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rl := newTestLimiter(5, clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ramped := make(chan struct{})
+	go func() {
+		defer close(ramped)
+		rl.SlowStart(ctx, 4*time.Second)
+	}()
+	clk.BlockUntil(1)
+
+	if _, err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	granted := enqueue(t, context.Background(), rl, 4)
+
+	// Capacity grows by a slot a second, each admitting one more waiter.
+	for step := range 4 {
+		if n := rl.size(); n != step+1 {
+			t.Fatalf("capacity after %ds = %d, want %d", step, n, step+1)
+		}
+		clk.Advance(time.Second)
+		if got := <-granted; got != step {
+			t.Fatalf("request %d granted a slot, want %d", got, step)
+		}
+		if step < 3 {
+			clk.BlockUntil(1)
+		}
+	}
+
+	<-ramped
+	if n := rl.size(); n != 5 {
+		t.Errorf("capacity after the ramp = %d, want 5", n)
+	}
+}
+
+func TestRateLimiterCountQueued(t *testing.T) {
+	rl := newTestLimiter(2, clock.Real{})
+	rl.countQueued = true
+
+	for range 2 {
+		if _, err := rl.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A full limiter rejects rather than queues.
+	if _, err := rl.acquire(context.Background()); !errors.Is(err, errLimiterFull) {
+		t.Fatalf("acquire on a full limiter = %v, want %v", err, errLimiterFull)
+	}
+	rec := httptest.NewRecorder()
+	rl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if n := rl.queued(); n != 0 {
+		t.Errorf("%d requests queued, want none", n)
+	}
+
+	rl.release()
+	if _, err := rl.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after a release = %v, want a slot", err)
+	}
+}
+
+func TestRateLimiterStats(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	executing := make(chan struct{}, 3)
+	release := make(chan struct{})
+	rl := NewRateLimitHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		executing <- struct{}{}
+		<-release
+	}), log.New(io.Discard, "", 0), 2, clk, nil)
+
+	var wg sync.WaitGroup
+	serve := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+
+	// The first request executes, the second takes the last slot and backs
+	// off, and the third queues for a slot.
+	serve()
+	<-executing
+	serve()
+	clk.BlockUntil(1)
+	serve()
+	waitFor(t, "the third request to queue", func() bool { return rl.queued() == 1 })
+
+	want := limiterStats{Executing: 1, Waiting: 2, Capacity: 2}
+	if got := rl.stats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// Let everything finish, advancing past whichever back-offs follow.
+	close(release)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			clk.Advance(4 * time.Second)
+		}
+	}
+}
+
+func TestResizeOnSignal(t *testing.T) {
+	rl := newTestLimiter(2, clock.Real{})
+	path := filepath.Join(t.TempDir(), "max-active-requests")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Unbuffered, so each send waits for the previous reload to finish.
+	sig := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resizeOnSignal(ctx, rl, path, log.New(io.Discard, "", 0), sig)
+	}()
+
+	reload := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sig <- syscall.SIGHUP
+	}
+
+	reload("5\n")
+	waitFor(t, "the resize to 5", func() bool { return rl.size() == 5 })
+
+	for _, invalid := range []string{"", "many", "0", "-3"} {
+		reload(invalid)
+		// A second signal is only received once the first is handled.
+		sig <- syscall.SIGHUP
+		if n := rl.size(); n != 5 {
+			t.Errorf("size = %d after reloading %q, want it unchanged at 5", n, invalid)
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	sig <- syscall.SIGHUP
+	sig <- syscall.SIGHUP
+	if n := rl.size(); n != 5 {
+		t.Errorf("size = %d with the file missing, want it unchanged at 5", n)
+	}
+
+	cancel()
+	<-done
+}
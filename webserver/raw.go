@@ -0,0 +1,122 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apierror"
+)
+
+// rawHandler streams the first upstream page to the client exactly as it
+// was received, with the upstream's content type and whichever other headers
+// the header filter forwards. Nothing is decoded, so there are no
+// transformations, caching or retries, but passthrough parameters are still
+// forwarded.
+func (ah *ApiRequestHandler) rawHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		opts, paramErrs := ah.query.parse(r.URL.Query())
+		if len(paramErrs) > 0 {
+			ah.logger.Printf("ERROR: bad request: %v", paramErrs)
+			body := map[string]paramErrors{"errors": paramErrs}
+			if err := writeJSON(rw, http.StatusBadRequest, body); err != nil {
+				ah.logger.Printf("io error writing response: %v", err)
+			}
+			return
+		}
+
+		// Only the wait for the upstream's headers is bounded by the upstream
+		// timeout. The body is then copied for as long as the request lasts.
+		ctx, cancel := context.WithCancel(ah.withPropagatedHeaders(r))
+		defer cancel()
+		upstreamTimeout := ah.upstreamTimeout(r)
+		headerTimer := time.AfterFunc(upstreamTimeout, cancel)
+
+		upstreamURL := withQuery(ah.override.target(r, ah.apiURL), opts.upstream)
+		resp, err := ah.openRaw(ctx, upstreamURL)
+		if !headerTimer.Stop() {
+			if err == nil {
+				resp.Body.Close()
+			}
+			err = fmt.Errorf("no upstream response within %s: %w", upstreamTimeout, context.DeadlineExceeded)
+		}
+		switch {
+		case errors.Is(err, apierror.ErrUpstreamAuth):
+			ah.logger.Printf("ERROR: upstream authentication failed, check the GitHub token: %v", err)
+			http.Error(rw, "upstream authentication failed", http.StatusInternalServerError)
+			return
+		case err != nil:
+			ah.logger.Printf("ERROR: raw response-time=%s: %v", time.Since(start), err)
+			code := upstreamErrorStatus(err)
+			http.Error(rw, http.StatusText(code), code)
+			return
+		}
+		defer resp.Body.Close()
+
+		ah.rawHeaders.copy(rw.Header(), resp.Header)
+		rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		rw.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(newFlushWriter(rw), resp.Body); err != nil {
+			ah.logger.Printf("ERROR: raw response-time=%s: %v", time.Since(start), err)
+			return
+		}
+		ah.logger.Printf("INFO: raw response-time=%s", time.Since(start))
+	}
+}
+
+// openRaw requests url from the upstream, returning the response if it was
+// successful. The caller must close its body.
+func (ah *ApiRequestHandler) openRaw(ctx context.Context, url string) (*http.Response, error) {
+	req, err := ah.newUpstreamRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ah.doUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &apierror.UpstreamStatusError{Code: resp.StatusCode}
+	}
+	ah.upstreamVersion.observe(resp.Header)
+
+	return resp, nil
+}
+
+// flushWriter flushes its response after every write, so that each chunk read
+// from the upstream reaches the client as soon as it arrives.
+type flushWriter struct {
+	rw http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// newFlushWriter sends the header already written to rw, then returns a
+// writer flushing each write to it.
+func newFlushWriter(rw http.ResponseWriter) *flushWriter {
+	rc := http.NewResponseController(rw)
+	_ = rc.Flush()
+
+	return &flushWriter{rw: rw, rc: rc}
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.rw.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	// Writers that can't flush still pass the body through, just buffered.
+	if err := w.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,96 @@
+package webserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRawPassesBodyThroughUnchanged(t *testing.T) {
+	// Not valid JSON, so anything that decoded the body would fail on it.
+	payload := []byte("{\"b\": 1,  \"a\":\t[ ]}\n\x00\xff trailing é")
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/vnd.github+json")
+		rw.Write(payload)
+	})
+	_, url := newTestServer(t, upstream, nil)
+
+	resp, body := get(t, url+"/raw")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if !bytes.Equal([]byte(body), payload) {
+		t.Errorf("body = %q, want %q", body, payload)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.github+json" {
+		t.Errorf("Content-Type = %q, want the upstream's", ct)
+	}
+}
+
+func TestRawStreamsPastUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "first,")
+		rw.(http.Flusher).Flush()
+		<-release
+		io.WriteString(rw, "second")
+	})
+	_, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.UpstreamTimeout = 50 * time.Millisecond
+		cfg.RequestTimeout = 5 * time.Second
+	})
+
+	resp, err := http.Get(url + "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first chunk must reach the client while the upstream is still
+	// sending, rather than once the whole body has been buffered.
+	first := make([]byte, len("first,"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("first chunk not streamed before the upstream finished")
+	}
+
+	// Finish well past the upstream timeout, which only bounds the headers.
+	time.Sleep(150 * time.Millisecond)
+	close(release)
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(first) + string(rest); got != "first,second" {
+		t.Errorf("body = %q, want the whole upstream body", got)
+	}
+}
+
+func TestRawUpstreamHeaderTimeout(t *testing.T) {
+	_, url := newTestServer(t, http.HandlerFunc(hangingUpstream), func(cfg *Config) {
+		cfg.UpstreamTimeout = 50 * time.Millisecond
+		cfg.RequestTimeout = 5 * time.Second
+	})
+
+	start := time.Now()
+	resp, body := get(t, url+"/raw")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusGatewayTimeout, body)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("answered after %s, want the upstream timeout to bound the header wait", elapsed)
+	}
+}
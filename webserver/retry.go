@@ -0,0 +1,155 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apierror"
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// retryPolicy decides which failed upstream attempts are retried.
+type retryPolicy struct {
+	maxRetries     int
+	timeouts       bool
+	serverErrors   bool
+	attemptTimeout time.Duration
+	backoff        time.Duration // base of the decorrelated jitter
+	backoffCap     time.Duration
+	budget         *retryBudget // nil leaves retries unbudgeted
+}
+
+func (p retryPolicy) retryable(err error) bool {
+	var statusErr *apierror.UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return p.serverErrors && statusErr.Code >= http.StatusInternalServerError
+	}
+
+	// A dropped connection is transient, so it's worth retrying whenever
+	// retries are enabled at all.
+	if errors.Is(err, apierror.ErrUpstreamTruncated) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return p.timeouts
+	}
+
+	return false
+}
+
+// nextBackoff returns the delay before the retry following one delayed by
+// prev, using decorrelated jitter: exactly the base backoff for the first
+// retry, when prev is 0, and afterwards a random delay from the base up to
+// three times prev, capped. Unlike plain exponential back-off, requests
+// failing together don't retry together.
+func (p retryPolicy) nextBackoff(prev time.Duration) time.Duration {
+	upper := prev * 3
+	if upper <= p.backoff {
+		return min(p.backoff, p.backoffCap)
+	}
+
+	return min(p.backoff+rand.N(upper-p.backoff), p.backoffCap)
+}
+
+// fetchPageWithRetry calls fetchPage, retrying failures the policy allows for
+// as long as the request context has budget left.
+func (ah *ApiRequestHandler) fetchPageWithRetry(r *http.Request) (apiresponse.Repos, string, error) {
+	ctx := r.Context()
+
+	ah.retry.budget.deposit()
+
+	var delay time.Duration
+	for attempt := 0; ; attempt++ {
+		repos, next, err := ah.fetchAttempt(r)
+		if err == nil || attempt >= ah.retry.maxRetries || !ah.retry.retryable(err) {
+			return repos, next, err
+		}
+		if !ah.retry.budget.withdraw() {
+			ah.logger.Printf("WARNING: retry budget exhausted, not retrying: %v", err)
+			return repos, next, err
+		}
+
+		delay = ah.retry.nextBackoff(delay)
+		ah.logger.Printf(
+			"WARNING: upstream attempt %d failed, retrying in %s: %v",
+			attempt+1,
+			delay,
+			err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, "", err
+		case <-ah.clock.After(delay):
+		}
+	}
+}
+
+// fetchAttempt makes a single upstream attempt, bounded by the per-attempt
+// timeout when one is configured.
+func (ah *ApiRequestHandler) fetchAttempt(r *http.Request) (apiresponse.Repos, string, error) {
+	if ah.retry.attemptTimeout <= 0 {
+		return ah.fetchHedged(r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ah.retry.attemptTimeout)
+	defer cancel()
+
+	return ah.fetchHedged(r.WithContext(ctx))
+}
+
+// retryBudgetMaxTokens bounds how many retries a retryBudget can bank, and so
+// the size of a retry burst after a quiet period.
+const retryBudgetMaxTokens = 10
+
+// retryBudget is a token bucket shared by all requests, limiting retries to
+// a fraction of the request rate so that a widespread outage can't turn into
+// a retry storm. Each request earns ratio tokens and each retry spends one.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+// newRetryBudget returns nil, an unlimited budget, unless ratio is positive.
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+
+	return &retryBudget{ratio: ratio, tokens: retryBudgetMaxTokens}
+}
+
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMaxTokens)
+	b.mu.Unlock()
+}
+
+// withdraw spends a token for a retry, reporting false if none is left.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
@@ -0,0 +1,109 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	p := retryPolicy{backoff: 100 * time.Millisecond, backoffCap: time.Second}
+
+	if d := p.nextBackoff(0); d != p.backoff {
+		t.Errorf("first retry delay = %s, want exactly the base %s", d, p.backoff)
+	}
+
+	for prev := p.backoff; prev < 2*p.backoffCap; prev *= 2 {
+		for range 100 {
+			d := p.nextBackoff(prev)
+			if d < p.backoff || d >= 3*prev || d > p.backoffCap {
+				t.Fatalf("delay after %s = %s, want within [%s, %s) and at most %s", prev, d, p.backoff, 3*prev, p.backoffCap)
+			}
+		}
+	}
+}
+
+func TestValidateRejectsZeroRetryBackoff(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = ":8080"
+	cfg.APIURL = "https://api.github.com/"
+	cfg.RetryBackoff = 0
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate without retries: %v", err)
+	}
+
+	cfg.MaxRetries = 2
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "retry backoff") {
+		t.Errorf("Validate = %v, want a zero retry backoff rejected", err)
+	}
+}
+
+// flakyResolver fails its first failures dials with a temporary DNS error, or
+// with err if set, and succeeds after that, counting every call.
+type flakyResolver struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyResolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, &net.DNSError{Err: "server misbehaving", Name: addr, IsTemporary: true}
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestRetryDNS(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		resolver  flakyResolver
+		wantCalls int
+		wantErr   bool
+	}{
+		{"no failures", flakyResolver{}, 1, false},
+		{"fails then resolves", flakyResolver{failures: 2}, 3, false},
+		{"fails past the retries", flakyResolver{failures: 5}, 3, true},
+		{"not found", flakyResolver{failures: 1, err: &net.DNSError{Err: "no such host", IsNotFound: true}}, 1, true},
+		{"not a DNS error", flakyResolver{failures: 1, err: errors.New("connection refused")}, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := retryDNS(tt.resolver.dial, 2, time.Millisecond)
+			conn, err := dial(context.Background(), "tcp", "api.github.com:443")
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.resolver.calls != tt.wantCalls {
+				t.Errorf("dialed %d times, want %d", tt.resolver.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryDNSStopsWithContext(t *testing.T) {
+	resolver := flakyResolver{failures: 5}
+	dial := retryDNS(resolver.dial, 5, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := dial(ctx, "tcp", "api.github.com:443"); err == nil {
+		t.Fatal("dial succeeded, want the DNS error once the context ends")
+	}
+	if resolver.calls != 1 {
+		t.Errorf("dialed %d times, want the back-off cut short after 1", resolver.calls)
+	}
+}
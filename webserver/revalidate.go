@@ -0,0 +1,45 @@
+package webserver
+
+import (
+	"context"
+)
+
+// revalidate refreshes the cache entry for url in the background, so that a
+// stale response can be served without the client waiting on the upstream.
+// At most one refresh per URL runs at a time.
+func (ah *ApiRequestHandler) revalidate(ctx context.Context, url string) {
+	if _, running := ah.revalidating.LoadOrStore(url, struct{}{}); running {
+		return
+	}
+
+	// The refresh outlives the request that triggered it, but keeps its
+	// values, such as the propagated trace headers.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ah.timeout)
+
+	go func() {
+		defer ah.revalidating.Delete(url)
+		defer cancel()
+
+		release, err := ah.background.acquire(ctx)
+		if err != nil {
+			ah.logger.Printf("WARNING: cache revalidation gave up waiting for a background slot: %v", err)
+			return
+		}
+		defer release()
+
+		req, err := ah.newUpstreamRequest(ctx, url)
+		if err != nil {
+			ah.logger.Printf("ERROR: cache revalidation failed: %v", err)
+			return
+		}
+
+		// Partial results aren't cached by a regular fetch either.
+		repos, fresh, err := ah.fetchRepos(req)
+		if err != nil {
+			ah.logger.Printf("WARNING: cache revalidation failed, keeping stale entry: %v", err)
+			return
+		}
+
+		ah.cacheRepos(url, repos, fresh)
+	}()
+}
@@ -0,0 +1,186 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		fmt.Fprintf(rw, `[{"name":"v%d"}]`, n)
+	})
+	clk := clock.NewFake(time.Now())
+	_, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.CacheTTL = time.Minute
+		cfg.CacheStaleWhileRevalidate = time.Minute
+	}, log.New(io.Discard, "", 0), clk)
+
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v1"`) {
+		t.Fatalf("body = %s, want the first fetch", body)
+	}
+
+	// Past the TTL the stale entry is served at once, without waiting on the
+	// refresh it triggers.
+	clk.Advance(time.Minute + time.Second)
+	resp, body := get(t, url+"/")
+	if !strings.Contains(body, `"v1"`) {
+		t.Errorf("body = %s, want the stale entry", body)
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Error("stale response has no Warning header")
+	}
+
+	waitFor(t, "the refreshed entry", func() bool {
+		_, body := get(t, url+"/")
+		return strings.Contains(body, `"v2"`)
+	})
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream called %d times, want once more for the refresh", n)
+	}
+
+	// Past the grace period as well, the request waits on a fresh fetch.
+	clk.Advance(2*time.Minute + time.Second)
+	resp, body = get(t, url+"/")
+	if !strings.Contains(body, `"v3"`) {
+		t.Errorf("body = %s, want a fresh fetch", body)
+	}
+	if resp.Header.Get("Warning") != "" {
+		t.Errorf("fresh response has Warning %q", resp.Header.Get("Warning"))
+	}
+}
+
+func TestCacheHitsSkipFullLimiter(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		fmt.Fprintf(rw, `[{"name":"v%d"}]`, n)
+	})
+	clk := clock.NewFake(time.Now())
+	srv, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 2
+		cfg.CacheTTL = time.Minute
+		cfg.CacheStaleWhileRevalidate = time.Minute
+		cfg.RequestTimeout = 500 * time.Millisecond
+		cfg.UpstreamTimeout = 500 * time.Millisecond
+	}, log.New(io.Discard, "", 0), clk)
+
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v1"`) {
+		t.Fatalf("body = %s, want the first fetch", body)
+	}
+
+	// Hold both of the limiter's slots, so that anything queueing for one
+	// times out.
+	for range 2 {
+		if _, err := srv.limiter.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.limiter.release()
+	}
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"v1"`) {
+		t.Errorf("fresh hit = %d %s, want the cached entry", resp.StatusCode, body)
+	}
+
+	clk.Advance(time.Minute + time.Second)
+	resp, body = get(t, url+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"v1"`) {
+		t.Errorf("stale hit = %d %s, want the stale entry", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Error("stale response has no Warning header")
+	}
+}
+
+func TestWarmupGateOpensOnceWarmed(t *testing.T) {
+	var up atomic.Bool
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(rw, `[{"name":"a"}]`)
+	})
+	clk := clock.NewFake(time.Now())
+	_, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.CacheTTL = time.Hour
+		cfg.CacheWarmInterval = time.Minute
+		cfg.WarmupGate = true
+		cfg.MaxRetries = 0
+	}, log.New(io.Discard, "", 0), clk)
+
+	// The first refresh fails, leaving the warmer waiting on the clock.
+	clk.BlockUntil(1)
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d before warming: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+
+	up.Store(true)
+	clk.Advance(time.Minute)
+	waitFor(t, "the warmup gate to open", func() bool {
+		resp, _ := get(t, url+"/")
+		return resp.StatusCode == http.StatusOK
+	})
+}
+
+func TestCacheFlush(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		fmt.Fprintf(rw, `[{"name":"v%d"}]`, n)
+	})
+	_, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.CacheTTL = time.Hour
+		cfg.AdminAPIKeys = []string{"admin-key"}
+	})
+
+	get(t, url+"/")
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v1"`) {
+		t.Fatalf("body = %s, want the cached first fetch", body)
+	}
+
+	flush := func(header ...string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, url+"/admin/cache/flush", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := flush(); code != http.StatusUnauthorized {
+		t.Errorf("flush without a key = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v1"`) {
+		t.Errorf("body = %s, want the cache kept after an unauthorised flush", body)
+	}
+
+	if code := flush("X-API-Key", "admin-key"); code != http.StatusNoContent {
+		t.Fatalf("flush = %d, want %d", code, http.StatusNoContent)
+	}
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v2"`) {
+		t.Errorf("body = %s, want a fresh upstream fetch after the flush", body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,124 @@
+package webserver
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// routeTable records the routes registered on its muxes, since ServeMux
+// doesn't expose its patterns. When latency is set, each route's handler is
+// instrumented under its pattern.
+type routeTable struct {
+	routes  []route
+	latency *routeLatencies
+}
+
+// mux returns a new ServeMux whose registrations are recorded in t.
+func (t *routeTable) mux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux(), table: t}
+}
+
+func (t *routeTable) record(pattern string) {
+	method, path := splitPattern(pattern)
+	t.routes = append(t.routes, route{Method: method, Path: path})
+}
+
+// has reports whether a route with path has been recorded.
+func (t *routeTable) has(path string) bool {
+	return slices.ContainsFunc(t.routes, func(r route) bool { return r.Path == path })
+}
+
+// splitPattern splits a ServeMux pattern into its method, "*" if it has
+// none, and path. An exact-match "{$}" suffix is dropped, so "/{$}" is "/".
+func splitPattern(pattern string) (method, path string) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "*", pattern
+	}
+
+	return method, strings.TrimSuffix(strings.TrimSpace(path), "{$}")
+}
+
+// upstreamTimeout returns the upstream timeout for the route r was routed to,
+// which defaults to the adaptive one if enabled, or else the global one.
+func (ah *ApiRequestHandler) upstreamTimeout(r *http.Request) time.Duration {
+	_, path := splitPattern(r.Pattern)
+	if d, ok := ah.routeTimeouts[path]; ok {
+		return d
+	}
+	if ah.adaptive != nil {
+		return ah.adaptive.timeout()
+	}
+
+	return ah.timeout
+}
+
+// ParseRouteTimeouts parses a comma-separated list of path=duration pairs,
+// such as "/=10s,/summary=30s".
+func ParseRouteTimeouts(v string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, pair := range strings.Split(v, ",") {
+		path, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid route timeout %q, must be path=duration", pair)
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route timeout %q: %w", pair, err)
+		}
+		timeouts[path] = d
+	}
+
+	return timeouts, nil
+}
+
+// handler lists the recorded routes, sorted by path.
+func (t *routeTable) handler(logger *log.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		routes := slices.SortedFunc(slices.Values(t.routes), func(a, b route) int {
+			return cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.Method, b.Method))
+		})
+
+		if err := writeJSON(rw, http.StatusOK, routes); err != nil {
+			logger.Printf("io error writing response: %v", err)
+		}
+	}
+}
+
+// notFound answers requests matching no route with a JSON 404.
+func notFound(logger *log.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		body := errorResponse{Error: "not_found", Message: fmt.Sprintf("no route for %s", r.URL.Path)}
+		if err := writeJSON(rw, http.StatusNotFound, body); err != nil {
+			logger.Printf("io error writing response: %v", err)
+		}
+	}
+}
+
+type routeMux struct {
+	*http.ServeMux
+	table *routeTable
+}
+
+func (m *routeMux) Handle(pattern string, handler http.Handler) {
+	if m.table.latency != nil {
+		handler = m.table.latency.instrument(pattern, handler)
+	}
+	m.ServeMux.Handle(pattern, handler)
+	m.table.record(pattern)
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
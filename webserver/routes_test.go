@@ -0,0 +1,117 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotFoundOutsideLimiter(t *testing.T) {
+	srv, url := newTestServer(t, http.HandlerFunc(hangingUpstream), func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 1
+		cfg.RateLimitCountQueued = true
+	})
+
+	// Hold the limiter's only slot with a request the upstream never answers.
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.DefaultClient.Do(req)
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.limiter.total() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request never reached the limiter")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, body := get(t, url+"/nonexistent")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusNotFound, body)
+	}
+	if !strings.Contains(body, `"not_found"`) {
+		t.Errorf("body = %s, want the JSON not found error", body)
+	}
+}
+
+func TestAPIRouteWrongMethod(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[]`), nil)
+
+	req, err := http.NewRequest(http.MethodPost, url+"/summary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRoutesListsRegisteredRoutes(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.AdminAPIKeys = []string{"key"}
+		cfg.CacheTTL = time.Minute
+		cfg.StatsInterval = time.Minute
+	})
+
+	resp, body := get(t, url+"/routes")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	var routes []route
+	if err := json.Unmarshal([]byte(body), &routes); err != nil {
+		t.Fatalf("invalid /routes body %s: %v", body, err)
+	}
+
+	want := []route{
+		{"*", "/"},
+		{"POST", "/admin/cache/flush"},
+		{"GET", "/favicon.ico"},
+		{"*", "/healthz"},
+		{"GET", "/raw"},
+		{"GET", "/readyz"},
+		{"GET", "/robots.txt"},
+		{"GET", "/routes"},
+		{"*", "/stats"},
+		{"GET", "/summary"},
+		{"GET", "/whoami"},
+	}
+	if !slices.Equal(routes, want) {
+		t.Errorf("routes = %v, want %v", routes, want)
+	}
+
+	// Each listed route is served by the router rather than the 404 handler.
+	for _, r := range routes {
+		method := r.Method
+		if method == "*" {
+			method = http.MethodGet
+		}
+		req, err := http.NewRequest(method, url+r.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed || strings.Contains(string(b), `"not_found"`) {
+			t.Errorf("%s %s: status = %d, want the listed route to be served: %s", method, r.Path, resp.StatusCode, b)
+		}
+	}
+}
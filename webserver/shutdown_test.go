@@ -0,0 +1,185 @@
+package webserver
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSecondSignalForcesExit(t *testing.T) {
+	srv, _ := newTestServer(t, reposUpstream(`[]`), nil)
+	exited := make(chan int, 1)
+	srv.exit = func(code int) { exited <- code }
+
+	quit := make(chan os.Signal, 1)
+	done := make(chan bool)
+	// The drain delay keeps the shutdown going while the second signal
+	// arrives.
+	go gracefullShutdown(srv, time.Second, log.New(io.Discard, "", 0), quit, done)
+
+	quit <- syscall.SIGTERM
+	waitFor(t, "draining to begin", srv.draining.Load)
+	select {
+	case code := <-exited:
+		t.Fatalf("exited with %d on the first signal", code)
+	default:
+	}
+
+	quit <- syscall.SIGINT
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("exit code = %d, want 1", code)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("second signal didn't force an exit")
+	}
+
+	<-done
+}
+
+func TestShutdownSignals(t *testing.T) {
+	for _, tt := range []struct {
+		configured string
+		sent       syscall.Signal
+		wantShut   bool
+	}{
+		{"SIGINT,SIGTERM", syscall.SIGTERM, true},
+		{"SIGINT,SIGTERM", syscall.SIGQUIT, false},
+		{"term,quit", syscall.SIGQUIT, true},
+	} {
+		t.Run(tt.configured+"/"+tt.sent.String(), func(t *testing.T) {
+			sigs, err := ParseShutdownSignals(tt.configured)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Catch every signal sent, so an unregistered one can't end the
+			// test process.
+			sink := make(chan os.Signal, 1)
+			signal.Notify(sink, tt.sent)
+			defer signal.Stop(sink)
+
+			srv, _ := newTestServer(t, reposUpstream(`[]`), nil)
+			srv.exit = func(int) { t.Error("forced exit") }
+			quit := make(chan os.Signal, 1)
+			signal.Notify(quit, sigs...)
+			defer signal.Stop(quit)
+			done := make(chan bool)
+			go gracefullShutdown(srv, 0, log.New(io.Discard, "", 0), quit, done)
+
+			if err := syscall.Kill(os.Getpid(), tt.sent); err != nil {
+				t.Fatal(err)
+			}
+			<-sink
+
+			select {
+			case <-done:
+				if !tt.wantShut {
+					t.Fatalf("%s shut the server down", tt.sent)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantShut {
+					t.Fatalf("%s didn't shut the server down", tt.sent)
+				}
+				if srv.draining.Load() {
+					t.Errorf("%s started draining", tt.sent)
+				}
+				// End the shutdown goroutine.
+				quit <- syscall.SIGTERM
+				<-done
+			}
+		})
+	}
+
+	if _, err := ParseShutdownSignals("SIGINT,SIGKILL"); err == nil {
+		t.Error("SIGKILL accepted as a shutdown signal")
+	}
+}
+
+func TestShutdownWebhook(t *testing.T) {
+	type notification struct {
+		event    string
+		draining bool
+	}
+	received := make(chan notification, 1)
+	var srv *webserver
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Event string }
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		received <- notification{body.Event, srv.draining.Load()}
+	}))
+	defer hook.Close()
+
+	srv, _ = newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.ShutdownWebhookURL = hook.URL
+	})
+	var logs lockedBuffer
+	quit := make(chan os.Signal, 1)
+	done := make(chan bool)
+	go gracefullShutdown(srv, 0, log.New(&logs, "", 0), quit, done)
+	quit <- syscall.SIGTERM
+
+	select {
+	case n := <-received:
+		if n.event != "shutdown" {
+			t.Errorf("event = %q, want shutdown", n.event)
+		}
+		if n.draining {
+			t.Error("webhook notified after draining began")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("webhook not notified")
+	}
+	<-done
+	if !strings.Contains(logs.String(), "INFO: shutdown webhook notified") {
+		t.Errorf("logs = %q, want the notification logged", logs.String())
+	}
+}
+
+func TestShutdownWebhookFailureDoesNotBlock(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	for name, webhookURL := range map[string]string{
+		"error status": failing.URL,
+		"unreachable":  unreachable.URL,
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, _ := newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+				cfg.ShutdownWebhookURL = webhookURL
+			})
+			var logs lockedBuffer
+			quit := make(chan os.Signal, 1)
+			done := make(chan bool)
+			go gracefullShutdown(srv, 0, log.New(&logs, "", 0), quit, done)
+			quit <- syscall.SIGTERM
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("shutdown blocked on the failed webhook")
+			}
+			if !strings.Contains(logs.String(), "ERROR: shutdown webhook failed") {
+				t.Errorf("logs = %q, want the failure logged", logs.String())
+			}
+		})
+	}
+}
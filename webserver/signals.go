@@ -0,0 +1,38 @@
+package webserver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// DefaultShutdownSignals trigger a graceful shutdown unless overridden.
+var DefaultShutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+var shutdownSignalNames = map[string]os.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// ParseShutdownSignals parses a comma-separated list of signal names such as
+// "SIGINT,SIGTERM,SIGQUIT". The SIG prefix is optional.
+func ParseShutdownSignals(names string) ([]os.Signal, error) {
+	var sigs []os.Signal
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+
+		sig, ok := shutdownSignalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported shutdown signal %q", name)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	return sigs, nil
+}
@@ -0,0 +1,26 @@
+package webserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type serverStats struct {
+	UpstreamConnections connStatsSnapshot `json:"upstream_connections"`
+	RateLimiter         limiterStats      `json:"rate_limiter"`
+}
+
+func statsHandler(logger *log.Logger, conns *connStats, limiter *RateLimiter) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		stats := serverStats{
+			UpstreamConnections: conns.snapshot(),
+			RateLimiter:         limiter.stats(),
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(stats); err != nil {
+			logger.Printf("io error writing response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apierror"
+	"github.com/tcuthbert/apiserver/apiresponse"
+)
+
+// summaryHandler serves aggregate statistics over the repos, honouring the
+// same filters and passthrough parameters as the listing.
+func (ah *ApiRequestHandler) summaryHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		opts, paramErrs := ah.query.parse(r.URL.Query())
+		if len(paramErrs) > 0 {
+			ah.logger.Printf("ERROR: bad request: %v", paramErrs)
+			body := map[string]paramErrors{"errors": paramErrs}
+			if err := writeJSON(rw, http.StatusBadRequest, body); err != nil {
+				ah.logger.Printf("io error writing response: %v", err)
+			}
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ah.withPropagatedHeaders(r), ah.upstreamTimeout(r))
+		defer cancel()
+
+		upstreamURL := withQuery(ah.override.target(r, ah.apiURL), opts.upstream)
+		repos, fetchedAt, err := ah.loadRepos(ctx, upstreamURL)
+		switch {
+		case errors.Is(err, apierror.ErrUpstreamAuth):
+			ah.logger.Printf("ERROR: upstream authentication failed, check the GitHub token: %v", err)
+			http.Error(rw, "upstream authentication failed", http.StatusInternalServerError)
+			return
+		case errors.Is(err, context.DeadlineExceeded):
+			ah.logger.Printf("ERROR: summary response-time=%s: %v", time.Since(start), err)
+			http.Error(rw, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			ah.logger.Printf("ERROR: summary response-time=%s: %v", time.Since(start), err)
+			code := upstreamErrorStatus(err)
+			http.Error(rw, http.StatusText(code), code)
+			return
+		}
+
+		if len(opts.filters) > 0 {
+			repos = repos.Filter(opts.filters...)
+		}
+
+		setFetchedAt(rw.Header(), fetchedAt)
+		ah.exposeAPIVersion(rw.Header())
+		if err := writeJSON(rw, http.StatusOK, repos.Summarize()); err != nil {
+			ah.logger.Printf("io error writing response: %v", err)
+			return
+		}
+		ah.logger.Printf("INFO: summary response-time=%s", time.Since(start))
+	}
+}
+
+// loadRepos returns the complete repos list for url and the time it was
+// fetched, from the cache when possible and otherwise from the upstream,
+// caching the result.
+func (ah *ApiRequestHandler) loadRepos(ctx context.Context, url string) (apiresponse.Repos, time.Time, error) {
+	if ah.cache != nil {
+		if entry, ok := ah.cache.Get(url); ok {
+			return entry.Value, entry.FetchedAt, nil
+		}
+	}
+
+	req, err := ah.newUpstreamRequest(ctx, url)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Partial results would skew the totals, so any failure is an error here.
+	repos, fresh, err := ah.fetchRepos(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if ah.cache != nil {
+		ah.cacheRepos(url, repos, fresh)
+	}
+
+	return repos, ah.clock.Now(), nil
+}
@@ -0,0 +1,69 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// DefaultTLSCipherSuites are the TLS 1.2 suites offered unless configured
+// otherwise: forward secret AEAD suites only. TLS 1.3 suites aren't
+// configurable and are always enabled.
+var DefaultTLSCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a minimum TLS version, "1.2" or "1.3".
+func ParseTLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimSpace(v)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, must be 1.2 or 1.3", v)
+	}
+
+	return version, nil
+}
+
+// ParseTLSCipherSuites parses a comma-separated list of cipher suite names as
+// spelled by crypto/tls, such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Suites crypto/tls considers insecure are rejected.
+func ParseTLSCipherSuites(names string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// serverTLSConfig returns the TLS policy for serving, or nil when TLS isn't
+// enabled.
+func serverTLSConfig(cfg *Config) *tls.Config {
+	if cfg.TLSCertFile == "" {
+		return nil
+	}
+
+	return &tls.Config{
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCipherSuites,
+	}
+}
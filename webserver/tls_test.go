@@ -0,0 +1,89 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{" 1.3 ", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"1.0", 0, true},
+		{"TLS1.2", 0, true},
+		{"", 0, true},
+	} {
+		got, err := ParseTLSVersion(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTLSVersion(%q) = %#x, %v, want %#x, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseTLSCipherSuites(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    []uint16
+		wantErr bool
+	}{
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, false},
+		{
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+			false,
+		},
+		{"TLS_RSA_WITH_RC4_128_SHA", nil, true}, // insecure
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,NOT_A_SUITE", nil, true},
+		{"", nil, true},
+	} {
+		got, err := ParseTLSCipherSuites(tt.in)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseTLSCipherSuites(%q) = %#x, %v, want %#x, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTLSMinVersionEnforced(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		min       uint16
+		clientMax uint16
+		wantOK    bool
+	}{
+		{"TLS 1.1 client to 1.2 minimum", tls.VersionTLS12, tls.VersionTLS11, false},
+		{"TLS 1.2 client to 1.2 minimum", tls.VersionTLS12, tls.VersionTLS12, true},
+		{"TLS 1.2 client to 1.3 minimum", tls.VersionTLS13, tls.VersionTLS12, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.TLSCertFile = "cert.pem" // only enables the policy, httptest supplies the certificate
+			cfg.TLSMinVersion = tt.min
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+			ts.TLS = serverTLSConfig(&cfg)
+			ts.StartTLS()
+			defer ts.Close()
+
+			client := ts.Client()
+			transport := client.Transport.(*http.Transport)
+			transport.TLSClientConfig.MinVersion = tls.VersionTLS10
+			transport.TLSClientConfig.MaxVersion = tt.clientMax
+
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if ok := err == nil; ok != tt.wantOK {
+				t.Errorf("handshake succeeded = %t, want %t: %v", ok, tt.wantOK, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+)
+
+// traceHeaders carry W3C trace context (https://www.w3.org/TR/trace-context/).
+var traceHeaders = []string{"Traceparent", "Tracestate"}
+
+type propagatedHeadersKey struct{}
+
+// withPropagatedHeaders returns r's context carrying the incoming trace
+// context and correlation header, for newUpstreamRequest to copy onto every
+// upstream request made on r's behalf, including later pages and hedges.
+func (ah *ApiRequestHandler) withPropagatedHeaders(r *http.Request) context.Context {
+	var names []string
+	if ah.propagateTrace {
+		names = append(names, traceHeaders...)
+	}
+	if ah.correlationHeader != "" {
+		names = append(names, ah.correlationHeader)
+	}
+
+	h := make(http.Header)
+	for _, name := range names {
+		if v := r.Header.Values(name); len(v) > 0 {
+			h[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if len(h) == 0 {
+		return r.Context()
+	}
+
+	return context.WithValue(r.Context(), propagatedHeadersKey{}, h)
+}
+
+func propagatedHeaders(ctx context.Context) http.Header {
+	h, _ := ctx.Value(propagatedHeadersKey{}).(http.Header)
+	return h
+}
@@ -0,0 +1,210 @@
+package webserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// connStats counts the upstream connections dialed and closed by the
+// transport, giving visibility into connection pool churn.
+type connStats struct {
+	opened atomic.Int64
+	closed atomic.Int64
+}
+
+type connStatsSnapshot struct {
+	Opened int64 `json:"opened"`
+	Closed int64 `json:"closed"`
+	Open   int64 `json:"open"`
+}
+
+func (cs *connStats) snapshot() connStatsSnapshot {
+	closed := cs.closed.Load()
+	opened := cs.opened.Load()
+
+	return connStatsSnapshot{Opened: opened, Closed: closed, Open: opened - closed}
+}
+
+type countedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.stats.closed.Add(1) })
+	return c.Conn.Close()
+}
+
+func newUpstreamClient(cfg *Config, stats *connStats) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Honour HTTP_PROXY/HTTPS_PROXY/NO_PROXY unless a proxy is given explicitly.
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(cfg.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := upstreamTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	dial := retryDNS(dialer.DialContext, cfg.DNSRetries, cfg.DNSRetryBackoff)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		stats.opened.Add(1)
+
+		return &countedConn{Conn: conn, stats: stats}, nil
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// retryDNS retries dials failing on a temporary DNS error up to retries
+// times, doubling backoff between attempts, for as long as ctx allows. This
+// is separate from request retries: resolvers in freshly started containers
+// often fail briefly, and no request reached the upstream.
+func retryDNS(dial dialFunc, retries int, backoff time.Duration) dialFunc {
+	if retries <= 0 {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for attempt := 0; ; attempt++ {
+			conn, err := dial(ctx, network, addr)
+
+			var dnsErr *net.DNSError
+			if err == nil || attempt >= retries || !errors.As(err, &dnsErr) || !(dnsErr.IsTemporary || dnsErr.IsTimeout) {
+				return conn, err
+			}
+
+			timer := time.NewTimer(backoff << attempt)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+func upstreamTLSConfig(cfg *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.UpstreamInsecureSkipVerify, //nolint:gosec // opt-in for development.
+	}
+
+	if cfg.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(cfg.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s", cfg.UpstreamCAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	return tlsConfig, nil
+}
+
+// keepUpstreamWarm sends a HEAD request to the root of the upstream host every
+// interval, so that a warm connection stays pooled through quiet periods and
+// the next request doesn't pay for connection setup. The pings carry no
+// credentials. A ping is skipped if bg has no room for it, as busy client
+// traffic keeps a connection warm anyway. It stops once shutdown is closed or
+// ctx is cancelled.
+func keepUpstreamWarm(
+	ctx context.Context,
+	shutdown <-chan struct{},
+	client *http.Client,
+	bg *backgroundLimiter,
+	apiURL string,
+	interval time.Duration,
+	logger *log.Logger,
+	clk clock.Clock,
+) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return
+	}
+	target := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-shutdown:
+			return
+		case <-clk.After(interval):
+		}
+
+		release, ok := bg.tryAcquire()
+		if !ok {
+			continue
+		}
+		err := pingUpstream(ctx, client, target, interval)
+		release()
+		if err != nil {
+			logger.Printf("WARNING: upstream keep-alive ping failed: %v", err)
+		}
+	}
+}
+
+func pingUpstream(ctx context.Context, client *http.Client, target string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// reapIdleConnections periodically closes idle upstream connections so stale
+// ones aren't reused after being silently dropped by a NAT or load balancer.
+func reapIdleConnections(ctx context.Context, client *http.Client, interval time.Duration, clk clock.Clock) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+			client.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package webserver
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/tcuthbert/apiserver/middleware"
+)
+
+// warmCache keeps the response cache populated by refreshing it every interval
+// until ctx is cancelled. warmed is set once the first refresh succeeds.
+func (ah *ApiRequestHandler) warmCache(
+	ctx context.Context,
+	interval time.Duration,
+	warmed *atomic.Bool,
+) {
+	for {
+		if err := ah.refreshCache(ctx); err != nil {
+			ah.logger.Printf("ERROR: cache warm failed: %v", err)
+		} else if !warmed.Swap(true) {
+			ah.logger.Println("INFO: cache warmed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ah.clock.After(interval):
+		}
+	}
+}
+
+func (ah *ApiRequestHandler) refreshCache(ctx context.Context) error {
+	release, err := ah.background.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, ah.timeout)
+	defer cancel()
+
+	req, err := ah.newUpstreamRequest(ctx, ah.apiURL)
+	if err != nil {
+		return err
+	}
+
+	repos, fresh, err := ah.fetchRepos(req)
+	if err != nil {
+		return err
+	}
+
+	ah.cacheRepos(ah.apiURL, repos, fresh)
+
+	return nil
+}
+
+// warmupGate answers 503 with a Retry-After header until warmed is set, so
+// clients don't pay for a cold upstream fetch during startup.
+func warmupGate(warmed *atomic.Bool) middleware.Middleware {
+	return middleware.Unavailable(func() bool { return !warmed.Load() }, WarmupRetryAfter)
+}
@@ -1,45 +1,145 @@
 package webserver
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/tcuthbert/apiserver/apierror"
 	"github.com/tcuthbert/apiserver/apiresponse"
+	"github.com/tcuthbert/apiserver/cache"
+	"github.com/tcuthbert/apiserver/clock"
+	"github.com/tcuthbert/apiserver/middleware"
 )
 
 var (
-	MaxActiveAPIRequests = 3
+	// MaxActiveAPIRequests scales with the available CPUs, but never drops
+	// below the historical default of 3. See BenchmarkHandler.
+	MaxActiveAPIRequests = max(3, runtime.GOMAXPROCS(0))
 
-	MaxAPIResponseTimeout = 60 * time.Second
+	MaxRequestTimeout     = 60 * time.Second
+	MaxAPIResponseTimeout = 50 * time.Second
 	MaxReadTimeout        = 15 * time.Second
 	MaxWriteTimeout       = 30 * time.Second
 	MaxIdleTimeout        = 120 * time.Second
+
+	// MaxPresizedBodyBytes caps the buffer pre-allocated from an upstream
+	// Content-Length, so a bogus header can't force a huge allocation.
+	MaxPresizedBodyBytes int64 = 32 << 20
+
+	// WarmupRetryAfter is advertised to clients turned away by the warmup gate.
+	WarmupRetryAfter = 5 * time.Second
+
+	// MaintenanceRetryAfter is advertised to clients turned away while the
+	// server is in maintenance mode.
+	MaintenanceRetryAfter = 5 * time.Minute
+
+	// DefaultRobotsTxt asks crawlers to stay away from the whole API.
+	DefaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+	// ReadinessCheckTimeout bounds each of the checks behind /readyz.
+	ReadinessCheckTimeout = 5 * time.Second
+
+	// UpstreamCheckInterval is how long /readyz reuses the result of its
+	// last upstream check.
+	UpstreamCheckInterval = 10 * time.Second
 )
 
-func Start(listenAddr *string, apiURL string) error {
-	logger := log.New(os.Stdout, "webserver: ", log.LstdFlags)
+// openLogOutput returns stdout, or path opened for appending if set, along
+// with a func that closes it.
+func openLogOutput(path string) (io.Writer, func() error, error) {
+	if path == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open log file: %w", err)
+	}
+
+	return f, f.Close, nil
+}
+
+// Start serves the API as configured by cfg until a shutdown signal arrives.
+// cfg is taken by value, so the caller's copy (typically bound to flags) is
+// never shared with the running server.
+func Start(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	out, closeLog, err := openLogOutput(cfg.LogFile)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	logger := log.New(out, "webserver: ", log.LstdFlags)
 
 	done := make(chan bool, 1)
 	quit := make(chan os.Signal, 1)
 
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, cfg.ShutdownSignals...)
 
-	server := newWebserver(listenAddr, apiURL, logger)
-	go gracefullShutdown(server, logger, quit, done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	logger.Printf("Server is ready to handle requests at: %s", *listenAddr)
+	server, err := newWebserver(ctx, &cfg, logger, clock.Real{})
+	if err != nil {
+		return err
+	}
+	defer server.audit.close()
 
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("could not listen on %s: %w", *listenAddr, err)
+	if cfg.RequireUpstreamOnStart {
+		if err := server.api.checkUpstream(ctx); err != nil {
+			return fmt.Errorf("upstream check failed: %w", err)
+		}
+		logger.Println("INFO: upstream check passed")
+	}
+
+	go gracefullShutdown(server, cfg.DrainDelay, logger, quit, done)
+
+	if cfg.MaxActiveAPIRequestsFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go resizeOnSignal(ctx, server.limiter, cfg.MaxActiveAPIRequestsFile, logger, hup)
+	}
+
+	ln, err := listen(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", cfg.ListenAddr, err)
+	}
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go toggleMaintenanceOnSignal(ctx, server.maintenance, logger, server.audit, usr1)
+
+	logger.Printf("Server is ready to handle requests at: %s", cfg.ListenAddr)
+
+	if cfg.TLSCertFile != "" {
+		err = server.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("could not serve on %s: %w", cfg.ListenAddr, err)
 	}
 
 	<-done
@@ -49,13 +149,29 @@ func Start(listenAddr *string, apiURL string) error {
 }
 
 func gracefullShutdown(
-	server *http.Server,
+	server *webserver,
+	drainDelay time.Duration,
 	logger *log.Logger,
 	quit <-chan os.Signal,
 	done chan<- bool,
 ) {
 	<-quit
 	logger.Println("Server is shutting down...")
+	go forceExitOnSignal(logger, quit, server.exit)
+
+	if server.webhookURL != "" {
+		notifyShutdown(logger, server.webhookURL)
+	}
+
+	// Turn new requests away while in-flight ones finish, giving load
+	// balancers drainDelay to notice before the listener closes. Requests
+	// sleeping in a rate limiter back-off are released straight away.
+	server.draining.Store(true)
+	close(server.shutdown)
+	if drainDelay > 0 {
+		logger.Printf("Draining for %s", drainDelay)
+		time.Sleep(drainDelay)
+	}
 
 	shutDownTime := 30 * time.Second
 
@@ -71,94 +187,707 @@ func gracefullShutdown(
 	close(done)
 }
 
-type RateLimiter struct {
-	handler http.Handler
-	logger  *log.Logger
-	sem     chan (struct{})
-}
+// shutdownWebhookTimeout bounds the shutdown notification, which mustn't hold
+// up the shutdown itself.
+const shutdownWebhookTimeout = 5 * time.Second
 
-func NewRateLimitHandler(handler http.Handler, logger *log.Logger, size int) *RateLimiter {
-	return &RateLimiter{logger: logger, handler: handler, sem: make(chan struct{}, size)}
-}
+// notifyShutdown POSTs a shutdown event to webhookURL. Failures are only
+// logged, and never include the URL, which may hold a secret.
+func notifyShutdown(logger *log.Logger, webhookURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWebhookTimeout)
+	defer cancel()
 
-func (rl *RateLimiter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	if !rl.acquire() { // too many in-flight requests detected.
-		delay := max(1, rand.IntN(5)) // minimum 1s back-off delay.
-		rl.logger.Printf(
-			"WARNING: %ds back-off delay triggered: active-requests=%d max-request=%d",
-			delay,
-			rl.total(),
-			rl.size(),
-		)
-		time.Sleep(time.Duration(delay) * time.Second)
+	host, _ := os.Hostname()
+	body, err := json.Marshal(map[string]string{
+		"event": "shutdown",
+		"host":  host,
+		"time":  time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		logger.Printf("ERROR: shutdown webhook failed: %v", err)
+		return
 	}
-	defer rl.release()
 
-	rl.handler.ServeHTTP(rw, r)
-}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("ERROR: shutdown webhook failed: could not build request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-func (rl *RateLimiter) acquire() bool {
-	rl.sem <- struct{}{}
-	return rl.total() < rl.size()
-}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Unwrapped to drop the *url.Error naming the URL.
+		logger.Printf("ERROR: shutdown webhook failed: %v", errors.Unwrap(err))
+		return
+	}
+	defer resp.Body.Close()
 
-func (rl *RateLimiter) release() {
-	<-rl.sem
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Printf("ERROR: shutdown webhook failed: status=%d", resp.StatusCode)
+		return
+	}
+	logger.Println("INFO: shutdown webhook notified")
 }
 
-func (rl *RateLimiter) size() int {
-	return cap(rl.sem)
+// forceExitOnSignal exits straight away with exit on a second shutdown
+// signal, for an operator who would rather not wait for in-flight requests to
+// finish.
+func forceExitOnSignal(logger *log.Logger, quit <-chan os.Signal, exit func(code int)) {
+	sig := <-quit
+	logger.Printf("WARNING: received %s during shutdown, forcing exit", sig)
+	exit(1)
 }
 
-func (rl *RateLimiter) total() int {
-	return len(rl.sem)
+// timeout bounds requests to d. http.TimeoutHandler buffers the whole body
+// until the handler returns, which would defeat streaming, so streamed
+// responses get a context deadline instead. The upstream fetch is cut off at d
+// either way, but once a stream has started it runs to completion, bounded
+// only by the server's WriteTimeout, rather than being replaced by an error.
+func timeout(logger *log.Logger, d time.Duration) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		buffered := http.TimeoutHandler(next, d, http.StatusText(http.StatusRequestTimeout))
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !streamingRequested(r) {
+				// TimeoutHandler copies the buffered body out once the handler
+				// has returned, discarding any write error, so check for one
+				// here.
+				cw := &countingWriter{ResponseWriter: rw}
+				buffered.ServeHTTP(cw, r)
+				if cw.err != nil {
+					err := &downstreamWriteError{written: cw.written, err: cw.err}
+					logger.Printf(
+						"ERROR: client received a truncated response: write-timeout=%t: %v",
+						errors.Is(err, os.ErrDeadlineExceeded),
+						err,
+					)
+				}
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
 }
 
 type ApiRequestHandler struct {
-	logger *log.Logger
-	apiURL string
+	logger   *log.Logger
+	apiURL   string
+	auth     Authenticator
+	signer   Signer
+	timeout  time.Duration
+	maxPages int
+
+	// routeTimeouts override timeout for the upstream calls made by the
+	// routes at these paths.
+	routeTimeouts map[string]time.Duration
+
+	// adaptive, if set, replaces timeout with one derived from recent
+	// latencies.
+	adaptive *adaptiveTimeout
+
+	partialOK bool
+	query     queryParser
+	client    *http.Client
+	cache     *cache.Cache[apiresponse.Repos]
+
+	// honorUpstreamCache caches responses for as long as the upstream's
+	// caching headers allow, rather than the cache TTL.
+	honorUpstreamCache bool
+
+	// revalidating holds the URLs being refreshed in the background.
+	revalidating sync.Map
+	fallback     apiresponse.Repos
+
+	cacheControl  string
+	emptyAs204    bool
+	cliMode       bool
+	maxEncodeTime time.Duration // bounds transforming and encoding a response
+
+	// maxResponseBytes bounds the responses buffered by ServeHTTP, 0 leaving
+	// them unbounded.
+	maxResponseBytes int
+
+	propagateTrace    bool
+	correlationHeader string
+
+	// deprecateLegacyShape marks bare JSON responses as deprecated, with
+	// legacySunset as their Sunset date if set.
+	deprecateLegacyShape bool
+	legacySunset         time.Time
+
+	// background bounds and deprioritises upstream calls made outside of a
+	// client request.
+	background *backgroundLimiter
+
+	// upstreamCheck is the upstream check behind /readyz.
+	upstreamCheck *cachedCheck
+
+	// upstreamVersion is the API version last reported by the upstream,
+	// exposed downstream if exposeUpstreamVersion is set.
+	upstreamVersion       *upstreamVersion
+	exposeUpstreamVersion bool
+
+	// strictDecode rejects upstream pages with fields Repo doesn't have.
+	strictDecode bool
+
+	// rawHeaders selects the upstream headers /raw forwards.
+	rawHeaders *headerFilter
+
+	bodyLog  *bodyLogger
+	override *upstreamOverride
+	retry    retryPolicy
+	hedge    *hedger
+	clock    clock.Clock
 }
 
+// handleRequest fetches the repos requested by r, allowing the upstream
+// upstreamTimeout, and writes the response. Only the fetch is bounded by
+// upstreamTimeout, so that a fallback or partial response, and the
+// transformation and encoding of any response, still have until the request
+// deadline to complete.
 func (ah *ApiRequestHandler) handleRequest(
 	resultCh chan error,
 	rw http.ResponseWriter,
 	r *http.Request,
+	opts queryOptions,
+	upstreamTimeout time.Duration,
 ) {
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		resultCh <- fmt.Errorf("api client error: %w", err)
+	// This runs on its own goroutine, out of reach of the recovery middleware,
+	// so a panic must be reported back rather than crashing the process.
+	defer func() {
+		if p := recover(); p != nil {
+			resultCh <- &panicError{value: p, stack: debug.Stack()}
+		}
+	}()
+
+	fetchStart := time.Now()
+	fetchCtx, cancelFetch := context.WithTimeout(r.Context(), upstreamTimeout)
+	repos, fresh, err := ah.fetchRepos(r.WithContext(fetchCtx))
+	cancelFetch()
+	meta := responseMeta{UpstreamMillis: time.Since(fetchStart).Milliseconds()}
+	if ah.adaptive != nil {
+		if deadline, ok := fetchCtx.Deadline(); ok && errors.Is(err, context.DeadlineExceeded) {
+			ah.adaptive.observe(deadline.Sub(fetchStart))
+		} else if err == nil {
+			ah.adaptive.observe(time.Since(fetchStart))
+		}
+	}
+
+	fetchedAt := ah.clock.Now()
+
+	var partial *partialResultsError
+	switch {
+	case errors.As(err, &partial):
+		ah.logger.Printf("WARNING: serving partial results: %v", err)
+		rw.Header().Set("Warning", partial.warning())
+	case err != nil && ah.fallback != nil:
+		ah.logger.Printf("WARNING: serving fallback response: %v", err)
+		rw.Header().Set("Warning", `111 - "upstream unavailable, serving fallback response"`)
+		repos = ah.fallback
+		fetchedAt = time.Time{} // the fallback file was never fetched
+	case err != nil:
+		resultCh <- err
 		return
+	case ah.cache != nil:
+		ah.cacheRepos(r.URL.String(), repos, fresh)
+	}
+	if !fetchedAt.IsZero() {
+		setFetchedAt(rw.Header(), fetchedAt)
+	}
+
+	if err := ah.serveRepos(rw, repos, opts, meta); err != nil {
+		resultCh <- err
+		return
+	}
+
+	close(resultCh)
+}
+
+// serveRepos applies opts to repos and writes the result.
+func (ah *ApiRequestHandler) serveRepos(
+	rw http.ResponseWriter,
+	repos apiresponse.Repos,
+	opts queryOptions,
+	meta responseMeta,
+) error {
+	if ah.maxEncodeTime > 0 {
+		return ah.serveReposBounded(rw, repos, opts, meta)
+	}
+
+	repos, status := opts.apply(rw.Header(), repos)
+	if status == http.StatusRequestedRangeNotSatisfiable {
+		http.Error(rw, http.StatusText(status), status)
+		return nil
+	}
+
+	cw := &countingWriter{ResponseWriter: rw}
+	err := ah.writeRepos(cw, repos, status, opts, meta)
+	if cw.err != nil {
+		return &downstreamWriteError{written: cw.written, err: cw.err}
+	}
+
+	return err
+}
+
+// withQuery adds params to the query of rawURL, leaving it untouched when
+// there are none.
+func withQuery(rawURL string, params url.Values) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	q := u.Query()
+	for name, values := range params {
+		q[name] = values
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+func (ah *ApiRequestHandler) newUpstreamRequest(
+	ctx context.Context,
+	url string,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range propagatedHeaders(ctx) {
+		req.Header[name] = values
+	}
+
+	return req, nil
+}
+
+// doUpstream authenticates and signs r, then sends it.
+func (ah *ApiRequestHandler) doUpstream(r *http.Request) (*http.Response, error) {
+	if err := ah.auth.Apply(r.Context(), r); err != nil {
+		return nil, fmt.Errorf("%w: %w", apierror.ErrUpstreamAuth, err)
+	}
+	if ah.signer != nil {
+		if err := ah.signer.Sign(r); err != nil {
+			return nil, fmt.Errorf("failed to sign upstream request: %w", err)
+		}
+	}
+
+	resp, err := ah.client.Do(r)
+	if err != nil {
+		return nil, apierror.Unreachable(err)
+	}
+
+	return resp, nil
+}
+
+// fetchPage issues r and decodes a single page of repos, returning the URL of
+// the next page if the upstream advertised one.
+func (ah *ApiRequestHandler) fetchPage(r *http.Request) (apiresponse.Repos, string, error) {
+	resp, err := ah.doUpstream(r)
+	if err != nil {
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	b, err := io.ReadAll(resp.Body)
+	b, err := readBody(resp)
 	if err != nil {
-		resultCh <- fmt.Errorf("failed to read upstream response body: %v", err)
-		return
+		return nil, "", apierror.Decode(fmt.Errorf("failed to read body: %w", err))
+	}
+	ah.debugLogBody("upstream request="+r.URL.String(), r.Header, b)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", &apierror.UpstreamStatusError{Code: resp.StatusCode}
+	}
+	recordFreshness(r.Context(), resp.Header, ah.clock.Now())
+	ah.upstreamVersion.observe(resp.Header)
+
+	repos, err := decodeRepos(b, ah.strictDecode)
+	if err != nil {
+		return nil, "", apierror.Decode(fmt.Errorf("%w: %q", err, b))
 	}
 
+	next, err := nextPageURL(resp.Header, r.URL)
+	if err != nil {
+		return nil, "", apierror.Decode(err)
+	}
+
+	return repos, next, nil
+}
+
+// decodeRepos decodes an upstream page. Strict decoding also rejects fields
+// Repo doesn't have, so that a changed upstream payload is reported rather
+// than decoded into a partial struct.
+func decodeRepos(b []byte, strict bool) (apiresponse.Repos, error) {
+	// Decoding replaces invalid UTF-8 in strings with U+FFFD, so decoded
+	// repos are always valid UTF-8, whatever the upstream sent.
 	var repos apiresponse.Repos
-	if err := json.Unmarshal(b, &repos); err != nil {
-		resultCh <- fmt.Errorf("failed to unmarshal upstream response: %v: %q", err, b)
-		return
+	if !strict {
+		err := json.Unmarshal(b, &repos)
+		return repos, err
 	}
 
-	enc := json.NewEncoder(rw)
-	if err := enc.Encode(repos); err != nil {
-		resultCh <- fmt.Errorf("failed to encode response: %v", err)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&repos); err != nil {
+		return nil, fmt.Errorf("strict decode: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("strict decode: unexpected data after top-level value")
+	}
+
+	return repos, nil
+}
+
+// checkUpstream fetches the first upstream page, reporting whether the
+// upstream is reachable and accepts the configured credentials.
+func (ah *ApiRequestHandler) checkUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ah.timeout)
+	defer cancel()
+
+	req, err := ah.newUpstreamRequest(ctx, ah.apiURL)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = ah.fetchPageWithRetry(req)
+	return err
+}
+
+// responseMeta describes how a response was produced, for the ?envelope mode.
+type responseMeta struct {
+	Count          int   `json:"count"`
+	Cached         bool  `json:"cached"`
+	UpstreamMillis int64 `json:"upstream_ms"`
+}
+
+type envelope struct {
+	Data any `json:"data"`
+	Meta any `json:"meta"`
+}
+
+// deprecateLegacy adds the Deprecation and Sunset headers to a response in
+// the legacy bare shape, if that shape is deprecated.
+func (ah *ApiRequestHandler) deprecateLegacy(h http.Header) {
+	if !ah.deprecateLegacyShape {
 		return
 	}
 
-	close(resultCh)
+	h.Set("Deprecation", "true")
+	if !ah.legacySunset.IsZero() {
+		h.Set("Sunset", ah.legacySunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// feedAuthor names the owner of the repos listed at apiURL, the user or
+// organisation in a GitHub style /users/{name}/repos path, falling back to
+// the upstream host.
+func feedAuthor(apiURL string) string {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return apiURL
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] == "users" || segments[i] == "orgs" {
+			return segments[i+1]
+		}
+	}
+
+	return cmp.Or(u.Host, apiURL)
+}
+
+func (ah *ApiRequestHandler) writeRepos(
+	rw http.ResponseWriter,
+	repos apiresponse.Repos,
+	status int,
+	opts queryOptions,
+	meta responseMeta,
+) error {
+	if ah.cliMode {
+		// The User-Agent picks the text table for command line tools.
+		rw.Header().Set("Vary", "Accept, Accept-Encoding, User-Agent")
+	} else {
+		rw.Header().Set("Vary", "Accept, Accept-Encoding")
+	}
+	if ah.cacheControl != "" {
+		rw.Header().Set("Cache-Control", ah.cacheControl)
+	}
+	ah.exposeAPIVersion(rw.Header())
+
+	// The envelope still has metadata to report, even without repos.
+	if ah.emptyAs204 && len(repos) == 0 && !opts.envelope {
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if opts.format == formatNDJSON && !opts.reshaped() {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.WriteHeader(status)
+		if err := repos.WriteNDJSON(rw, opts.keyCase); err != nil {
+			return fmt.Errorf("failed to encode response: %v", err)
+		}
+		return nil
+	}
+
+	if opts.format == formatText && !opts.reshaped() {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		var buf bytes.Buffer
+		if err := repos.WriteTable(&buf); err != nil {
+			return fmt.Errorf("failed to encode table: %v", err)
+		}
+
+		return writeWithETag(rw, status, buf.Bytes(), opts.ifNoneMatch)
+	}
+
+	// Feeds have no grouped or enveloped form, so those options don't apply.
+	if opts.format == formatAtom {
+		rw.Header().Set("Content-Type", "application/atom+xml")
+
+		var buf bytes.Buffer
+		if err := repos.WriteAtom(&buf, ah.apiURL, "Repositories", feedAuthor(ah.apiURL)); err != nil {
+			return fmt.Errorf("failed to encode feed: %v", err)
+		}
+
+		return writeWithETag(rw, status, buf.Bytes(), opts.ifNoneMatch)
+	}
+
+	var v any
+	if opts.groupBy == "language" {
+		rw.Header().Set("Content-Type", "application/json")
+
+		// Language names are data, so only the repos within each group are
+		// recased, not the group keys.
+		groups := make(map[string]any)
+		for lang, group := range repos.GroupByLanguage() {
+			recased, err := apiresponse.Recase(group, opts.keyCase)
+			if err != nil {
+				return fmt.Errorf("failed to encode response: %v", err)
+			}
+			groups[lang] = recased
+		}
+		v = groups
+	} else {
+		recased, err := apiresponse.Recase(repos, opts.keyCase)
+		if err != nil {
+			return fmt.Errorf("failed to encode response: %v", err)
+		}
+		v = recased
+	}
+
+	if opts.jq != nil {
+		rw.Header().Set("Content-Type", "application/json")
+
+		projected, err := ah.evalJQ(opts.jq, v)
+		if err != nil {
+			rw.Header().Del("Cache-Control")
+			body := map[string]paramErrors{"errors": {{Param: "jq", Value: opts.jq.src, Message: err.Error()}}}
+			return writeJSON(rw, http.StatusBadRequest, body)
+		}
+		v = projected
+	}
+
+	if opts.envelope {
+		meta.Count = len(repos)
+		rw.Header().Set("Content-Type", "application/json")
+
+		recasedMeta, err := apiresponse.Recase(meta, opts.keyCase)
+		if err != nil {
+			return fmt.Errorf("failed to encode response: %v", err)
+		}
+		v = envelope{Data: v, Meta: recasedMeta}
+	} else {
+		ah.deprecateLegacy(rw.Header())
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return fmt.Errorf("failed to encode response: %v", err)
+	}
+
+	ah.debugLogBody("downstream", rw.Header(), buf.Bytes())
+
+	return writeWithETag(rw, status, buf.Bytes(), opts.ifNoneMatch)
+}
+
+// loadFallback reads the static response served when the upstream is down.
+func loadFallback(path string) (apiresponse.Repos, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fallback file: %w", err)
+	}
+
+	repos := apiresponse.Repos{}
+	if err := json.Unmarshal(b, &repos); err != nil {
+		return nil, fmt.Errorf("failed to parse fallback file %s: %w", path, err)
+	}
+
+	return repos, nil
+}
+
+// panicError carries a panic recovered from the upstream request goroutine.
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic handling upstream request: %v", e.value)
+}
+
+// readBody reads the upstream response body, pre-sizing the buffer from the
+// advertised Content-Length to avoid repeated reallocations on large payloads.
+// Gzip encoded bodies the transport didn't transparently decode are
+// decompressed here.
+func readBody(resp *http.Response) ([]byte, error) {
+	body, size := io.Reader(resp.Body), resp.ContentLength
+
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer zr.Close()
+
+		// The compressed length says little about the decoded size.
+		body, size = zr, -1
+	}
+
+	if size <= 0 || size > MaxPresizedBodyBytes {
+		return io.ReadAll(body)
+	}
+
+	// Reading exactly size bytes fills the buffer without growing it, where
+	// a bytes.Buffer would double itself looking for EOF once full.
+	b := make([]byte, size)
+	if _, err := io.ReadFull(body, b); err != nil {
+		return nil, err
+	}
+
+	// A body running past its Content-Length is still read in full.
+	var extra [1]byte
+	switch n, err := io.ReadFull(body, extra[:]); {
+	case n > 0:
+		rest, err := io.ReadAll(body)
+		return append(append(b, extra[:n]...), rest...), err
+	case err != io.EOF:
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// parseRequest resolves the options r asks for.
+func (ah *ApiRequestHandler) parseRequest(r *http.Request) (queryOptions, paramErrors) {
+	opts, paramErrs := ah.query.parse(r.URL.Query())
+	if len(paramErrs) > 0 {
+		return opts, paramErrs
+	}
+	opts.format = negotiateFormat(r.Header.Get("Accept"))
+	if ah.cliMode && opts.format == formatJSON && wantsText(r, opts.cli) {
+		opts.format = formatText
+	}
+	opts.ifNoneMatch = r.Header.Get("If-None-Match")
+	opts.itemRange = parseItemRange(r.Header.Get("Range"))
+
+	return opts, nil
+}
+
+// upstreamURL is the upstream URL r is fetched from. Overridden requests are
+// cached under their own upstream URL so canary responses never leak into
+// regular traffic.
+func (ah *ApiRequestHandler) upstreamURL(r *http.Request, opts queryOptions) string {
+	return withQuery(ah.override.target(r, ah.apiURL), opts.upstream)
+}
+
+// serveCached answers r from the cache, fresh or stale, reporting whether
+// there was an entry to answer it with.
+func (ah *ApiRequestHandler) serveCached(
+	rw http.ResponseWriter,
+	r *http.Request,
+	opts queryOptions,
+	upstreamURL string,
+	start time.Time,
+) bool {
+	if ah.cache == nil {
+		return false
+	}
+	entry, fresh, ok := ah.cache.GetStale(upstreamURL)
+	if !ok {
+		return false
+	}
+
+	status := "hit"
+	if !fresh {
+		status = "stale"
+		rw.Header().Set("Warning", `110 - "response is stale"`)
+		ah.revalidate(ah.withPropagatedHeaders(r), upstreamURL)
+	}
+
+	setFetchedAt(rw.Header(), entry.FetchedAt)
+	if err := ah.serveRepos(rw, entry.Value, opts, responseMeta{Cached: true}); err != nil {
+		ah.logger.Printf("ERROR: cache=%s response-time=%s: %v", status, time.Since(start), err)
+		return true
+	}
+	ah.logger.Printf("INFO: cache=%s response-time=%s", status, time.Since(start))
+
+	return true
+}
+
+// cacheHits answers API requests the cache holds an entry for before the
+// next handler, so that they never wait for a limiter slot. Anything else,
+// including invalid requests, is left to ServeHTTP.
+func (ah *ApiRequestHandler) cacheHits() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if ah.cache == nil || r.URL.Path != "/" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			start := time.Now()
+			opts, paramErrs := ah.parseRequest(r)
+			if len(paramErrs) > 0 || !ah.serveCached(rw, r, opts, ah.upstreamURL(r, opts), start) {
+				next.ServeHTTP(rw, r)
+			}
+		})
+	}
 }
 
 func (ah *ApiRequestHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(r.Context(), MaxAPIResponseTimeout) // TODO: mdn timeouts
-	defer cancel()
+	opts, paramErrs := ah.parseRequest(r)
+	if len(paramErrs) > 0 {
+		ah.logger.Printf("ERROR: bad request: %v", paramErrs)
+		body := map[string]paramErrors{"errors": paramErrs}
+		if err := writeJSON(rw, http.StatusBadRequest, body); err != nil {
+			ah.logger.Printf("io error writing response: %v", err)
+		}
+		return
+	}
+
+	// The cache is checked again in case the entry was filled while this
+	// request waited for a slot.
+	upstreamURL := ah.upstreamURL(r, opts)
+	if ah.serveCached(rw, r, opts, upstreamURL, start) {
+		return
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ah.apiURL, nil)
+	// The request context is bounded by the request timeout, and the
+	// upstream timeout only applies to the fetch within handleRequest.
+	ctx := ah.withPropagatedHeaders(r)
+	req, err := ah.newUpstreamRequest(ctx, upstreamURL)
 	if err != nil {
 		ah.logger.Printf("ERROR: api request error: %v", err)
 		http.Error(
@@ -169,51 +898,391 @@ func (ah *ApiRequestHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// handleRequest builds the response in buf, which is only copied to rw
+	// once complete, so that rw has a single owner and the client gets all
+	// of a response or none of it. The goroutine is only abandoned, along
+	// with buf, once the request deadline passes, by which point the
+	// timeout middleware has answered the client. Streamed responses are the exception: they are written
+	// as they are encoded, so timeouts surface as fetch errors instead.
+	var buf *bufferedResponse
+	out := rw
+	if !streamingRequested(r) {
+		buf = &bufferedResponse{header: rw.Header().Clone(), limit: ah.maxResponseBytes}
+		out = buf
+	}
+
 	resultCh := make(chan error, 1)
-	go ah.handleRequest(resultCh, rw, req)
+	go ah.handleRequest(resultCh, out, req, opts, ah.upstreamTimeout(r))
 
 	// TODO: structured logging with slog
 	select {
+	case err = <-resultCh:
 	case <-ctx.Done():
+		if buf != nil {
+			err = ctx.Err()
+		} else {
+			err = <-resultCh
+		}
+	}
+	if err == nil && buf != nil {
+		cw := &countingWriter{ResponseWriter: rw}
+		if copyErr := buf.copyTo(cw); copyErr != nil {
+			err = &downstreamWriteError{written: cw.written, err: copyErr}
+		}
+	}
+
+	var panicErr *panicError
+	var writeErr *downstreamWriteError
+	switch {
+	case errors.Is(err, errResponseTooLarge):
+		// Checked before write errors, which it is reported as, since nothing
+		// has reached the client yet.
 		ah.logger.Printf(
-			"ERROR: request=%s response-time=%s: %v",
-			req.URL,
+			"ERROR: response exceeds %d bytes: response-time=%s",
+			ah.maxResponseBytes,
 			time.Since(start),
-			ctx.Err(),
 		)
-		http.Error(rw, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
-	case err := <-resultCh:
-		if err != nil {
-			ah.logger.Printf(
-				"ERROR: response-time=%s: %v",
-				time.Since(start),
-				err,
-			)
-			http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
-		} else {
-			ah.logger.Printf("INFO: response-time=%s", time.Since(start))
-		}
+		http.Error(rw, "response too large", http.StatusInternalServerError)
+	case errors.As(err, &writeErr):
+		// The response is already under way, so there is no status to send.
+		ah.logger.Printf(
+			"ERROR: client received a truncated response: response-time=%s write-timeout=%t: %v",
+			time.Since(start),
+			errors.Is(err, os.ErrDeadlineExceeded),
+			err,
+		)
+	case errors.As(err, &panicErr):
+		ah.logger.Printf(
+			"ERROR: response-time=%s: %v\n%s",
+			time.Since(start),
+			err,
+			panicErr.stack,
+		)
+		http.Error(
+			rw,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
+	case errors.Is(err, apierror.ErrUpstreamAuth):
+		ah.logger.Printf(
+			"ERROR: upstream authentication failed, check the GitHub token: response-time=%s: %v",
+			time.Since(start),
+			err,
+		)
+		http.Error(rw, "upstream authentication failed", http.StatusInternalServerError)
+	case errors.Is(err, apierror.ErrUpstreamTruncated):
+		ah.logger.Printf(
+			"ERROR: truncated upstream response: response-time=%s: %v",
+			time.Since(start),
+			err,
+		)
+		http.Error(rw, "truncated upstream response", http.StatusBadGateway)
+	case err != nil:
+		ah.logger.Printf(
+			"ERROR: response-time=%s: %v",
+			time.Since(start),
+			err,
+		)
+		code := upstreamErrorStatus(err)
+		http.Error(rw, http.StatusText(code), code)
+	default:
+		ah.logger.Printf("INFO: response-time=%s", time.Since(start))
+	}
+}
+
+// upstreamErrorStatus maps a failed upstream fetch to the status returned to
+// the client.
+func upstreamErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, apierror.ErrUpstreamUnreachable),
+		errors.Is(err, apierror.ErrUpstreamDecode),
+		errors.As(err, new(*apierror.UpstreamStatusError)):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
 	}
 }
 
-func newWebserver(listenAddr *string, apiURL string, logger *log.Logger) *http.Server {
-	apiHandler := NewRateLimitHandler(
-		&ApiRequestHandler{
-			logger: logger,
-			apiURL: apiURL,
+// webserver is an http.Server along with the live components Start needs to
+// manage at runtime.
+type webserver struct {
+	*http.Server
+	api         *ApiRequestHandler
+	limiter     *RateLimiter
+	draining    *atomic.Bool
+	maintenance *atomic.Bool
+	audit       *auditLog
+	shutdown    chan struct{}  // closed when shutdown begins
+	webhookURL  string         // notified when shutdown begins, if set
+	exit        func(code int) // ends the process on a forced shutdown
+}
+
+func newWebserver(
+	ctx context.Context,
+	cfg *Config,
+	logger *log.Logger,
+	clk clock.Clock,
+) (*webserver, error) {
+	conns := new(connStats)
+	client, err := newUpstreamClient(cfg, conns)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.UpstreamInsecureSkipVerify {
+		logger.Println("WARNING: upstream TLS certificate verification is DISABLED, do not use in production")
+	}
+
+	if cfg.UpstreamIdleReapInterval > 0 {
+		go reapIdleConnections(ctx, client, cfg.UpstreamIdleReapInterval, clk)
+	}
+
+	override, err := newUpstreamOverride(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth Authenticator = StaticToken(cfg.GitHubToken)
+	var tokenFile *FileToken
+	if cfg.GitHubTokenFile != "" {
+		if tokenFile, err = newFileToken(cfg.GitHubTokenFile, clk); err != nil {
+			return nil, err
+		}
+		auth = tokenFile
+	}
+
+	apiHandler := &ApiRequestHandler{
+		logger:        logger,
+		apiURL:        cfg.APIURL,
+		auth:          auth,
+		timeout:       cfg.UpstreamTimeout,
+		routeTimeouts: cfg.RouteUpstreamTimeouts,
+		maxPages:      cfg.MaxPages,
+		partialOK:     cfg.PartialOK,
+		query: queryParser{
+			maxLimit:    cfg.MaxLimit,
+			strict:      cfg.StrictQuery,
+			passthrough: cfg.UpstreamPassthrough,
+		},
+		client:                client,
+		emptyAs204:            cfg.EmptyAs204,
+		cliMode:               cfg.CLIMode,
+		strictDecode:          cfg.StrictUpstreamDecode,
+		upstreamVersion:       &upstreamVersion{logger: logger},
+		exposeUpstreamVersion: cfg.ExposeUpstreamAPIVersion,
+		deprecateLegacyShape:  cfg.DeprecateLegacyShape,
+		legacySunset:          cfg.LegacySunset,
+		rawHeaders:            newHeaderFilter(cfg.ForwardUpstreamHeaders, cfg.StripUpstreamHeaders),
+		maxEncodeTime:         cfg.MaxEncodeTime,
+		maxResponseBytes:      cfg.MaxResponseBytes,
+		propagateTrace:        cfg.PropagateTrace,
+		correlationHeader:     cfg.CorrelationHeader,
+		override:              override,
+		clock:                 clk,
+		retry: retryPolicy{
+			maxRetries:     cfg.MaxRetries,
+			timeouts:       cfg.RetryTimeouts,
+			serverErrors:   cfg.Retry5xx,
+			attemptTimeout: cfg.UpstreamAttemptTimeout,
+			backoff:        cfg.RetryBackoff,
+			backoffCap:     cfg.RetryBackoffCap,
+			budget:         newRetryBudget(cfg.RetryBudgetRatio),
 		},
-		logger,
-		MaxActiveAPIRequests,
+	}
+	if !cfg.Features.Retry {
+		apiHandler.retry.maxRetries = 0
+	}
+
+	maintenance := new(atomic.Bool)
+	maintenance.Store(cfg.Maintenance)
+
+	apiChain := middleware.Chain{middleware.Recovery(logger), maintenanceGate(logger, maintenance)}
+	if cfg.MaxInFlight > 0 {
+		apiChain = append(apiChain, middleware.MaxInFlight(cfg.MaxInFlight))
+	}
+
+	if cfg.AdaptiveTimeoutFactor > 0 {
+		apiHandler.adaptive = &adaptiveTimeout{
+			factor: cfg.AdaptiveTimeoutFactor,
+			min:    cfg.AdaptiveTimeoutMin,
+			max:    cmp.Or(cfg.AdaptiveTimeoutMax, cfg.UpstreamTimeout),
+		}
+	}
+
+	apiHandler.cacheControl = cfg.CacheControl
+	if apiHandler.cacheControl == "" && cfg.CacheTTL > 0 {
+		apiHandler.cacheControl = fmt.Sprintf("max-age=%d", int(cfg.CacheTTL.Seconds()))
+		if cfg.CacheStaleWhileRevalidate > 0 {
+			apiHandler.cacheControl += fmt.Sprintf(
+				", stale-while-revalidate=%d",
+				int(cfg.CacheStaleWhileRevalidate.Seconds()),
+			)
+		}
+	}
+
+	if cfg.DebugLogBodies {
+		logger.Println("WARNING: debug body logging is enabled")
+		apiHandler.bodyLog = &bodyLogger{maxBytes: cfg.DebugLogMaxBytes}
+		for _, secret := range []string{cfg.GitHubToken, cfg.UpstreamHMACSecret} {
+			if secret != "" {
+				apiHandler.bodyLog.secrets = append(apiHandler.bodyLog.secrets, secret)
+			}
+		}
+		if tokenFile != nil {
+			apiHandler.bodyLog.liveSecret = tokenFile.Token
+		}
+	}
+
+	if cfg.UpstreamHMACSecret != "" {
+		apiHandler.signer = HMACSigner{Secret: []byte(cfg.UpstreamHMACSecret)}
+	}
+
+	if cfg.FallbackFile != "" {
+		fallback, err := loadFallback(cfg.FallbackFile)
+		if err != nil {
+			return nil, err
+		}
+		apiHandler.fallback = fallback
+	}
+
+	if cfg.Features.Cache && cfg.CacheTTL > 0 {
+		apiHandler.cache = cache.New[apiresponse.Repos](cfg.CacheTTL, cfg.CacheMaxEntries, clk)
+		apiHandler.cache.KeepStale(cfg.CacheStaleWhileRevalidate)
+		apiHandler.honorUpstreamCache = cfg.CacheHonorUpstream
+	}
+
+	// The limiter is created before any background task starts, as they
+	// yield to the requests it admits.
+	shutdown := make(chan struct{})
+	limiter := NewRateLimitHandler(nil, logger, cfg.MaxActiveAPIRequests, clk, shutdown)
+	limiter.countQueued = cfg.RateLimitCountQueued
+	apiHandler.hedge = newHedger(cfg.HedgeDelay, limiter.size)
+	if cfg.SlowStartDuration > 0 {
+		go limiter.SlowStart(ctx, cfg.SlowStartDuration)
+	}
+	apiHandler.background = newBackgroundLimiter(cfg.MaxBackgroundRequests, limiter, clk)
+	apiHandler.upstreamCheck = newCachedCheck(apiHandler.checkUpstream, UpstreamCheckInterval, clk)
+
+	draining := new(atomic.Bool)
+	ready := &readiness{timeout: ReadinessCheckTimeout}
+	ready.register("upstream", true, HealthCheckFunc(apiHandler.upstreamReady))
+	ready.register("draining", true, failWhen(draining.Load, "server is shutting down"))
+	// Maintenance is only reported: a load balancer taking every instance
+	// out of rotation would hide the maintenance response from clients.
+	ready.register("maintenance", false, failWhen(maintenance.Load, "maintenance mode is on"))
+
+	if cfg.CacheWarmInterval > 0 && apiHandler.cache == nil {
+		logger.Println("WARNING: cache warming requires the cache feature and a non-zero cache TTL, disabling")
+	} else if cfg.CacheWarmInterval > 0 {
+		warmed := new(atomic.Bool)
+		go apiHandler.warmCache(ctx, cfg.CacheWarmInterval, warmed)
+		ready.register("cache", false, failWhen(func() bool { return !warmed.Load() }, "cache not warmed yet"))
+
+		if cfg.WarmupGate {
+			apiChain = append(apiChain, warmupGate(warmed))
+		}
+	}
+
+	if cfg.Features.Cache && cfg.IdempotencyTTL > 0 {
+		store := cache.New[storedResponse](cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys, clk)
+		apiChain = append(apiChain, idempotency(logger, store))
+	}
+
+	if cfg.UpstreamKeepaliveInterval > 0 {
+		go keepUpstreamWarm(ctx, shutdown, client, apiHandler.background, cfg.APIURL, cfg.UpstreamKeepaliveInterval, logger, clk)
+	}
+
+	// Recovery must stay outermost and rate-limiting innermost. Cache hits
+	// are answered just before the limiter, so only requests going upstream
+	// take a slot or sit out a back-off delay; they keep the slot while
+	// their response is encoded.
+	apiChain = append(apiChain,
+		timeout(logger, cfg.RequestTimeout),
+		apiHandler.cacheHits(),
+		rateLimit(limiter),
 	)
 
-	router := http.NewServeMux()
-	router.Handle("/",
-		http.TimeoutHandler(
-			apiHandler,
-			MaxAPIResponseTimeout,
-			http.StatusText(http.StatusRequestTimeout),
-		))
+	// The limiter only fronts a single chain, so every endpoint that calls the
+	// upstream is routed behind it.
+	routes := new(routeTable)
+	if cfg.Features.Metrics && cfg.StatsInterval > 0 {
+		routes.latency = new(routeLatencies)
+		go logLatency(ctx, routes.latency, cfg.StatsInterval, logger, clk)
+	}
+
+	robots := []byte(DefaultRobotsTxt)
+	if cfg.RobotsTxtFile != "" {
+		if robots, err = os.ReadFile(cfg.RobotsTxtFile); err != nil {
+			return nil, fmt.Errorf("failed to read robots.txt file: %w", err)
+		}
+	}
+
+	audit, err := newAuditLog(cfg.AuditLogFile, logger, cfg.AdminAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	api := routes.mux()
+	api.Handle("/{$}", apiHandler)
+	api.Handle("GET /summary", apiHandler.summaryHandler())
+	api.Handle("GET /raw", apiHandler.rawHandler())
+	if len(cfg.AdminAPIKeys) > 0 {
+		api.Handle("GET /whoami", middleware.RequireAPIKey(cfg.AdminAPIKeys)(apiHandler.whoamiHandler()))
+	}
+	// Mounting the API mux isn't a route of its own, so it isn't recorded.
+	// Only the API's paths are mounted, leaving the API mux to answer other
+	// methods on them, and anything else is answered outside the chain so
+	// that it neither queues for the limiter nor spends an upstream call.
+	router := routes.mux()
+	chained := apiChain.Then(api)
+	for _, path := range []string{"/{$}", "/summary", "/raw"} {
+		router.ServeMux.Handle(path, chained)
+	}
+	if len(cfg.AdminAPIKeys) > 0 {
+		// The key is checked before the chain as well, so that no middleware
+		// in it, such as idempotency replay, can answer an unauthenticated
+		// request with an authenticated response.
+		requireKey := middleware.RequireAPIKey(cfg.AdminAPIKeys)
+		router.ServeMux.Handle("/whoami", chained)
+		router.ServeMux.Handle("GET /whoami", audit.middleware("whoami")(requireKey(chained)))
+	}
+	router.ServeMux.Handle("/", notFound(logger))
 
+	if cfg.Features.Metrics {
+		router.Handle("/stats", statsHandler(logger, conns, limiter))
+	}
+	router.Handle("GET /routes", routes.handler(logger))
+
+	for path := range cfg.RouteUpstreamTimeouts {
+		if !routes.has(path) {
+			audit.close()
+			return nil, fmt.Errorf("upstream timeout set for unknown route %s", path)
+		}
+	}
+
+	if len(cfg.AdminAPIKeys) > 0 && apiHandler.cache != nil {
+		requireKey := middleware.RequireAPIKey(cfg.AdminAPIKeys)
+		router.Handle(
+			"POST /admin/cache/flush",
+			audit.middleware("cache.flush")(requireKey(flushCacheHandler(logger, apiHandler.cache))),
+		)
+	}
+
+	// Browsers and crawlers ask for these, which would otherwise be answered
+	// with a 404.
+	router.HandleFunc("GET /favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.HandleFunc("GET /robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := w.Write(robots); err != nil {
+			logger.Printf("io error writing response: %v", err)
+		}
+	})
+
+	router.Handle("GET /readyz", ready.handler(logger))
 	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write([]byte("ok")); err != nil {
@@ -221,13 +1290,38 @@ func newWebserver(listenAddr *string, apiURL string, logger *log.Logger) *http.S
 		}
 	})
 
+	// The probes stay outside the drain gate: liveness keeps passing so the
+	// process isn't restarted mid-drain, and readiness fails on its own
+	// draining check.
+	drainGate := middleware.Unavailable(draining.Load, 0)(router)
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			router.ServeHTTP(rw, r)
+			return
+		}
+		drainGate.ServeHTTP(rw, r)
+	})
+
 	// TODO: use mdn recommended timeout values
-	return &http.Server{
-		Addr:         *listenAddr,
-		Handler:      router,
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      handler,
 		ErrorLog:     logger,
-		ReadTimeout:  MaxReadTimeout,
-		WriteTimeout: MaxWriteTimeout,
-		IdleTimeout:  MaxIdleTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		TLSConfig:    serverTLSConfig(cfg),
 	}
+
+	return &webserver{
+		Server:      server,
+		api:         apiHandler,
+		limiter:     limiter,
+		draining:    draining,
+		maintenance: maintenance,
+		audit:       audit,
+		shutdown:    shutdown,
+		webhookURL:  cfg.ShutdownWebhookURL,
+		exit:        os.Exit,
+	}, nil
 }
@@ -0,0 +1,2768 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tcuthbert/apiserver/apierror"
+	"github.com/tcuthbert/apiserver/apiresponse"
+	"github.com/tcuthbert/apiserver/clock"
+)
+
+// newTestServer starts a server in front of upstream, with the default
+// configuration adjusted by configure, and returns it and its URL.
+func newTestServer(t *testing.T, upstream http.Handler, configure func(*Config)) (*webserver, string) {
+	t.Helper()
+
+	return newTestServerWithLogger(t, upstream, configure, log.New(io.Discard, "", 0))
+}
+
+// newTestServerWithLogger is newTestServer logging to logger.
+func newTestServerWithLogger(
+	t *testing.T,
+	upstream http.Handler,
+	configure func(*Config),
+	logger *log.Logger,
+) (*webserver, string) {
+	t.Helper()
+
+	return newTestServerWithClock(t, upstream, configure, logger, clock.Real{})
+}
+
+// newTestServerWithClock is newTestServerWithLogger timing with clk.
+func newTestServerWithClock(
+	t testing.TB,
+	upstream http.Handler,
+	configure func(*Config),
+	logger *log.Logger,
+	clk clock.Clock,
+) (*webserver, string) {
+	t.Helper()
+
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+
+	cfg := DefaultConfig()
+	cfg.APIURL = up.URL
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv, err := newWebserver(ctx, &cfg, logger, clk)
+	if err != nil {
+		t.Fatalf("newWebserver: %v", err)
+	}
+
+	ts := httptest.NewServer(srv.Handler)
+	t.Cleanup(ts.Close)
+
+	return srv, ts.URL
+}
+
+// get requests url with the given header name and value pairs, returning
+// the response and its body.
+func get(t *testing.T, url string, header ...string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: reading body: %v", url, err)
+	}
+
+	return resp, string(b)
+}
+
+// reposUpstream answers every request with body.
+func reposUpstream(body string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, body)
+	}
+}
+
+// hangingUpstream never answers, returning only once the request is given up.
+func hangingUpstream(rw http.ResponseWriter, r *http.Request) {
+	<-r.Context().Done()
+}
+
+func TestServeHTTPBufferedSuccess(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"},{"name":"b"}]`), nil)
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"name":"a"`) || !strings.Contains(body, `"name":"b"`) {
+		t.Errorf("body = %s, want both repos", body)
+	}
+}
+
+func TestInvalidUpstreamUTF8(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream("[{\"name\":\"a\",\"description\":\"bad \xff\xfe bytes\"}]"), func(cfg *Config) {
+		cfg.CLIMode = true
+	})
+
+	for _, accept := range []string{"application/json", "application/x-ndjson", "application/atom+xml", "text/plain"} {
+		query := ""
+		if accept == "text/plain" {
+			query = "?cli=1"
+		}
+		resp, body := get(t, url+"/"+query, "Accept", accept)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Accept %s: status = %d, want %d: %s", accept, resp.StatusCode, http.StatusOK, body)
+		}
+		if !utf8.ValidString(body) {
+			t.Errorf("Accept %s: body is not valid UTF-8: %q", accept, body)
+		}
+		// The table has no description column.
+		if accept != "text/plain" && !strings.Contains(body, "bad \uFFFD\uFFFD bytes") {
+			t.Errorf("Accept %s: body = %q, want the invalid bytes replaced", accept, body)
+		}
+	}
+}
+
+func TestWantsText(t *testing.T) {
+	yes, no := true, false
+	for _, tt := range []struct {
+		accept, userAgent string
+		cli               *bool
+		want              bool
+	}{
+		{"", "curl/8.7.1", nil, true},
+		{"*/*", "Wget/1.21", nil, true},
+		{"*/*", "HTTPie/3.2.2", nil, true},
+		{"*/*", "curl/8.7.1", &no, false},
+		{"application/json", "curl/8.7.1", nil, false},
+		{"text/html", "curl/8.7.1", nil, false},
+		{"*/*", "Go-http-client/1.1", nil, false},
+		{"", "", nil, false},
+		{"text/html,application/xhtml+xml", "Mozilla/5.0", nil, false},
+		{"application/json", "Go-http-client/1.1", &yes, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		r.Header.Set("User-Agent", tt.userAgent)
+		if got := wantsText(r, tt.cli); got != tt.want {
+			cli := "unset"
+			if tt.cli != nil {
+				cli = fmt.Sprint(*tt.cli)
+			}
+			t.Errorf("wantsText(Accept %q, User-Agent %q, cli %s) = %t, want %t", tt.accept, tt.userAgent, cli, got, tt.want)
+		}
+	}
+}
+
+func TestCLIMode(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), func(cfg *Config) {
+		cfg.CLIMode = true
+	})
+
+	for _, tt := range []struct {
+		query    string
+		header   []string
+		wantText bool
+	}{
+		{"", []string{"User-Agent", "curl/8.7.1", "Accept", "*/*"}, true},
+		{"?cli=0", []string{"User-Agent", "curl/8.7.1", "Accept", "*/*"}, false},
+		{"", []string{"User-Agent", "Go-http-client/1.1", "Accept", "*/*"}, false},
+		{"", []string{"User-Agent", "Mozilla/5.0", "Accept", "text/html"}, false},
+		{"?cli=1", []string{"Accept", "application/json"}, true},
+	} {
+		resp, body := get(t, url+"/"+tt.query, tt.header...)
+		if gotText := strings.HasPrefix(body, "NAME"); gotText != tt.wantText {
+			t.Errorf("%s %q: body = %s, want text table %t", tt.query, tt.header, body, tt.wantText)
+		}
+		if !strings.Contains(resp.Header.Get("Vary"), "User-Agent") {
+			t.Errorf("%s %q: Vary = %q, want User-Agent", tt.query, tt.header, resp.Header.Get("Vary"))
+		}
+	}
+}
+
+func TestAtomFeedStructure(t *testing.T) {
+	srv, url := newTestServer(t, reposUpstream(`[{"name":"a","html_url":"https://github.com/octocat/a","updated_at":"2026-01-02T03:04:05Z"}]`), nil)
+
+	resp, body := get(t, url+"/", "Accept", "application/atom+xml")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+
+	var feed struct {
+		XMLName xml.Name
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Author  struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Entries []struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal([]byte(body), &feed); err != nil {
+		t.Fatalf("invalid feed: %v\n%s", err, body)
+	}
+
+	if feed.XMLName != (xml.Name{Space: "http://www.w3.org/2005/Atom", Local: "feed"}) {
+		t.Errorf("root element = %v, want an Atom feed", feed.XMLName)
+	}
+	if feed.ID != srv.api.apiURL || feed.Title == "" || feed.Updated != "2026-01-02T03:04:05Z" {
+		t.Errorf("feed id, title, updated = %q, %q, %q", feed.ID, feed.Title, feed.Updated)
+	}
+	// No entry has an author, so the feed must.
+	if feed.Author.Name == "" {
+		t.Error("feed has no author")
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].ID != "https://github.com/octocat/a" || feed.Entries[0].Title != "a" {
+		t.Errorf("entries = %+v, want the one repo", feed.Entries)
+	}
+}
+
+func TestFeedAuthor(t *testing.T) {
+	for apiURL, want := range map[string]string{
+		"https://api.github.com/users/tcuthbert/repos": "tcuthbert",
+		"https://api.github.com/orgs/golang/repos":     "golang",
+		"https://api.github.com/user/repos":            "api.github.com",
+		"http://127.0.0.1:8080":                        "127.0.0.1:8080",
+	} {
+		if got := feedAuthor(apiURL); got != want {
+			t.Errorf("feedAuthor(%q) = %q, want %q", apiURL, got, want)
+		}
+	}
+}
+
+func TestServeHTTPUpstreamTimeout(t *testing.T) {
+	_, url := newTestServer(t, http.HandlerFunc(hangingUpstream), func(cfg *Config) {
+		cfg.UpstreamTimeout = 50 * time.Millisecond
+		cfg.RequestTimeout = 2 * time.Second
+	})
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusGatewayTimeout, body)
+	}
+}
+
+func TestServeHTTPResponseTooLarge(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"},{"name":"b"}]`), func(cfg *Config) {
+		cfg.MaxResponseBytes = 16
+	})
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusInternalServerError, body)
+	}
+	if strings.Contains(body, `"name"`) {
+		t.Errorf("body = %s, want no part of the oversized response", body)
+	}
+}
+
+func TestJQResultTooLarge(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), nil)
+
+	// Each step doubles the result while sharing one value, so evaluation is
+	// instant and only encoding it would take 2^30 objects.
+	expr := "@" + strings.Repeat(".{a:@,b:@}", 30)
+	resp, body := get(t, url+"/?jq="+expr)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %.200s", resp.StatusCode, http.StatusBadRequest, body)
+	}
+	// Under load the deadline may pass before the size limit is reached.
+	if !strings.Contains(body, errJQTooLarge.Error()) && !strings.Contains(body, errJQTimeout.Error()) {
+		t.Errorf("body = %.200s, want %q", body, errJQTooLarge)
+	}
+}
+
+func TestEncodeJQResult(t *testing.T) {
+	for _, v := range []any{
+		nil,
+		3.5,
+		"<a&b>",
+		[]any{true, "x", map[string]any{"z": 1.0, "a": []any{}}},
+		map[string]any{"b": nil, "a": map[string]any{"c": "d"}},
+	} {
+		var buf bytes.Buffer
+		if err := encodeJQResult(&buf, v, 0); err != nil {
+			t.Errorf("encodeJQResult(%v): %v", v, err)
+			continue
+		}
+		want, _ := json.Marshal(v)
+		if buf.String() != string(want) {
+			t.Errorf("encodeJQResult(%v) = %s, want %s", v, buf.String(), want)
+		}
+	}
+
+	var deep any = "leaf"
+	for range maxJQDepth + 1 {
+		deep = []any{deep}
+	}
+	if err := encodeJQResult(new(bytes.Buffer), deep, 0); !errors.Is(err, errJQTooLarge) {
+		t.Errorf("encoding %d nested lists = %v, want %v", maxJQDepth+1, err, errJQTooLarge)
+	}
+}
+
+func TestServeHTTPFallbackOnUpstreamTimeout(t *testing.T) {
+	fallback := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(fallback, []byte(`[{"name":"fallback"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, url := newTestServer(t, http.HandlerFunc(hangingUpstream), func(cfg *Config) {
+		cfg.UpstreamTimeout = 50 * time.Millisecond
+		cfg.RequestTimeout = 2 * time.Second
+		cfg.FallbackFile = fallback
+	})
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"name":"fallback"`) {
+		t.Errorf("body = %s, want the fallback repos", body)
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Error("no Warning header on the fallback response")
+	}
+}
+
+func TestServeHTTPPartialResultsOnUpstreamTimeout(t *testing.T) {
+	var upstreamURL string
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			hangingUpstream(rw, r)
+			return
+		}
+		rw.Header().Set("Link", "<"+upstreamURL+"/?page=2>; rel=\"next\"")
+		io.WriteString(rw, `[{"name":"first"}]`)
+	})
+
+	srv, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.UpstreamTimeout = 100 * time.Millisecond
+		cfg.RequestTimeout = 2 * time.Second
+		cfg.MaxPages = 2
+		cfg.PartialOK = true
+	})
+	upstreamURL = strings.TrimSuffix(srv.api.apiURL, "/")
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"name":"first"`) {
+		t.Errorf("body = %s, want the first page", body)
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Error("no Warning header on the partial response")
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	from := &url.URL{Scheme: "https", Host: "api.github.com", Path: "/users/u/repos"}
+	for _, tt := range []struct {
+		link    string
+		want    string
+		wantErr bool
+	}{
+		{``, "", false},
+		{`<https://api.github.com/users/u/repos?page=3>; rel="last"`, "", false},
+		{
+			`<https://api.github.com/users/u/repos?page=2>; rel="next", <https://api.github.com/users/u/repos?page=3>; rel="last"`,
+			"https://api.github.com/users/u/repos?page=2", false,
+		},
+		{`</users/u/repos?page=2>; rel="next"`, "https://api.github.com/users/u/repos?page=2", false},
+		{`<https://attacker.example/collect?page=2>; rel="next"`, "", true},
+		{`<http://api.github.com/users/u/repos?page=2>; rel="next"`, "", true},
+		{`<https://api.github.com:8443/users/u/repos?page=2>; rel="next"`, "", true},
+	} {
+		got, err := nextPageURL(http.Header{"Link": {tt.link}}, from)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("nextPageURL(%s) = %q, %v, want %q, error %t", tt.link, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestForeignNextPageNotFollowed(t *testing.T) {
+	var leaked atomic.Int32
+	foreign := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		leaked.Add(1)
+		io.WriteString(rw, `[]`)
+	}))
+	t.Cleanup(foreign.Close)
+
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Link", "<"+foreign.URL+"/?page=2>; rel=\"next\"")
+		io.WriteString(rw, `[{"name":"first"}]`)
+	})
+	_, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.GitHubToken = "secret"
+		cfg.MaxPages = 2
+	})
+
+	if resp, body := get(t, url+"/"); resp.StatusCode == http.StatusOK {
+		t.Errorf("status = %d, want an error for the foreign next page: %s", resp.StatusCode, body)
+	}
+	if n := leaked.Load(); n != 0 {
+		t.Errorf("foreign host called %d times, want 0", n)
+	}
+}
+
+// slowDownstreamLog stalls for delay whenever a downstream body is logged,
+// standing in for a slow transformation of the upstream response.
+type slowDownstreamLog struct {
+	delay time.Duration
+}
+
+func (w slowDownstreamLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("downstream")) {
+		time.Sleep(w.delay)
+	}
+	return len(p), nil
+}
+
+// slowUpstream answers with body after delay.
+func slowUpstream(delay time.Duration, body string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(rw, body)
+	}
+}
+
+func TestTransformationUsesRequestTimeoutHeadroom(t *testing.T) {
+	// The upstream answers within its timeout, but transforming the response
+	// takes the rest of the request timeout past the upstream deadline.
+	logger := log.New(slowDownstreamLog{delay: 200 * time.Millisecond}, "", 0)
+	_, url := newTestServerWithLogger(t, slowUpstream(80*time.Millisecond, `[{"name":"a"}]`), func(cfg *Config) {
+		cfg.UpstreamTimeout = 100 * time.Millisecond
+		cfg.RequestTimeout = 2 * time.Second
+		cfg.DebugLogBodies = true
+	}, logger)
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"name":"a"`) {
+		t.Errorf("body = %s, want the repos", body)
+	}
+}
+
+func TestTransformationExceedingRequestTimeout(t *testing.T) {
+	logger := log.New(slowDownstreamLog{delay: time.Second}, "", 0)
+	_, url := newTestServerWithLogger(t, reposUpstream(`[{"name":"a"}]`), func(cfg *Config) {
+		cfg.UpstreamTimeout = 100 * time.Millisecond
+		cfg.RequestTimeout = 300 * time.Millisecond
+		cfg.DebugLogBodies = true
+	}, logger)
+
+	start := time.Now()
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d from the request timeout: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+	if strings.Contains(body, `"name"`) {
+		t.Errorf("body = %s, want no part of the late response", body)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("answered after %s, want the request timeout to cut the transformation short", elapsed)
+	}
+}
+
+func TestProjectedNDJSONExceedingRequestTimeout(t *testing.T) {
+	// ?jq answers NDJSON requests with buffered JSON, which the request
+	// timeout must still cut short.
+	logger := log.New(slowDownstreamLog{delay: time.Second}, "", 0)
+	_, url := newTestServerWithLogger(t, reposUpstream(`[{"name":"a"}]`), func(cfg *Config) {
+		cfg.UpstreamTimeout = 100 * time.Millisecond
+		cfg.RequestTimeout = 300 * time.Millisecond
+		cfg.DebugLogBodies = true
+	}, logger)
+
+	start := time.Now()
+	resp, body := get(t, url+"/?jq=[].name", "Accept", "application/x-ndjson")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d from the request timeout: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("answered after %s, want the request timeout to cut the transformation short", elapsed)
+	}
+}
+
+func TestReadBodyPresized(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	resp := &http.Response{
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(payload)),
+		ContentLength: int64(len(payload)),
+	}
+
+	b, err := readBody(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("read %d bytes, want the %d byte payload", len(b), len(payload))
+	}
+	if cap(b) != len(payload) {
+		t.Errorf("cap = %d, want exactly the Content-Length %d", cap(b), len(payload))
+	}
+}
+
+func TestReadBodyMismatchedContentLength(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		contentLength int64
+		wantErr       error
+	}{
+		{"longer", 4, nil},
+		{"shorter", 16, io.ErrUnexpectedEOF},
+	} {
+		resp := &http.Response{
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader("abcdefgh")),
+			ContentLength: tt.contentLength,
+		}
+
+		b, err := readBody(resp)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && string(b) != "abcdefgh" {
+			t.Errorf("%s: body = %q, want the whole body", tt.name, b)
+		}
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for range b.N {
+		resp := &http.Response{
+			Header:        http.Header{},
+			Body:          io.NopCloser(bytes.NewReader(payload)),
+			ContentLength: int64(len(payload)),
+		}
+		if _, err := readBody(resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// runConcurrently runs op b.N times in total, spread across clients
+// goroutines, and reports the resulting throughput.
+func runConcurrently(b *testing.B, clients int, op func()) {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(b.N) {
+				op()
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+// fixtureRepos returns n repos shaped like a GitHub listing.
+func fixtureRepos(n int) apiresponse.Repos {
+	lang := "Go"
+	pushed := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	repos := make(apiresponse.Repos, n)
+	for i := range repos {
+		repos[i] = apiresponse.Repo{
+			Url:         fmt.Sprintf("https://api.github.com/repos/octocat/repo-%d", i),
+			Language:    &lang,
+			Name:        fmt.Sprintf("repo-%d", i),
+			HTMLURL:     fmt.Sprintf("https://github.com/octocat/repo-%d", i),
+			Description: "A fixture repository",
+			Visibility:  "public",
+			Stars:       i,
+			Forks:       i / 2,
+			PushedAt:    &pushed,
+			UpdatedAt:   &pushed,
+		}
+	}
+
+	return repos
+}
+
+// BenchmarkHandler measures whole requests against a fixture upstream, with
+// more clients than any limiter size benchmarked. Without upstream latency the
+// server is CPU bound and sizes past GOMAXPROCS add contention rather than
+// throughput; with it, throughput grows with the size until the CPUs are
+// saturated, which a fixed size of 3 reaches long before a large machine does.
+// Compare runs with -cpu to see the knee move with GOMAXPROCS.
+func BenchmarkHandler(b *testing.B) {
+	body, err := json.Marshal(fixtureRepos(100))
+	if err != nil {
+		b.Fatal(err)
+	}
+	clients := 4 * runtime.GOMAXPROCS(0)
+
+	for _, latency := range []time.Duration{0, 2 * time.Millisecond} {
+		for _, size := range limiterSizes() {
+			b.Run(fmt.Sprintf("latency=%s/max-active=%d", latency, size), func(b *testing.B) {
+				_, url := newTestServerWithClock(b, slowUpstream(latency, string(body)), func(cfg *Config) {
+					cfg.MaxActiveAPIRequests = size
+				}, log.New(io.Discard, "", 0), instantClock{})
+
+				client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: clients}}
+				b.Cleanup(client.CloseIdleConnections)
+
+				runConcurrently(b, clients, func() {
+					resp, err := client.Get(url + "/")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					defer resp.Body.Close()
+
+					io.Copy(io.Discard, resp.Body)
+					if resp.StatusCode != http.StatusOK {
+						b.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkWriteRepos measures the JSON transform path on its own, which
+// runs on the request's goroutine while it holds a limiter slot.
+func BenchmarkWriteRepos(b *testing.B) {
+	srv, _ := newTestServerWithClock(b, reposUpstream(`[]`), nil, log.New(io.Discard, "", 0), clock.Real{})
+	repos := fixtureRepos(100)
+
+	for _, tt := range []struct {
+		name string
+		opts queryOptions
+	}{
+		{"upstream-case", queryOptions{keyCase: apiresponse.UpstreamCase}},
+		{"camel-case", queryOptions{keyCase: apiresponse.CamelCase}},
+		{"group-by-language", queryOptions{groupBy: "language"}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := srv.api.writeRepos(httptest.NewRecorder(), repos, http.StatusOK, tt.opts, responseMeta{}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// repoNames decodes a JSON array of repos, returning their names in order.
+func repoNames(t *testing.T, body string) []string {
+	t.Helper()
+
+	var repos apiresponse.Repos
+	if err := json.Unmarshal([]byte(body), &repos); err != nil {
+		t.Fatalf("body %s is not a repos array: %v", body, err)
+	}
+	names := make([]string, len(repos))
+	for i, repo := range repos {
+		names[i] = repo.Name
+	}
+
+	return names
+}
+
+// fiveRepos is an upstream page of the repos a to e.
+const fiveRepos = `[{"name":"a"},{"name":"b"},{"name":"c"},{"name":"d"},{"name":"e"}]`
+
+func TestUpstreamConnectionStats(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	_, url := newTestServerWithClock(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.UpstreamIdleReapInterval = time.Minute
+	}, log.New(io.Discard, "", 0), clk)
+
+	stats := func() connStatsSnapshot {
+		t.Helper()
+		_, body := get(t, url+"/stats")
+		var s serverStats
+		if err := json.Unmarshal([]byte(body), &s); err != nil {
+			t.Fatalf("invalid /stats body %s: %v", body, err)
+		}
+		return s.UpstreamConnections
+	}
+
+	if s := stats(); s != (connStatsSnapshot{}) {
+		t.Errorf("connections before any request = %+v, want none", s)
+	}
+
+	get(t, url+"/")
+	get(t, url+"/")
+	if s := stats(); s != (connStatsSnapshot{Opened: 1, Open: 1}) {
+		t.Errorf("connections after two requests = %+v, want one reused connection", s)
+	}
+
+	// The reaper closes the idle connection on its next tick.
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	waitFor(t, "the idle connection to be reaped", func() bool {
+		return stats() == connStatsSnapshot{Opened: 1, Closed: 1}
+	})
+}
+
+func TestLimit(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(fiveRepos), func(cfg *Config) {
+		cfg.MaxLimit = 3
+	})
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"?limit=2", []string{"a", "b"}},
+		{"?limit=3", []string{"a", "b", "c"}},
+		{"?limit=50", []string{"a", "b", "c"}}, // capped at -max-limit
+	} {
+		resp, body := get(t, url+"/"+tt.query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.query, resp.StatusCode, http.StatusOK, body)
+		}
+		if got := repoNames(t, body); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: repos = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	_, url = newTestServer(t, reposUpstream(fiveRepos), nil)
+	resp, body := get(t, url+"/?limit=10")
+	if got := repoNames(t, body); resp.StatusCode != http.StatusOK || len(got) != 5 {
+		t.Errorf("limit past the list = %d %q, want all 5 repos", resp.StatusCode, got)
+	}
+
+	for _, invalid := range []string{"0", "-1", "ten"} {
+		resp, body := get(t, url+"/?limit="+invalid)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, `"param":"limit"`) {
+			t.Errorf("limit=%q: %d %s, want a 400 naming limit", invalid, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestOffset(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(fiveRepos), nil)
+
+	for _, tt := range []struct {
+		query      string
+		want       []string
+		nextOffset string
+	}{
+		{"?offset=0", []string{"a", "b", "c", "d", "e"}, ""},
+		{"?offset=3", []string{"d", "e"}, ""},
+		{"?offset=5", []string{}, ""},
+		{"?offset=100", []string{}, ""},
+		{"?offset=1&limit=2", []string{"b", "c"}, "3"},
+		{"?offset=3&limit=2", []string{"d", "e"}, ""},
+	} {
+		resp, body := get(t, url+"/"+tt.query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.query, resp.StatusCode, http.StatusOK, body)
+		}
+		if got := repoNames(t, body); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: repos = %q, want %q", tt.query, got, tt.want)
+		}
+		if got := resp.Header.Get("X-Total-Count"); got != "5" {
+			t.Errorf("%s: X-Total-Count = %q, want %q", tt.query, got, "5")
+		}
+		if got := resp.Header.Get("X-Next-Offset"); got != tt.nextOffset {
+			t.Errorf("%s: X-Next-Offset = %q, want %q", tt.query, got, tt.nextOffset)
+		}
+	}
+
+	if _, body := get(t, url+"/?offset=100"); strings.TrimSpace(body) != "[]" {
+		t.Errorf("offset past the end = %s, want []", body)
+	}
+
+	resp, body := get(t, url+"/?offset=-1")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, `"param":"offset"`) {
+		t.Errorf("offset=-1: %d %s, want a 400 naming offset", resp.StatusCode, body)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(fiveRepos), nil)
+
+	resp, body := get(t, url+"/", "Accept", "application/x-ndjson")
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want %q", got, "application/x-ndjson")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	var names []string
+	for _, line := range lines {
+		var repo apiresponse.Repo
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&repo); err != nil {
+			t.Fatalf("line %q is not a repo: %v", line, err)
+		}
+		if dec.More() {
+			t.Fatalf("line %q holds more than one value", line)
+		}
+		names = append(names, repo.Name)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(names, want) {
+		t.Errorf("repos = %q, want %q", names, want)
+	}
+}
+
+func TestGroupByLanguage(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[
+		{"name":"a","language":"Go"},
+		{"name":"b","language":"Python"},
+		{"name":"c","language":null},
+		{"name":"d","language":"Go"},
+		{"name":"e"}
+	]`), nil)
+
+	resp, body := get(t, url+"/?group_by=language")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want %q", got, "application/json")
+	}
+
+	var groups map[string]apiresponse.Repos
+	if err := json.Unmarshal([]byte(body), &groups); err != nil {
+		t.Fatalf("body %s is not a map of repos: %v", body, err)
+	}
+	got := make(map[string][]string)
+	for lang, repos := range groups {
+		for _, repo := range repos {
+			got[lang] = append(got[lang], repo.Name)
+		}
+	}
+	want := map[string][]string{
+		"Go":                        {"a", "d"},
+		"Python":                    {"b"},
+		apiresponse.UnknownLanguage: {"c", "e"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %q, want %q", got, want)
+	}
+}
+
+func TestInvalidQueryParams(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		strict bool
+		query  string
+		want   []string
+	}{
+		{"all reported", false, "?limit=ten&offset=-1&group_by=owner&case=kebab", []string{"case", "group_by", "limit", "offset"}},
+		{"unknown ignored", false, "?limit=0&colour=red", []string{"limit"}},
+		{"unknown rejected when strict", true, "?limit=0&colour=red", []string{"colour", "limit"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamCalled atomic.Bool
+			_, url := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalled.Store(true)
+				fmt.Fprint(w, `[]`)
+			}), func(cfg *Config) {
+				cfg.StrictQuery = tt.strict
+			})
+
+			resp, body := get(t, url+"/"+tt.query)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, body)
+			}
+			var got struct {
+				Errors []paramError `json:"errors"`
+			}
+			if err := json.Unmarshal([]byte(body), &got); err != nil {
+				t.Fatalf("invalid error body %s: %v", body, err)
+			}
+			var params []string
+			for _, pe := range got.Errors {
+				params = append(params, pe.Param)
+				if pe.Message == "" {
+					t.Errorf("%s: no message", pe.Param)
+				}
+			}
+			if !slices.Equal(params, tt.want) {
+				t.Errorf("invalid params = %q, want %q", params, tt.want)
+			}
+			if upstreamCalled.Load() {
+				t.Error("upstream called for an invalid request")
+			}
+		})
+	}
+}
+
+// authFunc adapts a function to an Authenticator.
+type authFunc func(ctx context.Context, req *http.Request) error
+
+func (f authFunc) Apply(ctx context.Context, req *http.Request) error { return f(ctx, req) }
+
+func TestPanicInUpstreamRequest(t *testing.T) {
+	var logs strings.Builder
+	srv, url := newTestServerWithLogger(t, reposUpstream(`[{"name":"a"}]`), nil, log.New(&logs, "", 0))
+
+	var panicked atomic.Bool
+	srv.api.auth = authFunc(func(context.Context, *http.Request) error {
+		if !panicked.Swap(true) {
+			panic("authenticator exploded")
+		}
+		return nil
+	})
+
+	resp, body := get(t, url+"/")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusInternalServerError, body)
+	}
+	if strings.Contains(body, "exploded") {
+		t.Errorf("panic value leaked to the client: %s", body)
+	}
+	if got := logs.String(); !strings.Contains(got, "authenticator exploded") || !strings.Contains(got, "goroutine") {
+		t.Errorf("log does not record the panic and its stack:\n%s", got)
+	}
+
+	// The process survived and the rate limiter slot was released.
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status after panic = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if active := srv.limiter.total(); active != 0 {
+		t.Errorf("limiter holds %d slots after the requests, want 0", active)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apiserver.log")
+	if err := os.WriteFile(path, []byte("earlier line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, closeLog, err := openLogOutput(path)
+	if err != nil {
+		t.Fatalf("openLogOutput: %v", err)
+	}
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	_, url := newTestServerWithLogger(t, failing, nil, log.New(out, "webserver: ", 0))
+	get(t, url+"/")
+	if err := closeLog(); err != nil {
+		t.Fatalf("closing the log: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != "earlier line" {
+		t.Fatalf("log file was not appended to:\n%s", b)
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "webserver: ") {
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+
+	if out, _, err := openLogOutput(""); err != nil || out != os.Stdout {
+		t.Errorf("openLogOutput(\"\") = %v, %v, want stdout", out, err)
+	}
+	if _, _, err := openLogOutput(filepath.Join(t.TempDir(), "missing", "apiserver.log")); err == nil {
+		t.Error("opening a log file in a missing directory succeeded")
+	}
+}
+
+func TestUpstreamCustomCA(t *testing.T) {
+	tlsUp := httptest.NewUnstartedServer(reposUpstream(`[{"name":"a"}]`))
+	tlsUp.Config.ErrorLog = log.New(io.Discard, "", 0) // the refused handshake
+	tlsUp.StartTLS()
+	t.Cleanup(tlsUp.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsUp.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		caFile     string
+		insecure   bool
+		wantStatus int
+	}{
+		{"system roots", "", false, http.StatusBadGateway},
+		{"custom CA", caFile, false, http.StatusOK},
+		{"insecure skip verify", "", true, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			_, url := newTestServerWithLogger(t, http.NotFoundHandler(), func(cfg *Config) {
+				cfg.APIURL = tlsUp.URL
+				cfg.UpstreamCAFile = tt.caFile
+				cfg.UpstreamInsecureSkipVerify = tt.insecure
+			}, log.New(&logs, "", 0))
+
+			if resp, body := get(t, url+"/"); resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if warned := strings.Contains(logs.String(), "WARNING: upstream TLS certificate verification is DISABLED"); warned != tt.insecure {
+				t.Errorf("startup warning logged = %t, want %t", warned, tt.insecure)
+			}
+		})
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.UpstreamCAFile = notPEM
+	if _, err := upstreamTLSConfig(&cfg); err == nil {
+		t.Error("a CA file with no certificates was accepted")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	var gotAuth atomic.Value
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth.Store(r.Header.Get("Authorization"))
+		fmt.Fprint(w, `[]`)
+	})
+
+	_, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.GitHubToken = "static-token"
+	})
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if got := gotAuth.Load(); got != "Bearer static-token" {
+		t.Errorf("static token Authorization = %q, want %q", got, "Bearer static-token")
+	}
+
+	var applied atomic.Int32
+	srv, url := newTestServer(t, upstream, nil)
+	srv.api.auth = authFunc(func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("Authorization", fmt.Sprintf("token installation-%d", applied.Add(1)))
+		return nil
+	})
+	get(t, url+"/")
+	if got := gotAuth.Load(); got != "token installation-1" {
+		t.Errorf("stub Authorization = %q, want %q", got, "token installation-1")
+	}
+
+	srv, url = newTestServer(t, upstream, nil)
+	srv.api.auth = authFunc(func(context.Context, *http.Request) error {
+		return errors.New("token refresh failed")
+	})
+	if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "upstream authentication failed") {
+		t.Errorf("failing authenticator: %d %s, want 500 upstream authentication failed", resp.StatusCode, body)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a"},{"name":"b"}]`), func(cfg *Config) {
+		cfg.CacheTTL = time.Minute
+	})
+
+	for _, wantCached := range []bool{false, true} {
+		_, body := get(t, url+"/?envelope=true")
+
+		var got struct {
+			Data apiresponse.Repos `json:"data"`
+			Meta map[string]any    `json:"meta"`
+		}
+		dec := json.NewDecoder(strings.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("body %s is not an envelope: %v", body, err)
+		}
+		if len(got.Data) != 2 {
+			t.Errorf("envelope data holds %d repos, want 2", len(got.Data))
+		}
+		if got.Meta["count"] != 2.0 || got.Meta["cached"] != wantCached {
+			t.Errorf("meta = %v, want count 2 and cached %t", got.Meta, wantCached)
+		}
+		if _, ok := got.Meta["upstream_ms"].(float64); !ok {
+			t.Errorf("meta = %v, want upstream_ms", got.Meta)
+		}
+	}
+
+	if _, body := get(t, url+"/"); !slices.Equal(repoNames(t, body), []string{"a", "b"}) {
+		t.Errorf("bare response = %s, want the repos array", body)
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		configure func(*Config)
+		want      string
+	}{
+		{"from cache TTL", func(cfg *Config) { cfg.CacheTTL = 90 * time.Second }, "max-age=90"},
+		{"with stale-while-revalidate", func(cfg *Config) {
+			cfg.CacheTTL = time.Minute
+			cfg.CacheStaleWhileRevalidate = 30 * time.Second
+		}, "max-age=60, stale-while-revalidate=30"},
+		{"configured", func(cfg *Config) {
+			cfg.CacheTTL = time.Minute
+			cfg.CacheControl = "public, max-age=300"
+		}, "public, max-age=300"},
+		{"caching disabled", func(cfg *Config) { cfg.CacheTTL = 0 }, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), tt.configure)
+
+			resp, body := get(t, url+"/")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+			if got := resp.Header.Get("Vary"); got != "Accept, Accept-Encoding" {
+				t.Errorf("Vary = %q, want %q", got, "Accept, Accept-Encoding")
+			}
+
+			// Errors must not be cached by a CDN.
+			resp, _ = get(t, url+"/?limit=0")
+			if got := resp.Header.Get("Cache-Control"); got != "" {
+				t.Errorf("Cache-Control on a 400 = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestGzipUpstream(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	fmt.Fprint(zw, `[{"name":"a"},{"name":"b"}]`)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		body       []byte
+		wantStatus int
+	}{
+		{"gzipped", gz.Bytes(), http.StatusOK},
+		{"corrupt", []byte("not gzip"), http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, url := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(tt.body)
+			}), nil)
+
+			// Asking for gzip explicitly stops the transport decoding it.
+			srv.api.auth = authFunc(func(_ context.Context, req *http.Request) error {
+				req.Header.Set("Accept-Encoding", "gzip")
+				return nil
+			})
+
+			resp, body := get(t, url+"/")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusOK && !slices.Equal(repoNames(t, body), []string{"a", "b"}) {
+				t.Errorf("body = %s, want repos a and b", body)
+			}
+		})
+	}
+}
+
+func TestDebugLogBodies(t *testing.T) {
+	const token = "ghp-debug-token"
+	upstream := reposUpstream(`[{"name":"a","description":"leaked ` + token + `"}]`)
+
+	for _, tt := range []struct {
+		name      string
+		enabled   bool
+		maxBytes  int
+		truncated bool
+	}{
+		{"disabled", false, 4096, false},
+		{"enabled", true, 4096, false},
+		{"truncated", true, 8, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			_, url := newTestServerWithLogger(t, upstream, func(cfg *Config) {
+				cfg.GitHubToken = token
+				cfg.DebugLogBodies = tt.enabled
+				cfg.DebugLogMaxBytes = tt.maxBytes
+			}, log.New(&logs, "", 0))
+			get(t, url+"/")
+			got := logs.String()
+
+			if strings.Contains(got, token) {
+				t.Errorf("log contains the token:\n%s", got)
+			}
+			for _, want := range []string{"DEBUG: upstream", "DEBUG: downstream"} {
+				if strings.Contains(got, want) != tt.enabled {
+					t.Errorf("log contains %q = %t, want %t:\n%s", want, !tt.enabled, tt.enabled, got)
+				}
+			}
+			if !tt.enabled {
+				return
+			}
+			if !strings.Contains(got, "Authorization:[REDACTED]") {
+				t.Errorf("upstream Authorization header not redacted:\n%s", got)
+			}
+			if strings.Contains(got, "(truncated)") != tt.truncated {
+				t.Errorf("log truncated = %t, want %t:\n%s", !tt.truncated, tt.truncated, got)
+			}
+			if !tt.truncated && !strings.Contains(got, `leaked REDACTED`) {
+				t.Errorf("body not logged with the token redacted:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestRetryTimeoutsAnd5xxIndependently(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		firstFailure  string
+		retryTimeouts bool
+		retry5xx      bool
+		wantCalls     int32
+		wantOK        bool
+	}{
+		{"502 retried", "502", false, true, 2, true},
+		{"502 not retried", "502", true, false, 1, false},
+		{"timeout retried", "timeout", true, false, 2, true},
+		{"timeout not retried", "timeout", false, true, 1, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					switch tt.firstFailure {
+					case "502":
+						http.Error(w, "bad gateway", http.StatusBadGateway)
+					case "timeout":
+						<-r.Context().Done()
+					}
+					return
+				}
+				fmt.Fprint(w, `[{"name":"a"}]`)
+			})
+			_, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.MaxRetries = 1
+				cfg.RetryTimeouts = tt.retryTimeouts
+				cfg.Retry5xx = tt.retry5xx
+				cfg.RetryBackoff = time.Millisecond
+				cfg.RetryBackoffCap = time.Millisecond
+				cfg.UpstreamAttemptTimeout = 50 * time.Millisecond
+			})
+
+			resp, body := get(t, url+"/")
+			if ok := resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+				t.Errorf("status = %d: %s, want success %t", resp.StatusCode, body, tt.wantOK)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	canary := httptest.NewServer(reposUpstream(`[{"name":"canary"}]`))
+	t.Cleanup(canary.Close)
+	canaryHost := strings.TrimPrefix(canary.URL, "http://")
+
+	for _, tt := range []struct {
+		name    string
+		allow   bool
+		trusted string
+		hosts   []string
+		want    string
+	}{
+		{"honoured", true, "127.0.0.1", []string{canaryHost}, "canary"},
+		{"flag off", false, "127.0.0.1", []string{canaryHost}, "primary"},
+		{"untrusted peer", true, "10.0.0.0/8", []string{canaryHost}, "primary"},
+		{"host not allowed", true, "127.0.0.0/8", []string{"ghe.example.com"}, "primary"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, reposUpstream(`[{"name":"primary"}]`), func(cfg *Config) {
+				cfg.AllowUpstreamOverride = tt.allow
+				cfg.TrustedProxies = []string{tt.trusted}
+				cfg.UpstreamOverrideHosts = tt.hosts
+			})
+
+			_, body := get(t, url+"/", UpstreamOverrideHeader, canaryHost)
+			if got := repoNames(t, body); !slices.Equal(got, []string{tt.want}) {
+				t.Errorf("served repos %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorTypes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/unauthorized", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/invalid", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"not":"repos"`)
+	})
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, `[{"name":`)
+	})
+	srv, _ := newTestServer(t, mux, nil)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	fetch := func(url string) error {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = srv.api.fetchPage(req)
+		return err
+	}
+
+	for _, tt := range []struct {
+		name       string
+		url        string
+		want       []error
+		wantStatus int
+	}{
+		{"unreachable", closed.URL, []error{apierror.ErrUpstreamUnreachable}, 0},
+		{"status", srv.api.apiURL + "/unavailable", nil, http.StatusServiceUnavailable},
+		{"unauthorized", srv.api.apiURL + "/unauthorized", []error{apierror.ErrUpstreamAuth}, http.StatusUnauthorized},
+		{"decode", srv.api.apiURL + "/invalid", []error{apierror.ErrUpstreamDecode}, 0},
+		{"truncated", srv.api.apiURL + "/truncated", []error{apierror.ErrUpstreamDecode, apierror.ErrUpstreamTruncated}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fetch(tt.url)
+			if err == nil {
+				t.Fatal("fetchPage succeeded")
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("error %v is not %v", err, want)
+				}
+			}
+
+			var statusErr *apierror.UpstreamStatusError
+			if got := errors.As(err, &statusErr); got != (tt.wantStatus != 0) {
+				t.Fatalf("error %v is an UpstreamStatusError = %t, want %t", err, got, tt.wantStatus != 0)
+			}
+			if statusErr != nil && statusErr.Code != tt.wantStatus {
+				t.Errorf("status code = %d, want %d", statusErr.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	srv.api.auth = authFunc(func(context.Context, *http.Request) error {
+		return errors.New("no token")
+	})
+	if err := fetch(srv.api.apiURL + "/unavailable"); !errors.Is(err, apierror.ErrUpstreamAuth) {
+		t.Errorf("failing authenticator error %v is not %v", err, apierror.ErrUpstreamAuth)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	})
+	srv, url := newTestServer(t, upstream, func(cfg *Config) {
+		cfg.MaxInFlight = 2
+		cfg.MaxActiveAPIRequests = 4
+	})
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 2)
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := get(t, url+"/")
+			statuses <- resp.StatusCode
+		}()
+	}
+	waitFor(t, "both requests to be in flight", func() bool { return srv.limiter.total() == 2 })
+
+	for range 3 {
+		start := time.Now()
+		if resp, body := get(t, url+"/"); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status past the ceiling = %d, want %d: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("shedding a request took %s, want it immediate", elapsed)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("in-flight request status = %d, want %d", status, http.StatusOK)
+		}
+	}
+
+	if resp, _ := get(t, url+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status once below the ceiling = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestUpstreamAuthFailure(t *testing.T) {
+	const token = "ghp-expired-token"
+
+	for _, tt := range []struct {
+		upstreamStatus int
+		wantStatus     int
+		wantAuthLog    bool
+	}{
+		{http.StatusUnauthorized, http.StatusInternalServerError, true},
+		// GitHub also sends 403 for an exhausted rate limit, so it isn't
+		// reported as a credentials problem.
+		{http.StatusForbidden, http.StatusBadGateway, false},
+	} {
+		t.Run(strconv.Itoa(tt.upstreamStatus), func(t *testing.T) {
+			var logs strings.Builder
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message":"Bad credentials"}`, tt.upstreamStatus)
+			})
+			_, url := newTestServerWithLogger(t, upstream, func(cfg *Config) {
+				cfg.GitHubToken = token
+			}, log.New(&logs, "", 0))
+
+			resp, body := get(t, url+"/")
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := strings.Contains(body, "upstream authentication failed"); got != tt.wantAuthLog {
+				t.Errorf("body %q reports an authentication failure = %t, want %t", body, got, tt.wantAuthLog)
+			}
+			if got := strings.Contains(logs.String(), "ERROR: upstream authentication failed"); got != tt.wantAuthLog {
+				t.Errorf("authentication failure logged = %t, want %t:\n%s", got, tt.wantAuthLog, logs.String())
+			}
+			if strings.Contains(body, token) || strings.Contains(logs.String(), token) {
+				t.Error("the token was exposed")
+			}
+		})
+	}
+}
+
+func TestVisibilityFilters(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[
+		{"name":"plain","visibility":"public"},
+		{"name":"fork","fork":true,"visibility":"public"},
+		{"name":"archived","archived":true,"visibility":"public"},
+		{"name":"secret","private":true,"visibility":"private"},
+		{"name":"legacy-private","private":true},
+		{"name":"legacy-public"},
+		{"name":"inner","visibility":"internal"},
+		{"name":"old-fork","fork":true,"archived":true,"visibility":"public"}
+	]`), nil)
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"?exclude_forks=true", []string{"plain", "archived", "secret", "legacy-private", "legacy-public", "inner"}},
+		{"?exclude_archived=true", []string{"plain", "fork", "secret", "legacy-private", "legacy-public", "inner"}},
+		{"?exclude_forks=false", []string{"plain", "fork", "archived", "secret", "legacy-private", "legacy-public", "inner", "old-fork"}},
+		{"?visibility=public", []string{"plain", "fork", "archived", "legacy-public", "old-fork"}},
+		{"?visibility=private", []string{"secret", "legacy-private"}},
+		{"?visibility=internal", []string{"inner"}},
+		{"?visibility=public&exclude_forks=true&exclude_archived=true", []string{"plain", "legacy-public"}},
+	} {
+		resp, body := get(t, url+"/"+tt.query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.query, resp.StatusCode, http.StatusOK, body)
+		}
+		if got := repoNames(t, body); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: repos = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	if resp, _ := get(t, url+"/?visibility=secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown visibility status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestUpstreamPassthrough(t *testing.T) {
+	const query = "?sort=pushed&direction=desc&per_page=50&type=owner&since=2020-01-01&limit=5"
+
+	for _, tt := range []struct {
+		name        string
+		passthrough bool
+		want        url.Values
+	}{
+		{"on", true, url.Values{
+			"sort":      {"pushed"},
+			"direction": {"desc"},
+			"per_page":  {"50"},
+			"type":      {"owner"},
+		}},
+		{"off", false, url.Values{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got atomic.Value
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got.Store(r.URL.Query())
+				fmt.Fprint(w, `[]`)
+			})
+			_, srvURL := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.UpstreamPassthrough = tt.passthrough
+			})
+
+			if resp, body := get(t, srvURL+"/"+query); resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+			}
+			if got := got.Load(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("upstream query = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, srvURL := newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.UpstreamPassthrough = true
+	})
+	if resp, body := get(t, srvURL+"/?per_page=500"); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, `"param":"per_page"`) {
+		t.Errorf("per_page=500: %d %s, want a 400 naming per_page", resp.StatusCode, body)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[
+		{"name":"a","language":"Go","stargazers_count":10,"forks_count":2,"pushed_at":"2024-03-01T00:00:00Z"},
+		{"name":"b","language":"Go","stargazers_count":5,"forks_count":1,"pushed_at":"2024-06-15T12:30:00Z"},
+		{"name":"c","language":"Python","stargazers_count":1,"forks_count":0,"pushed_at":"2023-01-01T00:00:00Z"},
+		{"name":"d","fork":true,"stargazers_count":100,"forks_count":7}
+	]`), nil)
+
+	summarize := func(query string) apiresponse.Summary {
+		t.Helper()
+		resp, body := get(t, url+"/summary"+query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+		}
+		var s apiresponse.Summary
+		if err := json.Unmarshal([]byte(body), &s); err != nil {
+			t.Fatalf("invalid summary %s: %v", body, err)
+		}
+		return s
+	}
+
+	lastPush := time.Date(2024, 6, 15, 12, 30, 0, 0, time.UTC)
+	got := summarize("")
+	want := apiresponse.Summary{
+		Repos:        4,
+		Stars:        116,
+		Forks:        10,
+		Languages:    map[string]int{"Go": 2, "Python": 1, apiresponse.UnknownLanguage: 1},
+		LastPushedAt: &lastPush,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %+v, want %+v", got, want)
+	}
+
+	// Filters apply before aggregating.
+	if got := summarize("?exclude_forks=true"); got.Repos != 3 || got.Stars != 16 || got.Forks != 3 {
+		t.Errorf("summary without forks = %+v, want 3 repos, 16 stars and 3 forks", got)
+	}
+}
+
+func TestRequireUpstreamOnStart(t *testing.T) {
+	srv, _ := newTestServer(t, reposUpstream(`[]`), nil)
+	if err := srv.api.checkUpstream(context.Background()); err != nil {
+		t.Errorf("check against a reachable upstream failed: %v", err)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	srv, _ = newTestServer(t, http.NotFoundHandler(), func(cfg *Config) {
+		cfg.APIURL = down.URL
+	})
+	if err := srv.api.checkUpstream(context.Background()); !errors.Is(err, apierror.ErrUpstreamUnreachable) {
+		t.Errorf("check against an unreachable upstream = %v, want %v", err, apierror.ErrUpstreamUnreachable)
+	}
+
+	// Start fails before serving when the check is required.
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.APIURL = down.URL
+	cfg.LogFile = filepath.Join(t.TempDir(), "apiserver.log")
+	cfg.RequireUpstreamOnStart = true
+	if err := Start(cfg); err == nil || !strings.Contains(err.Error(), "upstream check failed") {
+		t.Errorf("Start = %v, want an upstream check failure", err)
+	}
+}
+
+func TestTruncatedUpstreamResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		retries    int
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"not retried", 0, http.StatusBadGateway, 1},
+		{"retried", 1, http.StatusOK, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := `[{"name":"a"}]`
+				if calls.Add(1) == 1 {
+					// Promise more than is sent, so the connection closes mid-body.
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)+100))
+				}
+				io.WriteString(w, body)
+			})
+			var logs strings.Builder
+			_, url := newTestServerWithLogger(t, upstream, func(cfg *Config) {
+				cfg.MaxRetries = tt.retries
+				cfg.RetryBackoff = time.Millisecond
+				cfg.RetryBackoffCap = time.Millisecond
+			}, log.New(&logs, "", 0))
+
+			resp, body := get(t, url+"/")
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+			if tt.wantStatus == http.StatusBadGateway {
+				if !strings.Contains(body, "truncated upstream response") {
+					t.Errorf("body = %q, want it to report the truncation", body)
+				}
+				if !strings.Contains(logs.String(), "ERROR: truncated upstream response") {
+					t.Errorf("truncation not logged distinctly:\n%s", logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownAbortsBackoff(t *testing.T) {
+	// With room for a single request, every request is delayed by at least a
+	// second, and shutdown must cut that short.
+	srv, url := newTestServer(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 1
+	})
+
+	type result struct {
+		status int
+		at     time.Time
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, _ := get(t, url+"/")
+		done <- result{resp.StatusCode, time.Now()}
+	}()
+	waitFor(t, "the request to back off", func() bool { return srv.limiter.stats().Waiting == 1 })
+
+	closed := time.Now()
+	close(srv.shutdown)
+
+	res := <-done
+	if res.status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", res.status, http.StatusServiceUnavailable)
+	}
+	if took := res.at.Sub(closed); took > 500*time.Millisecond {
+		t.Errorf("request took %s to abort after shutdown, want it prompt", took)
+	}
+	if active := srv.limiter.total(); active != 0 {
+		t.Errorf("limiter holds %d slots after the abort, want 0", active)
+	}
+}
+
+// lockedBuffer is a log destination safe to read while the server writes to
+// it from background goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestLatencyByRoute(t *testing.T) {
+	var logs lockedBuffer
+	clk := clock.NewFake(time.Now())
+	_, url := newTestServerWithClock(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.StatsInterval = time.Minute
+	}, log.New(&logs, "", 0), clk)
+
+	get(t, url+"/")
+	get(t, url+"/")
+	get(t, url+"/summary")
+	get(t, url+"/summary?visibility=public")
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	waitFor(t, "the latency to be logged", func() bool {
+		return strings.Count(logs.String(), "INFO: latency") == 2
+	})
+
+	got := logs.String()
+	for _, want := range []string{`route="/{$}" window=1m0s count=2`, `route="GET /summary" window=1m0s count=2`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("latency log is missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "visibility") {
+		t.Errorf("latency is labelled with the raw request:\n%s", got)
+	}
+}
+
+func TestKeyCase(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[{"name":"a","html_url":"https://github.com/tcuthbert/a","stargazers_count":3,"forks_count":1,"pushed_at":"2024-01-01T00:00:00Z"}]`), nil)
+
+	keys := func(query string) []string {
+		t.Helper()
+		_, body := get(t, url+"/"+query)
+		var repos []map[string]any
+		if err := json.Unmarshal([]byte(body), &repos); err != nil || len(repos) != 1 {
+			t.Fatalf("%s: body %s is not one repo: %v", query, body, err)
+		}
+		return slices.Sorted(maps.Keys(repos[0]))
+	}
+
+	snake := keys("")
+	if got := keys("?case=snake"); !slices.Equal(got, snake) {
+		t.Errorf("case=snake keys = %q, want the default %q", got, snake)
+	}
+	for _, want := range []string{"html_url", "stargazers_count", "forks_count", "pushed_at"} {
+		if !slices.Contains(snake, want) {
+			t.Errorf("default keys %q are missing %q", snake, want)
+		}
+	}
+
+	camel := keys("?case=camel")
+	for _, want := range []string{"name", "htmlUrl", "stargazersCount", "forksCount", "pushedAt"} {
+		if !slices.Contains(camel, want) {
+			t.Errorf("camel keys %q are missing %q", camel, want)
+		}
+	}
+	if len(camel) != len(snake) {
+		t.Errorf("camel case has %d keys, want %d", len(camel), len(snake))
+	}
+	for _, key := range camel {
+		if strings.Contains(key, "_") {
+			t.Errorf("camel key %q still has an underscore", key)
+		}
+	}
+}
+
+func TestHMACSignedUpstreamRequests(t *testing.T) {
+	const secret = "s3cr3t-hmac-key"
+
+	// The verifier rebuilds the signing string from what it received, as an
+	// authenticating proxy would.
+	var verified, signed atomic.Int32
+	verifier := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig := r.Header.Get(SignatureHeader)
+		if sig == "" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		signed.Add(1)
+
+		ts := r.Header.Get(SignatureTimestampHeader)
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.Host, r.URL.RequestURI(), ts)
+		if !hmac.Equal([]byte(sig), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if n, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(n, 0)).Abs() > time.Minute {
+			http.Error(w, "stale signature", http.StatusForbidden)
+			return
+		}
+		verified.Add(1)
+		fmt.Fprint(w, `[]`)
+	})
+
+	_, url := newTestServer(t, verifier, func(cfg *Config) {
+		cfg.UpstreamHMACSecret = secret
+		cfg.UpstreamPassthrough = true
+	})
+	for _, query := range []string{"", "?sort=pushed&per_page=10"} {
+		if resp, body := get(t, url+"/"+query); resp.StatusCode != http.StatusOK {
+			t.Errorf("%q: status = %d, want %d: %s", query, resp.StatusCode, http.StatusOK, body)
+		}
+	}
+	if got := verified.Load(); got != 2 {
+		t.Errorf("verified %d signed requests, want 2", got)
+	}
+
+	_, url = newTestServer(t, verifier, nil)
+	get(t, url+"/")
+	if got := signed.Load(); got != 2 {
+		t.Errorf("%d signed requests in total, want only the 2 made with a secret", got)
+	}
+}
+
+func TestRetryBudgetTapersRetries(t *testing.T) {
+	var calls atomic.Int32
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	_, url := newTestServer(t, failing, func(cfg *Config) {
+		cfg.MaxRetries = 1
+		cfg.Retry5xx = true
+		cfg.RetryBackoff = time.Millisecond
+		cfg.RetryBackoffCap = time.Millisecond
+		cfg.RetryBudgetRatio = 0.1
+	})
+
+	// retried records, per request, whether it was retried.
+	var retried []bool
+	for range 60 {
+		before := calls.Load()
+		if resp, _ := get(t, url+"/"); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+		}
+		retried = append(retried, calls.Load()-before > 1)
+	}
+
+	count := func(rs []bool) (n int) {
+		for _, r := range rs {
+			if r {
+				n++
+			}
+		}
+		return n
+	}
+	// The full bucket allows a burst of retries, after which only one
+	// request in ten earns enough budget for a retry.
+	if n := count(retried[:10]); n != 10 {
+		t.Errorf("%d of the first 10 requests retried, want all", n)
+	}
+	if n := count(retried[30:]); n > 4 {
+		t.Errorf("%d of the last 30 requests retried, want at most 4 once the budget is spent", n)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	for _, names := range []string{"metrics", "cache,retry", "none"} {
+		t.Run(names, func(t *testing.T) {
+			features, err := ParseFeatures(names)
+			if err != nil {
+				t.Fatalf("ParseFeatures(%q): %v", names, err)
+			}
+			if got := features.String(); got != names {
+				t.Errorf("String() = %q, want %q", got, names)
+			}
+
+			var calls atomic.Int32
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					http.Error(w, "bad gateway", http.StatusBadGateway)
+					return
+				}
+				fmt.Fprint(w, `[]`)
+			})
+			_, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.Features = features
+				cfg.CacheTTL = time.Minute
+				cfg.MaxRetries = 1
+				cfg.Retry5xx = true
+				cfg.RetryBackoff = time.Millisecond
+				cfg.RetryBackoffCap = time.Millisecond
+			})
+
+			resp, _ := get(t, url+"/")
+			if retried := resp.StatusCode == http.StatusOK; retried != features.Retry {
+				t.Errorf("failed upstream attempt retried = %t, want %t", retried, features.Retry)
+			}
+
+			get(t, url+"/")
+			before := calls.Load()
+			get(t, url+"/")
+			if cached := calls.Load() == before; cached != features.Cache {
+				t.Errorf("repeat request cached = %t, want %t", cached, features.Cache)
+			}
+
+			resp, _ = get(t, url+"/stats")
+			if served := resp.StatusCode == http.StatusOK; served != features.Metrics {
+				t.Errorf("/stats served = %t, want %t", served, features.Metrics)
+			}
+		})
+	}
+
+	if _, err := ParseFeatures("cache,tracing"); err == nil || !strings.Contains(err.Error(), `unknown feature "tracing"`) {
+		t.Errorf("ParseFeatures with an unknown feature = %v, want an error naming it", err)
+	}
+}
+
+func TestEmptyAs204(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		emptyAs204 bool
+		upstream   string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"default empty", false, `[]`, "", http.StatusOK, "[]"},
+		{"empty", true, `[]`, "", http.StatusNoContent, ""},
+		{"empty after filtering", true, `[{"name":"a","fork":true}]`, "?exclude_forks=true", http.StatusNoContent, ""},
+		{"not empty", true, `[{"name":"a"}]`, "", http.StatusOK, `"name":"a"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, reposUpstream(tt.upstream), func(cfg *Config) {
+				cfg.EmptyAs204 = tt.emptyAs204
+			})
+
+			resp, body := get(t, url+"/"+tt.query)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantBody == "" && body != "" {
+				t.Errorf("body = %q, want none", body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	for _, tt := range []struct {
+		name        string
+		propagate   bool
+		correlation string
+		want        http.Header
+	}{
+		{"off", false, "", http.Header{}},
+		{"trace", true, "", http.Header{
+			"Traceparent": {traceparent},
+			"Tracestate":  {"congo=t61rcWkgMzE"},
+		}},
+		{"correlation only", false, "X-Request-ID", http.Header{
+			"X-Request-Id": {"req-42"},
+		}},
+		{"both", true, "x-request-id", http.Header{
+			"Traceparent":  {traceparent},
+			"Tracestate":   {"congo=t61rcWkgMzE"},
+			"X-Request-Id": {"req-42"},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got atomic.Value
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := http.Header{}
+				for _, name := range []string{"Traceparent", "Tracestate", "X-Request-Id", "X-Unrelated"} {
+					if v := r.Header.Values(name); len(v) > 0 {
+						h[name] = v
+					}
+				}
+				got.Store(h)
+				fmt.Fprint(w, `[]`)
+			})
+			_, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.PropagateTrace = tt.propagate
+				cfg.CorrelationHeader = tt.correlation
+			})
+
+			get(t, url+"/",
+				"traceparent", traceparent,
+				"tracestate", "congo=t61rcWkgMzE",
+				"X-Request-ID", "req-42",
+				"X-Unrelated", "not forwarded",
+			)
+			if got := got.Load(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("upstream headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestItemRange(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(fiveRepos), nil)
+
+	for _, tt := range []struct {
+		rangeHeader      string
+		wantStatus       int
+		wantContentRange string
+		want             []string
+	}{
+		{"items=1-2", http.StatusPartialContent, "items 1-2/5", []string{"b", "c"}},
+		{"items=3-", http.StatusPartialContent, "items 3-4/5", []string{"d", "e"}},
+		{"items=4-100", http.StatusPartialContent, "items 4-4/5", []string{"e"}},
+		{"items=5-9", http.StatusRequestedRangeNotSatisfiable, "items */5", nil},
+		// Ranges that can't be parsed are ignored, serving the full list.
+		{"bytes=0-10", http.StatusOK, "", []string{"a", "b", "c", "d", "e"}},
+		{"items=3-1", http.StatusOK, "", []string{"a", "b", "c", "d", "e"}},
+	} {
+		resp, body := get(t, url+"/", "Range", tt.rangeHeader)
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.rangeHeader, resp.StatusCode, tt.wantStatus, body)
+			continue
+		}
+		if got := resp.Header.Get("Content-Range"); got != tt.wantContentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.rangeHeader, got, tt.wantContentRange)
+		}
+		if got := resp.Header.Get("Accept-Ranges"); got != "items" {
+			t.Errorf("%s: Accept-Ranges = %q, want %q", tt.rangeHeader, got, "items")
+		}
+		if tt.want != nil && !slices.Equal(repoNames(t, body), tt.want) {
+			t.Errorf("%s: repos = %q, want %q", tt.rangeHeader, repoNames(t, body), tt.want)
+		}
+	}
+}
+
+func TestRouteUpstreamTimeouts(t *testing.T) {
+	upstream := slowUpstream(200*time.Millisecond, `[{"name":"a"}]`)
+
+	for _, tt := range []struct {
+		name            string
+		global, summary time.Duration
+		wantRoot        int
+		wantSummary     int
+	}{
+		{"slow route given longer", 50 * time.Millisecond, 2 * time.Second, http.StatusGatewayTimeout, http.StatusOK},
+		{"fast route kept tight", 2 * time.Second, 50 * time.Millisecond, http.StatusOK, http.StatusGatewayTimeout},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			timeouts, err := ParseRouteTimeouts("/summary=" + tt.summary.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.UpstreamTimeout = tt.global
+				cfg.RouteUpstreamTimeouts = timeouts
+				cfg.CacheTTL = 0
+			})
+
+			if resp, body := get(t, url+"/"); resp.StatusCode != tt.wantRoot {
+				t.Errorf("/ status = %d, want %d: %s", resp.StatusCode, tt.wantRoot, body)
+			}
+			if resp, body := get(t, url+"/summary"); resp.StatusCode != tt.wantSummary {
+				t.Errorf("/summary status = %d, want %d: %s", resp.StatusCode, tt.wantSummary, body)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIURL = "http://127.0.0.1:1"
+	cfg.RouteUpstreamTimeouts = map[string]time.Duration{"/search": time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := newWebserver(ctx, &cfg, log.New(io.Discard, "", 0), clock.Real{}); err == nil {
+		t.Error("a timeout for an unknown route was accepted")
+	}
+}
+
+func TestWriteTimeoutMidResponse(t *testing.T) {
+	repos, err := json.Marshal(fixtureRepos(30000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs lockedBuffer
+	srv, _ := newTestServerWithLogger(t, reposUpstream(string(repos)), func(cfg *Config) {
+		cfg.WriteTimeout = 200 * time.Millisecond
+	}, log.New(&logs, "", 0))
+
+	// Serve on srv's own http.Server, which carries the write timeout.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client too slow to read fills the socket buffers, so the response
+	// can't be written before the write timeout.
+	time.Sleep(500 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, _ := io.Copy(io.Discard, conn)
+	if received >= int64(len(repos)) {
+		t.Fatalf("received %d bytes, want the %d byte response cut short", received, len(repos))
+	}
+
+	waitFor(t, "the truncated response to be logged", func() bool {
+		return strings.Contains(logs.String(), "ERROR: client received a truncated response")
+	})
+	if got := logs.String(); !strings.Contains(got, "write-timeout=true") {
+		t.Errorf("truncation not attributed to the write timeout:\n%s", got)
+	}
+}
+
+func TestFaviconAndRobotsSkipUpstream(t *testing.T) {
+	customRobots := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(customRobots, []byte("User-agent: *\nAllow: /\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		robotsFile string
+		wantRobots string
+	}{
+		{"default", "", DefaultRobotsTxt},
+		{"configured", customRobots, "User-agent: *\nAllow: /\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				fmt.Fprint(w, `[]`)
+			})
+			srv, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.RobotsTxtFile = tt.robotsFile
+				cfg.MaxActiveAPIRequests = 2
+			})
+
+			// With the limiter full, anything passing through it would queue.
+			for range 2 {
+				if _, err := srv.limiter.acquire(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				defer srv.limiter.release()
+			}
+
+			resp, body := get(t, url+"/favicon.ico")
+			if resp.StatusCode != http.StatusNoContent || body != "" {
+				t.Errorf("/favicon.ico = %d %q, want an empty 204", resp.StatusCode, body)
+			}
+
+			resp, body = get(t, url+"/robots.txt")
+			if resp.StatusCode != http.StatusOK || body != tt.wantRobots {
+				t.Errorf("/robots.txt = %d %q, want 200 %q", resp.StatusCode, body, tt.wantRobots)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Errorf("/robots.txt Content-Type = %q, want text/plain", got)
+			}
+
+			if n := calls.Load(); n != 0 {
+				t.Errorf("upstream called %d times, want 0", n)
+			}
+		})
+	}
+}
+
+func TestBackoffHeader(t *testing.T) {
+	_, url := newTestServer(t, reposUpstream(`[]`), nil)
+	if resp, _ := get(t, url+"/"); resp.Header.Get(BackoffHeader) != "" {
+		t.Errorf("%s = %q without contention, want none", BackoffHeader, resp.Header.Get(BackoffHeader))
+	}
+
+	// With room for a single request, every request is backed off.
+	clk := clock.NewFake(time.Now())
+	_, url = newTestServerWithClock(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 1
+	}, log.New(io.Discard, "", 0), clk)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := get(t, url+"/")
+		done <- resp
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(4 * time.Second)
+	resp := <-done
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	d, err := time.ParseDuration(resp.Header.Get(BackoffHeader))
+	if err != nil || d < time.Second || d > 4*time.Second {
+		t.Errorf("%s = %q, want the 1-4s back-off applied", BackoffHeader, resp.Header.Get(BackoffHeader))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	const adminKey = "admin-key-do-not-log"
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	var logs strings.Builder
+	_, url := newTestServerWithLogger(t, reposUpstream(`[]`), func(cfg *Config) {
+		cfg.AdminAPIKeys = []string{"other-key", adminKey}
+		cfg.AuditLogFile = auditFile
+		cfg.CacheTTL = time.Minute
+	}, log.New(&logs, "", 0))
+
+	flush := func(key string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, url+"/admin/cache/flush", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	before := time.Now().UTC()
+	okStatus := flush(adminKey)
+	deniedStatus := flush("")
+
+	b, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), adminKey) || strings.Contains(logs.String(), adminKey) {
+		t.Fatal("the admin key was logged")
+	}
+	if strings.Contains(logs.String(), "AUDIT:") {
+		t.Errorf("audit records written to the main log as well as the audit file:\n%s", logs.String())
+	}
+
+	var records []auditRecord
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("invalid audit record in %s: %v", b, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d audit records, want 2:\n%s", len(records), b)
+	}
+
+	for i, want := range []auditRecord{
+		{Action: "cache.flush", Actor: "key:" + keyID(adminKey), RemoteIP: "127.0.0.1", Status: okStatus},
+		{Action: "cache.flush", Actor: "anonymous", RemoteIP: "127.0.0.1", Status: deniedStatus},
+	} {
+		got := records[i]
+		if got.Time.Before(before.Add(-time.Second)) || got.Time.After(time.Now().Add(time.Second)) {
+			t.Errorf("record %d time = %s, want around now", i, got.Time)
+		}
+		got.Time = time.Time{}
+		if got != want {
+			t.Errorf("record %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if okStatus != http.StatusOK && okStatus != http.StatusNoContent || deniedStatus != http.StatusUnauthorized {
+		t.Errorf("flush statuses = %d with the key and %d without, want success and %d", okStatus, deniedStatus, http.StatusUnauthorized)
+	}
+}
+
+func TestRawUpstreamHeaderFiltering(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Set-Cookie", "session=upstream")
+		w.Header().Set("X-GitHub-Request-Id", "ABCD:1234")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("ETag", `W/"abc"`)
+		w.Header().Set("Link", `<https://api.github.com/user/repos?page=2>; rel="next"`)
+		fmt.Fprint(w, `[]`)
+	})
+	upstreamHeaders := []string{"Set-Cookie", "X-Github-Request-Id", "X-Ratelimit-Remaining", "Etag", "Link"}
+
+	for _, tt := range []struct {
+		name    string
+		forward []string
+		strip   []string
+		want    []string
+	}{
+		{"nothing forwarded by default", nil, DefaultStrippedUpstreamHeaders, nil},
+		{"allow-list", []string{"x-ratelimit-remaining", "ETag", "Set-Cookie"}, DefaultStrippedUpstreamHeaders, []string{"X-Ratelimit-Remaining", "Etag"}},
+		{"all but stripped", []string{"*"}, DefaultStrippedUpstreamHeaders, []string{"X-Ratelimit-Remaining", "Etag", "Link"}},
+		{"custom deny-list", []string{"*"}, []string{"Link"}, []string{"Set-Cookie", "X-Github-Request-Id", "X-Ratelimit-Remaining", "Etag"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, upstream, func(cfg *Config) {
+				cfg.ForwardUpstreamHeaders = tt.forward
+				cfg.StripUpstreamHeaders = tt.strip
+			})
+
+			resp, body := get(t, url+"/raw")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+			}
+			var got []string
+			for _, name := range upstreamHeaders {
+				if resp.Header.Get(name) != "" {
+					got = append(got, name)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("forwarded upstream headers = %q, want %q", got, tt.want)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want the upstream's", ct)
+			}
+		})
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	sunset := time.Date(2027, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name       string
+		deprecate  bool
+		sunset     time.Time
+		wantSunset string
+	}{
+		{"off", false, time.Time{}, ""},
+		{"deprecated", true, time.Time{}, ""},
+		{"with sunset", true, sunset, "Mon, 01 Mar 2027 00:00:00 GMT"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, reposUpstream(`[{"name":"a"}]`), func(cfg *Config) {
+				cfg.DeprecateLegacyShape = tt.deprecate
+				cfg.LegacySunset = tt.sunset
+			})
+
+			for _, req := range []struct {
+				query, accept string
+				legacy        bool
+			}{
+				{"", "", true},
+				{"?envelope=true", "", false},
+				{"", "application/x-ndjson", false},
+			} {
+				resp, _ := get(t, url+"/"+req.query, "Accept", req.accept)
+				wantDeprecation := ""
+				wantSunset := ""
+				if req.legacy && tt.deprecate {
+					wantDeprecation, wantSunset = "true", tt.wantSunset
+				}
+				if got := resp.Header.Get("Deprecation"); got != wantDeprecation {
+					t.Errorf("%q %q: Deprecation = %q, want %q", req.query, req.accept, got, wantDeprecation)
+				}
+				if got := resp.Header.Get("Sunset"); got != wantSunset {
+					t.Errorf("%q %q: Sunset = %q, want %q", req.query, req.accept, got, wantSunset)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictUpstreamDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		strict   bool
+		upstream string
+		wantOK   bool
+	}{
+		{"lenient unknown field", false, `[{"name":"a","topics":["go"]}]`, true},
+		{"strict unknown field", true, `[{"name":"a","topics":["go"]}]`, false},
+		{"strict known fields", true, `[{"name":"a","language":"Go","fork":false}]`, true},
+		{"strict trailing data", true, `[{"name":"a"}] [{"name":"b"}]`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			_, url := newTestServerWithLogger(t, reposUpstream(tt.upstream), func(cfg *Config) {
+				cfg.StrictUpstreamDecode = tt.strict
+			}, log.New(&logs, "", 0))
+
+			resp, body := get(t, url+"/")
+			if ok := resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+				t.Fatalf("status = %d, want success %t: %s", resp.StatusCode, tt.wantOK, body)
+			}
+			if tt.wantOK {
+				return
+			}
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+			}
+			if got := logs.String(); !strings.Contains(got, "strict decode") {
+				t.Errorf("strict decode failure not logged:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestBackgroundRefreshYieldsToForeground(t *testing.T) {
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, `[{"name":"v%d"}]`, calls.Add(1))
+	})
+	clk := clock.NewFake(time.Now())
+	srv, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.MaxActiveAPIRequests = 2
+		cfg.MaxBackgroundRequests = 1
+		cfg.CacheTTL = time.Minute
+		cfg.CacheStaleWhileRevalidate = time.Hour
+	}, log.New(io.Discard, "", 0), clk)
+
+	get(t, url+"/")
+	clk.Advance(2 * time.Minute)
+
+	// A burst of client requests fills the limiter.
+	for range 2 {
+		if _, err := srv.limiter.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stale hit starts a refresh, which waits for the foreground.
+	if _, body := get(t, url+"/"); !strings.Contains(body, `"v1"`) {
+		t.Fatalf("stale hit = %s, want the first fetch", body)
+	}
+	clk.BlockUntil(1)
+	time.Sleep(20 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times while the foreground was busy, want 1", n)
+	}
+
+	srv.limiter.release()
+	srv.limiter.release()
+	clk.Advance(backgroundYieldInterval)
+	waitFor(t, "the refresh to run", func() bool { return calls.Load() == 2 })
+	waitFor(t, "the refreshed entry to be served", func() bool {
+		_, body := get(t, url+"/")
+		return strings.Contains(body, `"v2"`)
+	})
+}
+
+func TestFetchedAtHeader(t *testing.T) {
+	start := time.Date(2026, time.March, 4, 5, 6, 7, 0, time.UTC)
+	clk := clock.NewFake(start)
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprint(rw, `[{"name":"a"}]`)
+	})
+	_, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.CacheTTL = time.Minute
+	}, log.New(io.Discard, "", 0), clk)
+
+	for _, step := range []struct {
+		advance   time.Duration
+		want      time.Time
+		wantCalls int32
+	}{
+		{0, start, 1},
+		{30 * time.Second, start, 1}, // a cache hit keeps the original fetch time
+		{40 * time.Second, start.Add(70 * time.Second), 2},
+	} {
+		clk.Advance(step.advance)
+		resp, _ := get(t, url+"/")
+		if got := resp.Header.Get(FetchedAtHeader); got != step.want.Format(time.RFC3339) {
+			t.Errorf("after %s: %s = %q, want %q", step.advance, FetchedAtHeader, got, step.want.Format(time.RFC3339))
+		}
+		if got := calls.Load(); got != step.wantCalls {
+			t.Errorf("after %s: upstream called %d times, want %d", step.advance, got, step.wantCalls)
+		}
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	var logs lockedBuffer
+	srv, _ := newTestServerWithLogger(t, reposUpstream(`[]`), nil, log.New(io.Discard, "", 0))
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.MaxConnsPerIP = 2
+	ln, err := listen(context.Background(), cfg, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	dialFrom := func(ip string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	var held []net.Conn
+	for i := range 2 {
+		conn, br := dialFrom("127.0.0.1")
+		if err := roundTrip(conn, br); err != nil {
+			t.Fatalf("connection %d within the limit: %v", i, err)
+		}
+		held = append(held, conn)
+	}
+
+	// The kernel completes the handshake, so the refusal shows as the server
+	// closing the connection straight away.
+	conn, br := dialFrom("127.0.0.1")
+	if err := roundTrip(conn, br); err == nil {
+		t.Error("connection past the per-IP limit was served")
+	}
+	if got := logs.String(); !strings.Contains(got, "remote-ip=127.0.0.1 max-conns-per-ip=2") {
+		t.Errorf("refusal not logged:\n%s", got)
+	}
+
+	// Another IP has its own allowance.
+	if conn, br := dialFrom("127.0.0.2"); roundTrip(conn, br) != nil {
+		t.Error("connection from another IP was refused")
+	}
+
+	// Closing a connection frees its slot.
+	held[0].Close()
+	waitFor(t, "the closed connection's slot to be freed", func() bool {
+		conn, br := dialFrom("127.0.0.1")
+		return roundTrip(conn, br) == nil
+	})
+}
+
+func TestUpstreamAPIVersion(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("expose=%t", expose), func(t *testing.T) {
+			var version atomic.Value
+			version.Store("2022-11-28")
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("X-GitHub-Api-Version-Selected", version.Load().(string))
+				rw.Header().Set("X-GitHub-Media-Type", "github.v3; format=json")
+				fmt.Fprint(rw, `[]`)
+			})
+			var logs strings.Builder
+			_, url := newTestServerWithLogger(t, upstream, func(cfg *Config) {
+				cfg.ExposeUpstreamAPIVersion = expose
+				cfg.CacheTTL = 0
+			}, log.New(&logs, "", 0))
+
+			for _, v := range []string{"2022-11-28", "2022-11-28", "2026-03-10"} {
+				version.Store(v)
+				resp, _ := get(t, url+"/")
+				want := ""
+				if expose {
+					want = v
+				}
+				if got := resp.Header.Get(UpstreamAPIVersionHeader); got != want {
+					t.Errorf("%s = %q, want %q", UpstreamAPIVersionHeader, got, want)
+				}
+			}
+
+			got := logs.String()
+			for _, want := range []string{
+				`INFO: upstream API version: version="2022-11-28"`,
+				`WARNING: upstream API version changed: old="2022-11-28" new="2026-03-10"`,
+			} {
+				if strings.Count(got, want) != 1 {
+					t.Errorf("log should hold %q once:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeToken := func(token string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	writeToken("one", start)
+
+	var mu sync.Mutex
+	var got string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Get("Authorization")
+		mu.Unlock()
+		io.WriteString(w, `[]`)
+	})
+	clk := clock.NewFake(time.Now())
+	_, url := newTestServerWithClock(t, upstream, func(cfg *Config) {
+		cfg.GitHubTokenFile = path
+		cfg.Features.Cache = false
+	}, log.New(io.Discard, "", 0), clk)
+
+	wantAuth := func(want string) {
+		t.Helper()
+		if resp, _ := get(t, url+"/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if got != "Bearer "+want {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer "+want)
+		}
+	}
+
+	wantAuth("one")
+
+	// The file isn't checked again until the interval has passed.
+	writeToken("two", start.Add(time.Minute))
+	wantAuth("one")
+
+	clk.Advance(TokenFileCheckInterval)
+	wantAuth("two")
+
+	// A missing file keeps the last token.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(TokenFileCheckInterval)
+	wantAuth("two")
+
+	writeToken("three", start.Add(2*time.Minute))
+	clk.Advance(TokenFileCheckInterval)
+	wantAuth("three")
+}
+
+func TestKeepUpstreamWarm(t *testing.T) {
+	pings := make(chan string, 10)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings <- r.URL.Path
+	}))
+	defer up.Close()
+
+	clk := clock.NewFake(time.Now())
+	bg := newBackgroundLimiter(1, newTestLimiter(1, clk), clk)
+	shutdown := make(chan struct{})
+	stopped := make(chan struct{})
+	const interval = time.Minute
+	go func() {
+		defer close(stopped)
+		keepUpstreamWarm(context.Background(), shutdown, up.Client(), bg, up.URL+"/search/repositories", interval, log.New(io.Discard, "", 0), clk)
+	}()
+
+	wantPings := func(want int) {
+		t.Helper()
+		// The pinger waiting on the clock again means the last tick, and
+		// any ping it sent, is over.
+		clk.BlockUntil(1)
+		if got := len(pings); got != want {
+			t.Fatalf("pings = %d, want %d", got, want)
+		}
+		for range want {
+			if path := <-pings; path != "/" {
+				t.Errorf("pinged %q, want /", path)
+			}
+		}
+	}
+
+	wantPings(0)
+	clk.Advance(interval - time.Second)
+	wantPings(0)
+	clk.Advance(time.Second)
+	wantPings(1)
+	clk.Advance(interval)
+	wantPings(1)
+
+	// A ping is skipped while the background limiter is full.
+	release, ok := bg.tryAcquire()
+	if !ok {
+		t.Fatal("background limiter unexpectedly full")
+	}
+	clk.Advance(interval)
+	wantPings(0)
+	release()
+	clk.Advance(interval)
+	wantPings(1)
+
+	close(shutdown)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("pinger didn't stop on shutdown")
+	}
+	clk.Advance(interval)
+	if len(pings) != 0 {
+		t.Error("pinged after shutdown")
+	}
+}
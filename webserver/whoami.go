@@ -0,0 +1,113 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tcuthbert/apiserver/apierror"
+)
+
+type whoami struct {
+	Authenticated bool   `json:"authenticated"`
+	Login         string `json:"login,omitempty"`
+}
+
+// whoamiHandler reports the GitHub identity the configured token
+// authenticates as, for debugging a misconfigured token.
+func (ah *ApiRequestHandler) whoamiHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ctx, cancel := context.WithTimeout(ah.withPropagatedHeaders(r), ah.upstreamTimeout(r))
+		defer cancel()
+
+		var identity whoami
+		userURL := githubUserURL(ah.apiURL)
+		authenticated, err := ah.hasCredentials(ctx, userURL)
+		if err == nil && authenticated {
+			identity.Authenticated = true
+			identity.Login, err = ah.fetchLogin(ctx, userURL)
+		}
+
+		switch {
+		case errors.Is(err, apierror.ErrUpstreamAuth):
+			ah.logger.Printf("ERROR: upstream authentication failed, check the GitHub token: %v", err)
+			http.Error(rw, "upstream authentication failed", http.StatusInternalServerError)
+			return
+		case err != nil:
+			ah.logger.Printf("ERROR: whoami response-time=%s: %v", time.Since(start), err)
+			code := upstreamErrorStatus(err)
+			http.Error(rw, http.StatusText(code), code)
+			return
+		}
+
+		if err := writeJSON(rw, http.StatusOK, identity); err != nil {
+			ah.logger.Printf("io error writing response: %v", err)
+			return
+		}
+		ah.logger.Printf("INFO: whoami response-time=%s", time.Since(start))
+	}
+}
+
+// hasCredentials reports whether the authenticator attaches any credentials
+// to requests for url, which it doesn't in unauthenticated mode.
+func (ah *ApiRequestHandler) hasCredentials(ctx context.Context, url string) (bool, error) {
+	probe, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := ah.auth.Apply(ctx, probe); err != nil {
+		return false, fmt.Errorf("%w: %w", apierror.ErrUpstreamAuth, err)
+	}
+
+	return probe.Header.Get("Authorization") != "", nil
+}
+
+func (ah *ApiRequestHandler) fetchLogin(ctx context.Context, userURL string) (string, error) {
+	resp, err := ah.openRaw(ctx, userURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := readBody(resp)
+	if err != nil {
+		return "", apierror.Decode(fmt.Errorf("failed to read body: %w", err))
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.Unmarshal(b, &user); err != nil {
+		return "", apierror.Decode(err)
+	}
+
+	return user.Login, nil
+}
+
+// githubUserURL returns the authenticated user endpoint of the API serving
+// apiURL. Its base is taken to be everything before a /users/ or /orgs/
+// segment, so that GitHub Enterprise's /api/v3 prefix is kept.
+func githubUserURL(apiURL string) string {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return apiURL
+	}
+
+	base := ""
+	for _, segment := range []string{"/users/", "/orgs/"} {
+		if i := strings.Index(u.Path, segment); i >= 0 {
+			base = u.Path[:i]
+			break
+		}
+	}
+	u.Path, u.RawQuery = base+"/user", ""
+
+	return u.String()
+}
@@ -0,0 +1,90 @@
+package webserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// githubFixture serves a repos list under /users/octocat/repos and, to
+// requests carrying credentials, the authenticated user under /user.
+func githubFixture(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/users/octocat/repos":
+		io.WriteString(rw, `[{"name":"hello-world"}]`)
+	case "/user":
+		if r.Header.Get("Authorization") == "" {
+			http.Error(rw, `{"message":"Requires authentication"}`, http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(rw, `{"login":"octocat","id":1}`)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func newWhoamiServer(t *testing.T) string {
+	t.Helper()
+
+	_, url := newTestServer(t, http.HandlerFunc(githubFixture), func(cfg *Config) {
+		cfg.APIURL += "/users/octocat/repos"
+		cfg.GitHubToken = "token"
+		cfg.AdminAPIKeys = []string{"admin-key"}
+		cfg.IdempotencyTTL = time.Minute
+	})
+
+	return url
+}
+
+func TestWhoamiReportsLogin(t *testing.T) {
+	url := newWhoamiServer(t)
+
+	resp, body := get(t, url+"/whoami", "X-API-Key", "admin-key")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if want := `{"authenticated":true,"login":"octocat"}`; strings.TrimSpace(body) != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
+
+func TestWhoamiRequiresAPIKey(t *testing.T) {
+	url := newWhoamiServer(t)
+
+	resp, body := get(t, url+"/whoami")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusUnauthorized, body)
+	}
+}
+
+func TestWhoamiIdempotentReplayRequiresAPIKey(t *testing.T) {
+	url := newWhoamiServer(t)
+
+	resp, body := get(t, url+"/whoami", "X-API-Key", "admin-key", IdempotencyKeyHeader, "k1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+
+	resp, body = get(t, url+"/whoami", IdempotencyKeyHeader, "k1")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replay without a key: status = %d, want %d: %s", resp.StatusCode, http.StatusUnauthorized, body)
+	}
+	if strings.Contains(body, "octocat") {
+		t.Errorf("replay without a key leaked the identity: %s", body)
+	}
+}
+
+func TestGitHubUserURL(t *testing.T) {
+	for _, tt := range []struct{ apiURL, want string }{
+		{"https://api.github.com/users/octocat/repos", "https://api.github.com/user"},
+		{"https://api.github.com/orgs/github/repos?type=public", "https://api.github.com/user"},
+		{"https://ghe.example.com/api/v3/users/octocat/repos", "https://ghe.example.com/api/v3/user"},
+	} {
+		if got := githubUserURL(tt.apiURL); got != tt.want {
+			t.Errorf("githubUserURL(%q) = %q, want %q", tt.apiURL, got, tt.want)
+		}
+	}
+}